@@ -0,0 +1,197 @@
+package bytecode
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/x0y14/minivm/ir"
+	"github.com/x0y14/minivm/vm"
+)
+
+// examples 以下のプログラムをインタプリタとコンパイル済みの両方で実行し、出力と終了コードを比べる
+// 出力は期待する出力(READMEのPythonと同じ出力など)とも比べる。.mir は最適化してリンクしたものも比べる
+func TestExamples_SameOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string
+		stdin  string
+		want   string
+		config vm.Config
+	}{
+		{
+			name:   "fizzbuzz.mbyt",
+			files:  []string{"bytecode/fizzbuzz.mbyt"},
+			want:   fizzbuzz(),
+			config: vm.Config{StackSize: 100, HeapSize: 100},
+		},
+		{
+			name:  "brainfuck.mbyt",
+			files: []string{"bytecode/brainfuck.mbyt"},
+			// 入力が長いと時間がかかるので1文字だけ出力する
+			stdin:  "+.!",
+			want:   "\x01",
+			config: vm.Config{StackSize: 100, HeapSize: 70000},
+		},
+		{
+			name:   "calc",
+			files:  []string{"ir/calc/main.mir", "ir/calc/lib.mir", "ir/calc/fmt.mir"},
+			want:   "3\n",
+			config: vm.Config{StackSize: 100, HeapSize: 100},
+		},
+		{
+			name:   "fizzbuzz.mir",
+			files:  []string{"ir/fizzbuzz/fizzbuzz.mir"},
+			want:   fizzbuzz(),
+			config: vm.Config{StackSize: 100, HeapSize: 100},
+		},
+		{
+			name:   "input",
+			files:  []string{"ir/input/input.mir"},
+			stdin:  "minivm\n",
+			want:   "input your name: hello, minivm\n\n",
+			config: vm.Config{StackSize: 100, HeapSize: 1000},
+		},
+		{
+			name:   "kernel",
+			files:  []string{"ir/kernel/kernel.mir"},
+			want:   strings.Repeat("B\nA\n", 5) + "B\n",
+			config: vm.Config{StackSize: 200, HeapSize: 100, TimerInterval: 20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := func(engine vm.Engine, program []vm.Code) (string, int) {
+				var stdout bytes.Buffer
+				config := tt.config
+				config.Engine = engine
+				config.Stdin = strings.NewReader(tt.stdin)
+				config.Stdout = &stdout
+				runtime := vm.NewRuntime(program, &config)
+				if err := runtime.Run(); err != nil {
+					t.Fatalf("%s: Run() error = %v", engine.String(), err)
+				}
+				return stdout.String(), runtime.Status()
+			}
+			program := loadExample(t, tt.files, false)
+			wantOut, wantStatus := run(vm.EngineInterpreter, program)
+			if wantOut != tt.want {
+				t.Fatalf("interpreter: stdout = %q, want %q", wantOut, tt.want)
+			}
+			check := func(name string, out string, status int) {
+				if out != wantOut {
+					t.Errorf("%s: stdout = %q, want %q", name, out, wantOut)
+				}
+				if status != wantStatus {
+					t.Errorf("%s: Status() = %d, want %d", name, status, wantStatus)
+				}
+			}
+			out, status := run(vm.EngineCompiled, program)
+			check("compiled", out, status)
+			if strings.HasSuffix(tt.files[0], ".mir") {
+				optimized := loadExample(t, tt.files, true)
+				out, status := run(vm.EngineInterpreter, optimized)
+				check("optimized", out, status)
+			}
+		})
+	}
+}
+
+// fizzbuzz examples/ir/fizzbuzz/README.md のPythonと同じ出力
+func fizzbuzz() string {
+	var sb strings.Builder
+	for i := 1; i <= 100; i++ {
+		switch {
+		case i%15 == 0:
+			sb.WriteString("FizzBuzz\n")
+		case i%3 == 0:
+			sb.WriteString("Fizz\n")
+		case i%5 == 0:
+			sb.WriteString("Buzz\n")
+		default:
+			fmt.Fprintf(&sb, "%03d\n", i)
+		}
+	}
+	return sb.String()
+}
+
+func loadExample(t *testing.T, files []string, optimize bool) []vm.Code {
+	t.Helper()
+	var assembly string
+	if strings.HasSuffix(files[0], ".mbyt") {
+		text, err := os.ReadFile(filepath.Join("..", "examples", files[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assembly = string(text)
+	} else {
+		var srcs []ir.Source
+		for _, file := range files {
+			text, err := os.ReadFile(filepath.Join("..", "examples", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			srcs = append(srcs, ir.Source{Name: file, Text: []rune(string(text))})
+		}
+		nodes, err := ir.LinkSources(srcs, &ir.LinkConfig{Optimize: optimize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assembly = ir.Print(nodes)
+	}
+	tokens, err := Tokenize([]rune(assembly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := Gen(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+// crt0 が main の戻り値を終了コードにすること
+func TestLink_StartupExitStatus(t *testing.T) {
+	src := ir.Source{Name: "main.mir", Text: []rune(`
+.section .text:
+    global main
+main:
+    mov r0 7
+    ret
+`)}
+	startup, err := ir.DefaultStartup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := ir.LinkSources([]ir.Source{src}, &ir.LinkConfig{Startup: startup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := Tokenize([]rune(ir.Print(nodes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := Gen(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := vm.NewRuntime(program, &vm.Config{StackSize: 100, HeapSize: 100})
+	if err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Status() != 7 {
+		t.Errorf("Status() = %d, want 7", runtime.Status())
+	}
+}
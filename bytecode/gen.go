@@ -27,25 +27,67 @@ func convert(node Node) ([]vm.Code, error) {
 		return result, nil
 	case Operation:
 		op := []vm.Code{
-			NOP:     vm.NOP,
-			MOV:     vm.MOV,
-			PUSH:    vm.PUSH,
-			POP:     vm.POP,
-			ALLOC:   vm.ALLOC,
-			STORE:   vm.STORE,
-			LOAD:    vm.LOAD,
-			CALL:    vm.CALL,
-			RET:     vm.RET,
-			JMP:     vm.JMP,
-			JZ:      vm.JZ,
-			JNZ:     vm.JNZ,
-			ADD:     vm.ADD,
-			SUB:     vm.SUB,
-			EQ:      vm.EQ,
-			NE:      vm.NE,
-			LT:      vm.LT,
-			LE:      vm.LE,
-			SYSCALL: vm.SYSCALL,
+			NOP:      vm.NOP,
+			MOV:      vm.MOV,
+			PUSH:     vm.PUSH,
+			POP:      vm.POP,
+			ALLOC:    vm.ALLOC,
+			STORE:    vm.STORE,
+			LOAD:     vm.LOAD,
+			STORE8:   vm.STORE8,
+			STORE16:  vm.STORE16,
+			STORE32:  vm.STORE32,
+			STORE64:  vm.STORE64,
+			LOAD8:    vm.LOAD8,
+			LOAD16:   vm.LOAD16,
+			LOAD32:   vm.LOAD32,
+			LOAD64:   vm.LOAD64,
+			LEA:      vm.LEA,
+			CALL:     vm.CALL,
+			RET:      vm.RET,
+			ENTER:    vm.ENTER,
+			LEAVE:    vm.LEAVE,
+			TAILCALL: vm.TAILCALL,
+			JMP:      vm.JMP,
+			JZ:       vm.JZ,
+			JNZ:      vm.JNZ,
+			ADD:      vm.ADD,
+			SUB:      vm.SUB,
+			EQ:       vm.EQ,
+			NE:       vm.NE,
+			LT:       vm.LT,
+			LE:       vm.LE,
+			SADD:     vm.SADD,
+			SSUB:     vm.SSUB,
+			SEQ:      vm.SEQ,
+			SNE:      vm.SNE,
+			SLT:      vm.SLT,
+			SLE:      vm.SLE,
+			DUP:      vm.DUP,
+			SWAP:     vm.SWAP,
+			OVER:     vm.OVER,
+			DROP:     vm.DROP,
+			ROT:      vm.ROT,
+			SPAWN:    vm.SPAWN,
+			YIELD:    vm.YIELD,
+			JOIN:     vm.JOIN,
+			TEXIT:    vm.TEXIT,
+			CHAN:     vm.CHAN,
+			SEND:     vm.SEND,
+			RECV:     vm.RECV,
+			CLOSE:    vm.CLOSE,
+			LOCK:     vm.LOCK,
+			UNLOCK:   vm.UNLOCK,
+			CAS:      vm.CAS,
+			TRY:      vm.TRY,
+			ENDTRY:   vm.ENDTRY,
+			THROW:    vm.THROW,
+			SETVEC:   vm.SETVEC,
+			INT:      vm.INT,
+			IRET:     vm.IRET,
+			CLI:      vm.CLI,
+			STI:      vm.STI,
+			SYSCALL:  vm.SYSCALL,
 		}[node]
 		return []vm.Code{op}, nil
 	case Register:
@@ -77,8 +119,22 @@ func convert(node Node) ([]vm.Code, error) {
 		case BP:
 			return []vm.Code{vm.BpOffset(offset.Diff)}, nil
 		default:
-			return nil, fmt.Errorf("convert: unsupported offset: %s", offset.String())
+			base, err := generalRegister(offset.Target)
+			if err != nil {
+				return nil, err
+			}
+			return []vm.Code{vm.RegisterOffset{Base: base, Disp: offset.Diff}}, nil
 		}
+	case IndexedOffset:
+		base, err := generalRegister(node.Base)
+		if err != nil {
+			return nil, err
+		}
+		index, err := generalRegister(node.Index)
+		if err != nil {
+			return nil, err
+		}
+		return []vm.Code{vm.IndexedOffset{Base: base, Index: index, Scale: node.Scale}}, nil
 	case Number:
 		return []vm.Code{vm.Integer(node)}, nil
 	case Character:
@@ -88,6 +144,18 @@ func convert(node Node) ([]vm.Code, error) {
 	}
 }
 
+func generalRegister(reg Register) (vm.GeneralPurposeRegister, error) {
+	c, err := convert(reg)
+	if err != nil {
+		return 0, err
+	}
+	gr, ok := c[0].(vm.GeneralPurposeRegister)
+	if !ok {
+		return 0, fmt.Errorf("convert: unsupported register: %s", reg.String())
+	}
+	return gr, nil
+}
+
 func Gen(nodes []Node) ([]vm.Code, error) {
 	var codes []vm.Code
 	for _, node := range nodes {
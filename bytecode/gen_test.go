@@ -34,6 +34,17 @@ func TestGen(t *testing.T) {
 				vm.MOV, vm.PC, vm.Character('a'),
 			},
 		},
+		{
+			"register relative",
+			[]Node{
+				Instruction{LOAD, []Node{R3, Offset{R1, -4}}},
+				Instruction{STORE, []Node{IndexedOffset{R1, R2, 8}, R3}},
+			},
+			[]vm.Code{
+				vm.LOAD, vm.R3, vm.RegisterOffset{Base: vm.R1, Disp: -4},
+				vm.STORE, vm.IndexedOffset{Base: vm.R1, Index: vm.R2, Scale: 8}, vm.R3,
+			},
+		},
 		{
 			"fizzbuzz",
 			[]Node{
@@ -22,8 +22,20 @@ const (
 	ALLOC
 	STORE
 	LOAD
+	STORE8
+	STORE16
+	STORE32
+	STORE64
+	LOAD8
+	LOAD16
+	LOAD32
+	LOAD64
+	LEA
 	CALL
 	RET
+	ENTER
+	LEAVE
+	TAILCALL
 	JMP
 	JZ
 	JNZ
@@ -33,31 +45,103 @@ const (
 	NE
 	LT
 	LE
+	SADD
+	SSUB
+	SEQ
+	SNE
+	SLT
+	SLE
+	DUP
+	SWAP
+	OVER
+	DROP
+	ROT
+	SPAWN
+	YIELD
+	JOIN
+	TEXIT
+	CHAN
+	SEND
+	RECV
+	CLOSE
+	LOCK
+	UNLOCK
+	CAS
+	TRY
+	ENDTRY
+	THROW
+	SETVEC
+	INT
+	IRET
+	CLI
+	STI
 	SYSCALL
 )
 
 func (o Operation) isNode() {}
 func (o Operation) String() string {
 	return []string{
-		NOP:     "nop",
-		MOV:     "mov",
-		PUSH:    "push",
-		POP:     "pop",
-		ALLOC:   "alloc",
-		STORE:   "store",
-		LOAD:    "load",
-		CALL:    "call",
-		RET:     "ret",
-		JMP:     "jmp",
-		JZ:      "jz",
-		JNZ:     "jnz",
-		ADD:     "add",
-		SUB:     "sub",
-		EQ:      "eq",
-		NE:      "ne",
-		LT:      "lt",
-		LE:      "le",
-		SYSCALL: "syscall",
+		NOP:      "nop",
+		MOV:      "mov",
+		PUSH:     "push",
+		POP:      "pop",
+		ALLOC:    "alloc",
+		STORE:    "store",
+		LOAD:     "load",
+		STORE8:   "store8",
+		STORE16:  "store16",
+		STORE32:  "store32",
+		STORE64:  "store64",
+		LOAD8:    "load8",
+		LOAD16:   "load16",
+		LOAD32:   "load32",
+		LOAD64:   "load64",
+		LEA:      "lea",
+		CALL:     "call",
+		RET:      "ret",
+		ENTER:    "enter",
+		LEAVE:    "leave",
+		TAILCALL: "tailcall",
+		JMP:      "jmp",
+		JZ:       "jz",
+		JNZ:      "jnz",
+		ADD:      "add",
+		SUB:      "sub",
+		EQ:       "eq",
+		NE:       "ne",
+		LT:       "lt",
+		LE:       "le",
+		SADD:     "sadd",
+		SSUB:     "ssub",
+		SEQ:      "seq",
+		SNE:      "sne",
+		SLT:      "slt",
+		SLE:      "sle",
+		DUP:      "dup",
+		SWAP:     "swap",
+		OVER:     "over",
+		DROP:     "drop",
+		ROT:      "rot",
+		SPAWN:    "spawn",
+		YIELD:    "yield",
+		JOIN:     "join",
+		TEXIT:    "texit",
+		CHAN:     "chan",
+		SEND:     "send",
+		RECV:     "recv",
+		CLOSE:    "close",
+		LOCK:     "lock",
+		UNLOCK:   "unlock",
+		CAS:      "cas",
+		TRY:      "try",
+		ENDTRY:   "endtry",
+		THROW:    "throw",
+		SETVEC:   "setvec",
+		INT:      "int",
+		IRET:     "iret",
+		CLI:      "cli",
+		STI:      "sti",
+		SYSCALL:  "syscall",
 	}[o]
 }
 
@@ -102,6 +186,9 @@ const (
 )
 
 func (r Register) isNode() {}
+func (r Register) isGeneral() bool {
+	return R0 <= r && r <= R10
+}
 func (r Register) String() string {
 	return []string{
 		PC:  "pc",
@@ -123,7 +210,7 @@ func (r Register) String() string {
 	}[r]
 }
 
-// Offset `[sp+1]`のような相対位置
+// Offset `[sp+1]` `[r1+4]`のような相対位置
 type Offset struct {
 	Target Register
 	Diff   int
@@ -134,6 +221,18 @@ func (o Offset) String() string {
 	return fmt.Sprintf("[%s%+d]", o.Target.String(), o.Diff)
 }
 
+// IndexedOffset `[r1+r2*4]`のようなレジスタ相対位置
+type IndexedOffset struct {
+	Base  Register
+	Index Register
+	Scale int
+}
+
+func (i IndexedOffset) isNode() {}
+func (i IndexedOffset) String() string {
+	return fmt.Sprintf("[%s+%s*%d]", i.Base.String(), i.Index.String(), i.Scale)
+}
+
 type Number int
 
 func (n Number) isNode() {}
@@ -148,47 +247,50 @@ func (c Character) String() string {
 	return strconv.QuoteRune(rune(c))
 }
 
-var curt *Token
+// parser 1回のParseの状態。呼び出しごとに作るので並行に呼び出せる
+type parser struct {
+	curt *Token
+}
 
-func expect(kind TokenKind) (*Token, error) {
-	if curt.Kind != kind {
-		return nil, fmt.Errorf("want=%s, got=%s", kind.String(), curt.Kind.String())
+func (p *parser) expect(kind TokenKind) (*Token, error) {
+	if p.curt.Kind != kind {
+		return nil, fmt.Errorf("want=%s, got=%s", kind.String(), p.curt.Kind.String())
 	}
-	v := *curt
-	curt = curt.Next
+	v := *p.curt
+	p.curt = p.curt.Next
 	return &v, nil
 }
-func consume(kind TokenKind) *Token {
-	if curt.Kind != kind {
+func (p *parser) consume(kind TokenKind) *Token {
+	if p.curt.Kind != kind {
 		return nil
 	}
-	v := *curt
-	curt = curt.Next
+	v := *p.curt
+	p.curt = p.curt.Next
 	return &v
 }
 
-func parsePcOffset() ([]Node, error) {
+func (p *parser) parsePcOffset() ([]Node, error) {
 	// (
-	if _, err := expect(Lrb); err != nil {
+	if _, err := p.expect(Lrb); err != nil {
 		return nil, err
 	}
 
 	// +
-	plus := consume(Add)
+	plus := p.consume(Add)
 	// -
-	minus := consume(Sub)
+	minus := p.consume(Sub)
 	if plus != nil && minus != nil {
 		return nil, fmt.Errorf("syntax err")
 	}
 
 	// diff
-	diff, err := expect(Integer)
+	diff, err := p.expect(Integer)
 	if err != nil {
 		return nil, err
 	}
 
 	// )
-	if _, err = expect(Rrb); err != nil {
+	if _, err = p.expect(Rrb); err != nil {
 		return nil, err
 	}
 
@@ -202,14 +304,76 @@ func parsePcOffset() ([]Node, error) {
 	return []Node{Offset{PC, v}}, nil
 }
 
-func parseStackOffset() ([]Node, error) {
+func (p *parser) parseRegisterOffset(base Register) ([]Node, error) {
+	// [r1]
+	if p.consume(Rcb) != nil {
+		return []Node{Offset{base, 0}}, nil
+	}
+
+	// +
+	plus := p.consume(Add)
+	// -
+	minus := p.consume(Sub)
+	if plus != nil && minus != nil {
+		return nil, fmt.Errorf("syntax err")
+	}
+
+	// index * scale
+	if plus != nil && p.curt.Kind == Identifier {
+		id, err := p.expect(Identifier)
+		if err != nil {
+			return nil, err
+		}
+		index, yes := isRegister(string(id.Raw))
+		if !yes || !index.isGeneral() {
+			return nil, fmt.Errorf("unsupported index register: %s", string(id.Raw))
+		}
+		if _, err := p.expect(Mul); err != nil {
+			return nil, err
+		}
+		scale, err := p.expect(Integer)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(Rcb); err != nil {
+			return nil, err
+		}
+		v, err := scale.GetValueAsInteger()
+		if err != nil {
+			return nil, err
+		}
+		return []Node{IndexedOffset{base, index, v}}, nil
+	}
+
+	// diff
+	diff, err := p.expect(Integer)
+	if err != nil {
+		return nil, err
+	}
+
+	// ]
+	if _, err := p.expect(Rcb); err != nil {
+		return nil, err
+	}
+
+	v, err := diff.GetValueAsInteger()
+	if err != nil {
+		return nil, err
+	}
+	if minus != nil {
+		return []Node{Offset{base, -v}}, nil
+	}
+	return []Node{Offset{base, v}}, nil
+}
+
+func (p *parser) parseStackOffset() ([]Node, error) {
 	// [
-	if _, err := expect(Lcb); err != nil {
+	if _, err := p.expect(Lcb); err != nil {
 		return nil, err
 	}
 
 	// sp / bp
-	id, err := expect(Identifier)
+	id, err := p.expect(Identifier)
 	if err != nil {
 		return nil, err
 	}
@@ -220,25 +384,29 @@ func parseStackOffset() ([]Node, error) {
 	case "bp":
 		reg = BP
 	default:
+		// [r1+4] / [r1+r2*4]
+		if base, yes := isRegister(string(id.Raw)); yes && base.isGeneral() {
+			return p.parseRegisterOffset(base)
+		}
 		return nil, fmt.Errorf("unsupported register: %s", string(id.Raw))
 	}
 
 	// +
-	plus := consume(Add)
+	plus := p.consume(Add)
 	// -
-	minus := consume(Sub)
+	minus := p.consume(Sub)
 	if plus != nil && minus != nil {
 		return nil, fmt.Errorf("syntax err")
 	}
 
 	// diff
-	diff, err := expect(Integer)
+	diff, err := p.expect(Integer)
 	if err != nil {
 		return nil, err
 	}
 
 	// ]
-	if _, err := expect(Rcb); err != nil {
+	if _, err := p.expect(Rcb); err != nil {
 		return nil, err
 	}
 
@@ -254,54 +422,66 @@ func parseStackOffset() ([]Node, error) {
 
 func Parse(token *Token) ([]Node, error) {
 	var nodes []Node
-	curt = token
+	p := &parser{curt: token}
 loop:
 	for {
-		switch curt.Kind {
+		switch p.curt.Kind {
 		case Eof:
 			break loop
 		case Comment:
-			curt = curt.Next
+			p.curt = p.curt.Next
 		case Identifier:
-			if op, yes := isOperation(string(curt.Raw)); yes {
+			if op, yes := isOperation(string(p.curt.Raw)); yes {
 				nodes = append(nodes, op)
-				curt = curt.Next
+				p.curt = p.curt.Next
 				continue
 			}
-			if reg, yes := isRegister(string(curt.Raw)); yes {
+			if reg, yes := isRegister(string(p.curt.Raw)); yes {
 				nodes = append(nodes, reg)
-				curt = curt.Next
+				p.curt = p.curt.Next
 				continue
 			}
-			return nil, fmt.Errorf("parse: unsupported ident: %s", string(curt.Raw))
+			return nil, fmt.Errorf("parse: unsupported ident: %s", string(p.curt.Raw))
 		case Integer:
-			v, err := curt.GetValueAsInteger()
+			v, err := p.curt.GetValueAsInteger()
 			if err != nil {
 				return nil, err
 			}
 			nodes = append(nodes, Number(v))
-			curt = curt.Next
+			p.curt = p.curt.Next
+		case Sub:
+			// 負の数 -1
+			p.curt = p.curt.Next
+			n, err := p.expect(Integer)
+			if err != nil {
+				return nil, err
+			}
+			v, err := n.GetValueAsInteger()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, Number(-v))
 		case Char:
-			v, err := curt.GetValueAsRune()
+			v, err := p.curt.GetValueAsRune()
 			if err != nil {
 				return nil, err
 			}
 			nodes = append(nodes, Character(v))
-			curt = curt.Next
+			p.curt = p.curt.Next
 		case Lrb:
-			nds, err := parsePcOffset()
+			nds, err := p.parsePcOffset()
 			if err != nil {
 				return nil, err
 			}
 			nodes = append(nodes, nds...)
 		case Lcb:
-			nds, err := parseStackOffset()
+			nds, err := p.parseStackOffset()
 			if err != nil {
 				return nil, err
 			}
 			nodes = append(nodes, nds...)
 		default:
-			return nil, fmt.Errorf("parse: unsupported token: %s", curt.Kind.String())
+			return nil, fmt.Errorf("parse: unsupported token: %s", p.curt.Kind.String())
 		}
 	}
 	return nodes, nil
@@ -30,6 +30,20 @@ push 'a'
 	}
 }
 
+func TestParse_NegativeNumber(t *testing.T) {
+	toks, err := Tokenize([]rune("store 4 -1\n"))
+	if err != nil {
+		t.Fatalf("tokenize error: %v", err)
+	}
+	nodes, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if diff := cmp.Diff([]Node{STORE, Number(4), Number(-1)}, nodes); diff != "" {
+		t.Errorf("diff:\n%s", diff)
+	}
+}
+
 func TestParse_Offsets(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -71,6 +85,27 @@ func TestParse_Offsets(t *testing.T) {
 				STORE, Offset{Target: BP, Diff: -2}, R3,
 			},
 		},
+		{
+			name:  "register offset",
+			input: "load r3 [r1+4]",
+			expect: []Node{
+				LOAD, R3, Offset{Target: R1, Diff: 4},
+			},
+		},
+		{
+			name:  "register offset without diff",
+			input: "store [r1] 0",
+			expect: []Node{
+				STORE, Offset{Target: R1, Diff: 0}, Number(0),
+			},
+		},
+		{
+			name:  "indexed offset",
+			input: "mov r3 [r1+r2*4]",
+			expect: []Node{
+				MOV, R3, IndexedOffset{Base: R1, Index: R2, Scale: 4},
+			},
+		},
 		{
 			name:  "char",
 			input: "'r'1",
@@ -96,6 +131,27 @@ func TestParse_Offsets(t *testing.T) {
 	}
 }
 
+func TestParse_StackOps(t *testing.T) {
+	input := "push 1\ndup\nsadd\nswap over drop rot"
+	toks, err := Tokenize([]rune(input))
+	if err != nil {
+		t.Fatalf("tokenize error: %v", err)
+	}
+	nodes, err := Parse(toks)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	expect := []Node{
+		PUSH, Number(1),
+		DUP,
+		SADD,
+		SWAP, OVER, DROP, ROT,
+	}
+	if diff := cmp.Diff(expect, nodes); diff != "" {
+		t.Errorf("diff:\n%s", diff)
+	}
+}
+
 func TestParse_SkipComment(t *testing.T) {
 	input := "mov r0 1 ; comment\nadd r0 2"
 	toks, err := Tokenize([]rune(input))
@@ -136,3 +192,14 @@ func TestParse_Error_StackOffset_UnsupportedRegister(t *testing.T) {
 		t.Fatalf("expected error, got nil")
 	}
 }
+
+func TestParse_Error_IndexedOffset_UnsupportedRegister(t *testing.T) {
+	input := "[r1+sp*2]"
+	toks, err := Tokenize([]rune(input))
+	if err != nil {
+		t.Fatalf("tokenize error: %v", err)
+	}
+	if _, err := Parse(toks); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
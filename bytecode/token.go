@@ -5,15 +5,18 @@ import (
 	"strconv"
 )
 
-var text []rune
-var loc location
-
 type location struct {
 	at       int
 	line     int
 	atInLine int
 }
 
+// lexer 1回のTokenizeの状態。呼び出しごとに作るので並行に呼び出せる
+type lexer struct {
+	text []rune
+	loc  location
+}
+
 type TokenKind int
 
 const (
@@ -86,13 +89,13 @@ func (t *Token) GetValueAsRune() (rune, error) {
 	return t.Raw[0], nil
 }
 
-func comment() (*Token, error) {
-	tok := Token{Kind: Comment, Position: Position{loc.atInLine, loc.line}}
+func (l *lexer) comment() (*Token, error) {
+	tok := Token{Kind: Comment, Position: Position{l.loc.atInLine, l.loc.line}}
 	v := ""
-	for loc.at < len(text) && text[loc.at] != '\n' {
-		v += string(text[loc.at])
-		loc.at++
-		loc.atInLine++
+	for l.loc.at < len(l.text) && l.text[l.loc.at] != '\n' {
+		v += string(l.text[l.loc.at])
+		l.loc.at++
+		l.loc.atInLine++
 	}
 	tok.Raw = []rune(v)
 	return &tok, nil
@@ -109,13 +112,13 @@ func isIdentifier(head bool, r rune) bool {
 	return lower || upper || sym || num
 }
 
-func identifier() (*Token, error) {
-	tok := Token{Kind: Identifier, Position: Position{StartedAt: loc.atInLine, Line: loc.line}}
+func (l *lexer) identifier() (*Token, error) {
+	tok := Token{Kind: Identifier, Position: Position{StartedAt: l.loc.atInLine, Line: l.loc.line}}
 	v := ""
-	for loc.at < len(text) && isIdentifier(false, text[loc.at]) {
-		v += string(text[loc.at])
-		loc.at++
-		loc.atInLine++
+	for l.loc.at < len(l.text) && isIdentifier(false, l.text[l.loc.at]) {
+		v += string(l.text[l.loc.at])
+		l.loc.at++
+		l.loc.atInLine++
 	}
 	tok.Raw = []rune(v)
 	return &tok, nil
@@ -125,13 +128,13 @@ func isNumeric(r rune) bool {
 	return '0' <= r && r <= '9'
 }
 
-func integer() (*Token, error) {
-	tok := Token{Kind: Integer, Position: Position{loc.atInLine, loc.line}}
+func (l *lexer) integer() (*Token, error) {
+	tok := Token{Kind: Integer, Position: Position{l.loc.atInLine, l.loc.line}}
 	v := ""
-	for loc.at < len(text) && isNumeric(text[loc.at]) {
-		v += string(text[loc.at])
-		loc.at++
-		loc.atInLine++
+	for l.loc.at < len(l.text) && isNumeric(l.text[l.loc.at]) {
+		v += string(l.text[l.loc.at])
+		l.loc.at++
+		l.loc.atInLine++
 	}
 	tok.Raw = []rune(v)
 	return &tok, nil
@@ -144,7 +147,7 @@ func isSymbol(r rune) bool {
 		r == '+' || r == '-' || r == '*'
 }
 
-func symbol() (*Token, error) {
+func (l *lexer) symbol() (*Token, error) {
 	sym := map[rune]Token{
 		'(': {Kind: Lrb},
 		')': {Kind: Rrb},
@@ -158,29 +161,29 @@ func symbol() (*Token, error) {
 		'-': {Kind: Sub},
 		'*': {Kind: Mul},
 	}
-	tok, ok := sym[text[loc.at]]
+	tok, ok := sym[l.text[l.loc.at]]
 	if !ok {
-		return nil, fmt.Errorf("unexpected rune: %s", string(text[loc.at]))
+		return nil, fmt.Errorf("unexpected rune: %s", string(l.text[l.loc.at]))
 	}
-	tok.Position = Position{StartedAt: loc.atInLine, Line: loc.line}
-	loc.at++
-	loc.atInLine++
+	tok.Position = Position{StartedAt: l.loc.atInLine, Line: l.loc.line}
+	l.loc.at++
+	l.loc.atInLine++
 	return &tok, nil
 }
 
-func char() (*Token, error) {
-	tok := Token{Kind: Char, Position: Position{loc.atInLine, loc.line}}
+func (l *lexer) char() (*Token, error) {
+	tok := Token{Kind: Char, Position: Position{l.loc.atInLine, l.loc.line}}
 
 	// '
-	loc.at++
-	loc.atInLine++
+	l.loc.at++
+	l.loc.atInLine++
 
 	var r rune
-	if text[loc.at] == '\\' {
+	if l.text[l.loc.at] == '\\' {
 		// エスケープシーケンス
-		loc.at++
-		loc.atInLine++
-		switch text[loc.at] {
+		l.loc.at++
+		l.loc.atInLine++
+		switch l.text[l.loc.at] {
 		case 'n':
 			r = '\n'
 		case 't':
@@ -192,82 +195,81 @@ func char() (*Token, error) {
 		case '0':
 			r = 0
 		default:
-			return nil, fmt.Errorf("unsupported escape: \\%c", text[loc.at])
+			return nil, fmt.Errorf("unsupported escape: \\%c", l.text[l.loc.at])
 		}
 	} else {
-		r = text[loc.at]
+		r = l.text[l.loc.at]
 	}
-	loc.at++
-	loc.atInLine++
+	l.loc.at++
+	l.loc.atInLine++
 
-	if text[loc.at] != '\'' {
-		return nil, fmt.Errorf("unexpected token: want=', got=%s", string(text[loc.at]))
+	if l.text[l.loc.at] != '\'' {
+		return nil, fmt.Errorf("unexpected token: want=', got=%s", string(l.text[l.loc.at]))
 	}
 	// '
-	loc.at++
-	loc.atInLine++
+	l.loc.at++
+	l.loc.atInLine++
 
 	tok.Raw = []rune{r}
 	return &tok, nil
 }
 
 func Tokenize(input []rune) (*Token, error) {
-	text = input
-	loc = location{0, 0, 0}
+	l := &lexer{text: input}
 	head := &Token{}
 	curt := head
 
-	for loc.at < len(text) {
-		switch r := text[loc.at]; {
+	for l.loc.at < len(l.text) {
+		switch r := l.text[l.loc.at]; {
 		case r == ' ' || r == '\t':
-			loc.at++
-			loc.atInLine++
+			l.loc.at++
+			l.loc.atInLine++
 		case r == '\n':
-			loc.at++
-			loc.line++
-			loc.atInLine = 0
+			l.loc.at++
+			l.loc.line++
+			l.loc.atInLine = 0
 		case r == ';':
-			tok, err := comment()
+			tok, err := l.comment()
 			if err != nil {
 				return nil, err
 			}
 			curt.Next = tok
 			curt = curt.Next
 		case r == '\'':
-			tok, err := char()
+			tok, err := l.char()
 			if err != nil {
 				return nil, err
 			}
 			curt.Next = tok
 			curt = curt.Next
 		case isIdentifier(true, r):
-			tok, err := identifier()
+			tok, err := l.identifier()
 			if err != nil {
 				return nil, err
 			}
 			curt.Next = tok
 			curt = curt.Next
 		case isNumeric(r):
-			tok, err := integer()
+			tok, err := l.integer()
 			if err != nil {
 				return nil, err
 			}
 			curt.Next = tok
 			curt = curt.Next
 		case isSymbol(r):
-			tok, err := symbol()
+			tok, err := l.symbol()
 			if err != nil {
 				return nil, err
 			}
 			curt.Next = tok
 			curt = curt.Next
 		default:
-			return nil, fmt.Errorf("unexpected rune: %s", string(text[loc.at]))
+			return nil, fmt.Errorf("unexpected rune: %s", string(l.text[l.loc.at]))
 		}
 	}
 	curt.Next = &Token{
 		Kind:     Eof,
-		Position: Position{StartedAt: loc.atInLine, Line: loc.line},
+		Position: Position{StartedAt: l.loc.atInLine, Line: l.loc.line},
 	}
 	return head.Next, nil
 }
@@ -1,8 +1,10 @@
 package bytecode
 
 import (
+	"fmt"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"testing/quick"
 
@@ -108,3 +110,52 @@ func TestTokenize_RoundTrip(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Tokenize/Parse がパッケージの状態を共有していないこと
+func TestTokenizeAndParse_Concurrent(t *testing.T) {
+	inputs := []string{
+		"mov r0 1\nadd r1 r0\n",
+		"push 'a'\njmp (-3)\n",
+		"load r3 [r1+r2*4]\nstore [bp-2] r3\n",
+	}
+	want := make([][]Node, len(inputs))
+	for i, input := range inputs {
+		tokens, err := Tokenize([]rune(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, err := Parse(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = nodes
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for n := 0; n < 100; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := n % len(inputs)
+			tokens, err := Tokenize([]rune(inputs[i]))
+			if err != nil {
+				errs <- err
+				return
+			}
+			nodes, err := Parse(tokens)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !cmp.Equal(want[i], nodes) {
+				errs <- fmt.Errorf("input %d: result differs from sequential parse", i)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/urfave/cli/v3"
@@ -35,11 +36,210 @@ func readIr(path string) (string, error) {
 	return string(bytes), nil
 }
 
+// readIrs .mir を読み、.include を展開する
+func readIrs(paths []string, search ir.SearchPaths) ([]ir.Source, error) {
+	var srcs []ir.Source
+	for _, path := range paths {
+		v, err := readIr(path)
+		if err != nil {
+			return nil, err
+		}
+		src, err := search.Include(ir.Source{Name: path, Text: []rune(v)})
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
+
+// exportedNames irs、オブジェクト、アーカイブのメンバーがexportする名前
+func exportedNames(irs []*ir.IR, objs []*ir.Object, archives []*ir.Archive) map[string]bool {
+	names := map[string]bool{}
+	add := func(x *ir.IR) {
+		for _, name := range x.Exports {
+			names[name] = true
+		}
+	}
+	for _, x := range irs {
+		add(x)
+	}
+	for _, obj := range objs {
+		add(obj.IR)
+	}
+	for _, a := range archives {
+		for _, m := range a.Members {
+			add(m.IR)
+		}
+	}
+	return names
+}
+
+// loadInputs 引数のファイルと、そこから .import "fmt.mir" で名指しされたファイルを読む
+// 名指しされたファイルは引数の後ろに並ぶ。同じファイルは1度だけ読む
+// exportする名前がすべて読んだファイルで定義済みなら、名指しされたファイルは読まない
+// (lib.mir の代わりにコンパイルした lib.mobj を渡したとき)
+func loadInputs(paths []string, search ir.SearchPaths) ([]*ir.IR, []*ir.Object, []*ir.Archive, error) {
+	irs, objs, archives, err := loadFiles(paths, search)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	loaded := map[string]bool{}
+	for _, path := range paths {
+		loaded[filepath.Clean(path)] = true
+	}
+	defined := exportedNames(irs, objs, archives)
+	for i := 0; i < len(irs); i++ {
+		for _, name := range irs[i].Requires {
+			path, err := search.Find(name, irs[i].Source)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if loaded[filepath.Clean(path)] {
+				continue
+			}
+			loaded[filepath.Clean(path)] = true
+			more, moreObjs, moreArchives, err := loadFiles([]string{path}, search)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			names := exportedNames(more, moreObjs, moreArchives)
+			provided := len(names) > 0
+			for name := range names {
+				provided = provided && defined[name]
+				defined[name] = true
+			}
+			if provided {
+				continue
+			}
+			irs = append(irs, more...)
+			objs = append(objs, moreObjs...)
+			archives = append(archives, moreArchives...)
+		}
+	}
+	return irs, objs, archives, nil
+}
+
+// loadFiles .mir をパースし、.mobj と .mar を開く。IRとオブジェクトはそれぞれ引数の順に並ぶ
+func loadFiles(paths []string, search ir.SearchPaths) ([]*ir.IR, []*ir.Object, []*ir.Archive, error) {
+	var mirs []string
+	var objs []*ir.Object
+	var archives []*ir.Archive
+	for _, path := range paths {
+		switch {
+		case strings.HasSuffix(path, ".mar"):
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			a, err := ir.ReadArchive(f)
+			_ = f.Close()
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+			archives = append(archives, a)
+		case strings.HasSuffix(path, ".mobj"):
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			obj, err := ir.ReadObject(path, f)
+			_ = f.Close()
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+			objs = append(objs, obj)
+		default:
+			mirs = append(mirs, path)
+		}
+	}
+	srcs, err := readIrs(mirs, search)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// パースはファイルごとに並行して行う
+	parsed, err := ir.ParseSources(srcs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return parsed, objs, archives, nil
+}
+
+// loadLabeled loadFiles のオブジェクトをラベルに戻して、IRの後ろに並べる
+func loadLabeled(paths []string, search ir.SearchPaths) ([]*ir.IR, error) {
+	irs, objs, _, err := loadFiles(paths, search)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		labeled, err := obj.Labeled()
+		if err != nil {
+			return nil, err
+		}
+		irs = append(irs, labeled)
+	}
+	return irs, nil
+}
+
+// loadStartup --crt0 なら既定の、--startup ならそのファイルのスタートアップを返す
+func loadStartup(crt0 bool, path string, search ir.SearchPaths) (*ir.IR, error) {
+	if crt0 && path != "" {
+		return nil, fmt.Errorf("error: --crt0 and --startup cannot be used together")
+	}
+	if crt0 {
+		return ir.DefaultStartup()
+	}
+	if path == "" {
+		return nil, nil
+	}
+	irs, err := loadLabeled([]string{path}, search)
+	if err != nil {
+		return nil, err
+	}
+	return irs[0], nil
+}
+
+// includeFlag -I で .include と .import "file" を探すディレクトリを足す
+func includeFlag(dirs *[]string) cli.Flag {
+	return &cli.StringSliceFlag{
+		Name:        "include-path",
+		Aliases:     []string{"I"},
+		Usage:       "search the directory for .include and .import \"file\" (after the including file's directory, before $" + ir.PathEnv + ")",
+		Destination: dirs,
+	}
+}
+
+// warn リンカの警告を標準エラーに出す
+func warn(msg string) {
+	fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+}
+
 func main() {
 	var status int
 	var stackSize uint
 	var heapSize uint
+	var stackLimit uint
+	var heapLimit uint
 	var link bool
+	var memoryModel string
+	var quantum uint
+	var seed int64
+	var randomSchedule bool
+	var catchFaults bool
+	var timerInterval uint
+	var debug bool
+	var engineName string
+	var optimize bool
+	var keepUnused bool
+	var stripData bool
+	var outPath string
+	var relocatable bool
+	var mapPath string
+	var expandMacros bool
+	var includeDirs []string
+	var entry string
+	var crt0 bool
+	var startupPath string
 
 	cmd := &cli.Command{
 		Name:  "minivm",
@@ -48,60 +248,400 @@ func main() {
 			{
 				Name:  "link",
 				Usage: "Link *.mir files",
+				Flags: []cli.Flag{
+					includeFlag(&includeDirs),
+					&cli.StringFlag{
+						Name:        "memory",
+						Value:       "cell",
+						Usage:       "memory model (cell, byte)",
+						Destination: &memoryModel,
+					},
+					&cli.BoolFlag{
+						Name:        "debug",
+						Aliases:     []string{"g"},
+						Usage:       "append debug info (symbols and their pc) to the output",
+						Destination: &debug,
+					},
+					&cli.BoolFlag{
+						Name:        "optimize",
+						Aliases:     []string{"O"},
+						Usage:       "apply peephole optimizations to the linked program",
+						Destination: &optimize,
+					},
+					&cli.BoolFlag{
+						Name:        "keep-unused",
+						Usage:       "keep unreachable functions",
+						Destination: &keepUnused,
+					},
+					&cli.BoolFlag{
+						Name:        "strip-data",
+						Usage:       "also remove .data constants that reachable code never references",
+						Destination: &stripData,
+					},
+					&cli.StringFlag{
+						Name:        "entry",
+						Usage:       "symbol to start from (default: the global symbol, then _start)",
+						Destination: &entry,
+					},
+					&cli.BoolFlag{
+						Name:        "crt0",
+						Usage:       "add the default startup that calls the entry and exits with its return value",
+						Destination: &crt0,
+					},
+					&cli.StringFlag{
+						Name:        "startup",
+						Usage:       "use the .mir file as the startup instead of crt0",
+						Destination: &startupPath,
+					},
+					&cli.BoolFlag{
+						Name:        "relocatable",
+						Aliases:     []string{"r"},
+						Usage:       "merge inputs into one .mir that keeps unresolved imports and exports",
+						Destination: &relocatable,
+					},
+					&cli.BoolFlag{
+						Name:        "expand-macros",
+						Usage:       "print each input as .mir with its macros expanded instead of linking",
+						Destination: &expandMacros,
+					},
+					&cli.StringFlag{
+						Name:        "map",
+						Usage:       "write a link map (pc, size and source of every symbol) to the file",
+						Destination: &mapPath,
+					},
+				},
 				Action: func(ctx context.Context, command *cli.Command) error {
+					memory, err := vm.ParseMemoryModel(memoryModel)
+					if err != nil {
+						return err
+					}
 					var filePaths []string
 					for i := 0; i < command.Args().Len(); i++ {
 						filePaths = append(filePaths, command.Args().Get(i))
 					}
-					// *.mir
-					var irs []*ir.IR
-					for _, filePath := range filePaths {
-						v, err := readIr(filePath)
+					// *.mir, *.mobj, *.mar
+					irs, objs, archives, err := loadInputs(filePaths, ir.SearchPathsFromEnv(includeDirs))
+					if err != nil {
+						return err
+					}
+					if len(objs) > 0 && (expandMacros || relocatable) {
+						return fmt.Errorf("error: --expand-macros and -r take only *.mir and *.mar")
+					}
+					// --expand-macros: 入力ごとに展開したソースを出すだけ
+					if expandMacros {
+						expanded, err := ir.ExpandMacros(irs, archives)
 						if err != nil {
 							return err
 						}
-						tokens, err := ir.Tokenize([]rune(v), true)
+						for _, x := range expanded {
+							src, err := ir.ExpandedSource(x)
+							if err != nil {
+								return err
+							}
+							if len(expanded) > 1 {
+								fmt.Printf("; %s\n", x.Source)
+							}
+							fmt.Print(src)
+						}
+						return nil
+					}
+					// -r: 1つの .mir にまとめるだけ
+					if relocatable {
+						lib, err := ir.PartialLink(irs, archives)
 						if err != nil {
 							return err
 						}
-						ir_, err := ir.Parse(tokens)
+						fmt.Print(ir.Format(lib))
+						return nil
+					}
+					startup, err := loadStartup(crt0, startupPath, ir.SearchPathsFromEnv(includeDirs))
+					if err != nil {
+						return err
+					}
+					config := &ir.LinkConfig{
+						ByteMemory: memory == vm.ByteMemory,
+						Optimize:   optimize,
+						KeepUnused: keepUnused,
+						StripData:  stripData,
+						Warn:       warn,
+						Archives:   archives,
+						Objects:    objs,
+						Entry:      entry,
+						Startup:    startup,
+					}
+					program, err := ir.LinkProgram(irs, config)
+					if err != nil {
+						return err
+					}
+					nds, info := program.Nodes, program.Info
+					// .stack / .heap は先頭のコメントにしてrunに渡す
+					resources := program.Resources
+					if mapPath != "" {
+						var buf strings.Builder
+						if err := ir.WriteMap(&buf, info); err != nil {
+							return err
+						}
+						if err := os.WriteFile(mapPath, []byte(buf.String()), 0644); err != nil {
+							return err
+						}
+					}
+					if err := vm.WriteResources(os.Stdout, resources); err != nil {
+						return err
+					}
+					fmt.Print(ir.Print(nds))
+					if debug {
+						return vm.WriteDebugInfo(os.Stdout, info)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "ar",
+				Usage:     "Bundle *.mir files into a static library (.mar)",
+				ArgsUsage: "out.mar file.mir...",
+				Flags: []cli.Flag{
+					includeFlag(&includeDirs),
+				},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					if command.Args().Len() < 2 {
+						return fmt.Errorf("error: usage: minivm ar out.mar file.mir...")
+					}
+					out := command.Args().Get(0)
+					if !strings.HasSuffix(out, ".mar") {
+						return fmt.Errorf("error: unsupported file: %s", out)
+					}
+					srcs, err := readIrs(command.Args().Slice()[1:], ir.SearchPathsFromEnv(includeDirs))
+					if err != nil {
+						return err
+					}
+					// メンバーはファイル名だけで覚える
+					for i := range srcs {
+						srcs[i].Name = filepath.Base(srcs[i].Name)
+					}
+					archive, err := ir.ArchiveSources(srcs)
+					if err != nil {
+						return err
+					}
+					var buf strings.Builder
+					if err := ir.WriteArchive(&buf, archive); err != nil {
+						return err
+					}
+					return os.WriteFile(out, []byte(buf.String()), 0644)
+				},
+			},
+			{
+				Name:      "nm",
+				Usage:     "List symbols of *.mir, *.mobj and *.mar files",
+				ArgsUsage: "file...",
+				Flags: []cli.Flag{
+					includeFlag(&includeDirs),
+				},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					paths := command.Args().Slice()
+					if len(paths) == 0 {
+						return fmt.Errorf("error: at least one file must be specified")
+					}
+					for i, path := range paths {
+						if len(paths) > 1 {
+							if i > 0 {
+								fmt.Println()
+							}
+							fmt.Printf("%s:\n", path)
+						}
+						if strings.HasSuffix(path, ".mar") {
+							f, err := os.Open(path)
+							if err != nil {
+								return err
+							}
+							a, err := ir.ReadArchive(f)
+							_ = f.Close()
+							if err != nil {
+								return fmt.Errorf("%s: %w", path, err)
+							}
+							for j, m := range a.Members {
+								if j > 0 {
+									fmt.Println()
+								}
+								fmt.Printf("%s:\n", m.Name)
+								if err := ir.WriteNameList(os.Stdout, m.IR); err != nil {
+									return err
+								}
+							}
+							continue
+						}
+						irs, err := loadLabeled([]string{path}, ir.SearchPathsFromEnv(includeDirs))
 						if err != nil {
 							return err
 						}
-						irs = append(irs, ir_)
+						if err := ir.WriteNameList(os.Stdout, irs[0]); err != nil {
+							return err
+						}
 					}
-					nds, err := ir.Link(irs)
+					return nil
+				},
+			},
+			{
+				Name:      "compile",
+				Usage:     "Compile *.mir files into relocatable objects (.mobj)",
+				ArgsUsage: "file.mir...",
+				Flags: []cli.Flag{
+					includeFlag(&includeDirs),
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "output file (only with a single input)",
+						Destination: &outPath,
+					},
+				},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					paths := command.Args().Slice()
+					if len(paths) == 0 {
+						return fmt.Errorf("error: at least one file must be specified")
+					}
+					if outPath != "" && len(paths) != 1 {
+						return fmt.Errorf("error: -o requires a single input")
+					}
+					srcs, err := readIrs(paths, ir.SearchPathsFromEnv(includeDirs))
 					if err != nil {
 						return err
 					}
-					fmt.Printf(ir.Print(nds))
+					objs, err := ir.CompileSources(srcs)
+					if err != nil {
+						return err
+					}
+					for _, obj := range objs {
+						// x.mir -> x.mobj
+						out := strings.TrimSuffix(obj.Name, ".mir") + ".mobj"
+						if outPath != "" {
+							out = outPath
+						}
+						var buf strings.Builder
+						if err := ir.WriteObject(&buf, obj); err != nil {
+							return err
+						}
+						if err := os.WriteFile(out, []byte(buf.String()), 0644); err != nil {
+							return err
+						}
+					}
 					return nil
 				},
 			},
 			{
 				Name:        "run",
 				Usage:       "Execute program",
-				Description: "execute .mbyt file as program",
+				Description: "execute .mbyt file as program, or link and execute .mir, .mobj and .mar files",
 				Flags: []cli.Flag{
+					includeFlag(&includeDirs),
 					&cli.UintFlag{
 						Name:        "stack",
-						Value:       100,
-						Usage:       "initial stack size",
+						Value:       vm.DefaultStackSize,
+						Usage:       "initial stack size (default: .stack of the program, then 100)",
 						Destination: &stackSize,
 					},
 					&cli.UintFlag{
 						Name:        "heap",
-						Value:       100,
-						Usage:       "initial heap size",
+						Value:       vm.DefaultHeapSize,
+						Usage:       "initial heap size (default: .heap of the program, then 100)",
 						Destination: &heapSize,
 					},
+					&cli.UintFlag{
+						Name:        "stack-limit",
+						Value:       0,
+						Usage:       "grow the stack up to this size when it runs out (0: fixed size)",
+						Destination: &stackLimit,
+					},
+					&cli.UintFlag{
+						Name:        "heap-limit",
+						Value:       0,
+						Usage:       "grow the heap on alloc up to this size (0: fixed size)",
+						Destination: &heapLimit,
+					},
 					&cli.BoolFlag{
 						Name:        "link",
 						Aliases:     []string{"l"},
 						Destination: &link,
 					},
+					&cli.BoolFlag{
+						Name:        "optimize",
+						Aliases:     []string{"O"},
+						Usage:       "apply peephole optimizations when linking (with --link)",
+						Destination: &optimize,
+					},
+					&cli.BoolFlag{
+						Name:        "keep-unused",
+						Usage:       "keep unreachable functions when linking (with --link)",
+						Destination: &keepUnused,
+					},
+					&cli.BoolFlag{
+						Name:        "strip-data",
+						Usage:       "also remove unreferenced .data constants when linking (with --link)",
+						Destination: &stripData,
+					},
+					&cli.StringFlag{
+						Name:        "entry",
+						Usage:       "symbol to start from (default: the global symbol, then _start)",
+						Destination: &entry,
+					},
+					&cli.BoolFlag{
+						Name:        "crt0",
+						Usage:       "add the default startup that calls the entry and exits with its return value",
+						Destination: &crt0,
+					},
+					&cli.StringFlag{
+						Name:        "startup",
+						Usage:       "use the .mir file as the startup instead of crt0",
+						Destination: &startupPath,
+					},
+					&cli.StringFlag{
+						Name:        "memory",
+						Value:       "cell",
+						Usage:       "memory model (cell, byte)",
+						Destination: &memoryModel,
+					},
+					&cli.UintFlag{
+						Name:        "quantum",
+						Value:       0,
+						Usage:       "switch threads every n instructions (0: only on yield/join/texit)",
+						Destination: &quantum,
+					},
+					&cli.BoolFlag{
+						Name:        "random-schedule",
+						Usage:       "pick the next thread randomly using --seed",
+						Destination: &randomSchedule,
+					},
+					&cli.Int64Flag{
+						Name:        "seed",
+						Value:       0,
+						Usage:       "seed for --random-schedule",
+						Destination: &seed,
+					},
+					&cli.BoolFlag{
+						Name:        "catch-faults",
+						Usage:       "deliver runtime faults to try handlers",
+						Destination: &catchFaults,
+					},
+					&cli.UintFlag{
+						Name:        "timer",
+						Value:       0,
+						Usage:       "raise a timer interrupt every n instructions (0: disabled)",
+						Destination: &timerInterval,
+					},
+					&cli.StringFlag{
+						Name:        "engine",
+						Value:       "interpreter",
+						Usage:       "execution engine (interpreter, compiled)",
+						Destination: &engineName,
+					},
 				},
 				Action: func(ctx context.Context, command *cli.Command) error {
+					memory, err := vm.ParseMemoryModel(memoryModel)
+					if err != nil {
+						return err
+					}
+					engine, err := vm.ParseEngine(engineName)
+					if err != nil {
+						return err
+					}
 					// load args
 					var filePaths []string
 					for i := 0; i < command.Args().Len(); i++ {
@@ -112,35 +652,45 @@ func main() {
 						// 最低一個は指定してね
 						return fmt.Errorf("error: at least one file must be specified")
 					}
+					// .mbyt でなければリンクしてから実行する
+					if !strings.HasSuffix(filePaths[0], ".mbyt") {
+						link = true
+					}
 					if !link && len(filePaths) != 1 {
 						// リンクじゃないのにファイル多すぎるべ
 						return fmt.Errorf("error: too many files specified")
 					}
 
 					var assembly string
+					var info *vm.DebugInfo
+					var resources vm.Resources
 					if link {
-						// *.mir
-						var irs []*ir.IR
-						for _, filePath := range filePaths {
-							v, err := readIr(filePath)
-							if err != nil {
-								return err
-							}
-							tokens, err := ir.Tokenize([]rune(v), true)
-							if err != nil {
-								return err
-							}
-							ir_, err := ir.Parse(tokens)
-							if err != nil {
-								return err
-							}
-							irs = append(irs, ir_)
+						// *.mir, *.mobj, *.mar
+						irs, objs, archives, err := loadInputs(filePaths, ir.SearchPathsFromEnv(includeDirs))
+						if err != nil {
+							return err
 						}
-						nds, err := ir.Link(irs)
+						startup, err := loadStartup(crt0, startupPath, ir.SearchPathsFromEnv(includeDirs))
 						if err != nil {
 							return err
 						}
-						assembly = ir.Print(nds)
+						config := &ir.LinkConfig{
+							ByteMemory: memory == vm.ByteMemory,
+							Optimize:   optimize,
+							KeepUnused: keepUnused,
+							StripData:  stripData,
+							Archives:   archives,
+							Objects:    objs,
+							Entry:      entry,
+							Startup:    startup,
+						}
+						program, err := ir.LinkProgram(irs, config)
+						if err != nil {
+							return err
+						}
+						assembly = ir.Print(program.Nodes)
+						info = program.Info
+						resources = program.Resources
 					} else {
 						// *.mbyt
 						// read file
@@ -149,6 +699,23 @@ func main() {
 							return err
 						}
 						assembly = asm
+						// link -g で埋め込まれていれば使う
+						info, err = vm.ParseDebugInfo(asm)
+						if err != nil {
+							return err
+						}
+						// ;@stack / ;@heap があれば使う
+						resources, err = vm.ParseResources(asm)
+						if err != nil {
+							return err
+						}
+					}
+					// フラグがなければプログラムの指定、それもなければフラグの初期値
+					if !command.IsSet("stack") && resources.StackSize > 0 {
+						stackSize = uint(resources.StackSize)
+					}
+					if !command.IsSet("heap") && resources.HeapSize > 0 {
+						heapSize = uint(resources.HeapSize)
 					}
 					// tokenize
 					tokens, err := bytecode.Tokenize([]rune(assembly))
@@ -168,8 +735,20 @@ func main() {
 
 					// exec
 					rt := vm.NewRuntime(codes, &vm.Config{
-						StackSize: int(stackSize),
-						HeapSize:  int(heapSize),
+						StackSize:  int(stackSize),
+						HeapSize:   int(heapSize),
+						StackLimit: int(stackLimit),
+						HeapLimit:  int(heapLimit),
+						Memory:     memory,
+						Scheduler: vm.SchedulerConfig{
+							Quantum: int(quantum),
+							Random:  randomSchedule,
+							Seed:    seed,
+						},
+						CatchFaults:   catchFaults,
+						TimerInterval: int(timerInterval),
+						Debug:         info,
+						Engine:        engine,
 					})
 					err = rt.Run()
 					if err != nil {
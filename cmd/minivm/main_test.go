@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/x0y14/minivm/ir"
+)
+
+func TestLoadInputs_RequiredFileAndObject(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.mir": `
+.import "lib.mir"
+.import _f
+.section .text:
+    global _start
+_start:
+    call _f
+    mov r0 0
+    syscall
+`,
+		"lib.mir": `
+.export _f
+.section .text:
+_f:
+    ret
+`,
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objs, err := ir.CompileSources([]ir.Source{{Name: "lib.mir", Text: []rune(files["lib.mir"])}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "lib.mobj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ir.WriteObject(f, objs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		paths []string
+		irs   int
+		objs  int
+	}{
+		// lib.mir を名指ししているので読む
+		{"source", []string{"main.mir"}, 2, 0},
+		// lib.mobj が _f を定義しているので lib.mir は読まない
+		{"object", []string{"main.mir", "lib.mobj"}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			for _, p := range tt.paths {
+				paths = append(paths, filepath.Join(dir, p))
+			}
+			irs, objs, archives, err := loadInputs(paths, ir.SearchPaths{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(irs) != tt.irs || len(objs) != tt.objs {
+				t.Fatalf("got %d irs and %d objects, want %d and %d", len(irs), len(objs), tt.irs, tt.objs)
+			}
+			if _, err := ir.LinkProgram(irs, &ir.LinkConfig{Archives: archives, Objects: objs}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
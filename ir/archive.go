@@ -0,0 +1,164 @@
+package ir
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// archiveMagic .mar の1行目
+const archiveMagic = "!<minivm-ar>"
+
+// Member アーカイブに入っているパース済みの .mir
+type Member struct {
+	Name string
+	IR   *IR
+}
+
+// Archive .mar 静的ライブラリ。リンク時には足りないimportを解決するメンバーだけを取り出す
+type Archive struct {
+	Members []Member
+	// Index exportされたシンボル -> それを定義するメンバーの番号
+	Index map[string]int
+}
+
+// NewArchive membersをまとめ、exportされたシンボルの索引を作る
+func NewArchive(members []Member) (*Archive, error) {
+	a := &Archive{Members: members, Index: map[string]int{}}
+	for i, m := range members {
+		for _, name := range m.IR.Exports {
+			if j, ok := a.Index[name]; ok {
+				return nil, fmt.Errorf("%s: %s is already exported by %s", m.Name, name, members[j].Name)
+			}
+			a.Index[name] = i
+		}
+	}
+	return a, nil
+}
+
+// ArchiveSources srcsをパースしてアーカイブにする
+func ArchiveSources(srcs []Source) (*Archive, error) {
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		return nil, err
+	}
+	if irs, err = ExpandMacros(irs, nil); err != nil {
+		return nil, err
+	}
+	var members []Member
+	for i, src := range srcs {
+		members = append(members, Member{src.Name, irs[i]})
+	}
+	return NewArchive(members)
+}
+
+// WriteArchive アーカイブを書き出す
+//
+//	!<minivm-ar>
+//	.index _print fmt.mir
+//	.member fmt.mir
+//	...
+//	.end
+func WriteArchive(w io.Writer, a *Archive) error {
+	lines := []string{archiveMagic}
+	var names []string
+	for name := range a.Index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf(".index %s %s", name, a.Members[a.Index[name]].Name))
+	}
+	for _, m := range a.Members {
+		lines = append(lines, ".member "+m.Name)
+		lines = append(lines, encodeIR(m.IR)...)
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// ReadArchive WriteArchiveで書いたアーカイブを読む
+func ReadArchive(r io.Reader) (*Archive, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || lines[0] != archiveMagic {
+		return nil, fmt.Errorf("archive: not a minivm archive")
+	}
+	var members []Member
+	for i := 1; i < len(lines); {
+		fields := strings.Fields(lines[i])
+		switch {
+		case len(fields) == 0:
+			i++
+		case fields[0] == ".index":
+			// 索引はメンバーから作り直す
+			i++
+		case fields[0] == ".member" && len(fields) == 2:
+			ir, n, err := decodeIR(lines[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("archive: %s: %w", fields[1], err)
+			}
+			ir.Source = fields[1]
+			members = append(members, Member{fields[1], ir})
+			i += 1 + n
+		default:
+			return nil, fmt.Errorf("archive: unsupported line: %s", lines[i])
+		}
+	}
+	return NewArchive(members)
+}
+
+// pullMembers irsで足りないシンボルを定義するメンバーをarchivesから取り出す
+// 取り出したメンバーのimportも解決できるように、何も取り出せなくなるまで繰り返す
+func pullMembers(irs []*IR, archives []*Archive) ([]*IR, error) {
+	if len(archives) == 0 {
+		return nil, nil
+	}
+	table := &SymbolTable{"archive", make(map[string]Symbol)}
+	for _, ir := range irs {
+		if err := table.collect(ir); err != nil {
+			return nil, err
+		}
+	}
+	var pulled []*IR
+	taken := map[*IR]bool{}
+	for {
+		var names []string
+		for _, sym := range table.unsolved() {
+			names = append(names, sym.Name)
+		}
+		// 取り出す順番を決めるため名前順にする
+		sort.Strings(names)
+		found := false
+		for _, name := range names {
+			for _, a := range archives {
+				i, ok := a.Index[name]
+				if !ok {
+					continue
+				}
+				m := a.Members[i]
+				if taken[m.IR] {
+					break
+				}
+				taken[m.IR] = true
+				if err := table.collect(m.IR); err != nil {
+					return nil, fmt.Errorf("%s: %w", m.Name, err)
+				}
+				pulled = append(pulled, m.IR)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return pulled, nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package ir
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func readExampleSources(t *testing.T, files ...string) []Source {
+	t.Helper()
+	var srcs []Source
+	for _, file := range files {
+		text, err := os.ReadFile(filepath.Join("..", "examples", "ir", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, Source{Name: filepath.Base(file), Text: []rune(string(text))})
+	}
+	return srcs
+}
+
+func TestArchive_WriteAndRead(t *testing.T) {
+	a, err := ArchiveSources(append(
+		readExampleSources(t, "calc/lib.mir", "calc/fmt.mir", "kernel/kernel.mir"),
+		Source{Name: "chars.mir", Text: []rune(`
+.export _f
+.section .data:
+    chars auto ' ', '\0', '\n', 'a', 300
+    charsLen sizeof chars
+.section .text:
+_f:
+    mov [bp-1] [r1+r2*4]
+    mov r1 charsLen
+    ret
+`)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadArchive(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(a, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	if m := got.Members[got.Index["_println_int"]]; m.Name != "fmt.mir" {
+		t.Errorf("_println_int is in %s", m.Name)
+	}
+}
+
+func TestArchive_DuplicateExport(t *testing.T) {
+	code := `
+.export _f
+.section .text:
+_f:
+    ret
+`
+	_, err := ArchiveSources([]Source{
+		{Name: "a.mir", Text: []rune(code)},
+		{Name: "b.mir", Text: []rune(code)},
+	})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestLink_PullsArchiveMembers(t *testing.T) {
+	// unused.mir は誰からもimportされないので、入れると衝突する msg があってもリンクできる
+	a, err := ArchiveSources(append(
+		readExampleSources(t, "calc/fmt.mir", "calc/lib.mir"),
+		Source{Name: "unused.mir", Text: []rune(`
+.export _unused
+.section .data:
+    newline auto 0
+.section .text:
+_unused:
+    ret
+`)},
+		Source{Name: "twice.mir", Text: []rune(`
+.export _twice
+.import _add
+.section .text:
+_twice:
+    mov r2 r1
+    call _add
+    ret
+`)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := `
+.import _twice
+.import _println_int
+.section .text:
+    global _start
+_start:
+    mov r1 21
+    call _twice
+    mov r1 r0
+    call _println_int
+    mov r0 0
+    syscall
+`
+	nodes, info, err := LinkWithDebugInfo(parseSources(t, main), &LinkConfig{
+		Archives:   []*Archive{a},
+		KeepUnused: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// twice.mir が使う lib.mir も取り出される
+	for _, name := range []string{"_twice", "_add", "_println_int"} {
+		if _, ok := info.Lookup(name); !ok {
+			t.Errorf("%s not found:\n%s", name, Print(nodes))
+		}
+	}
+	if _, ok := info.Lookup("_unused"); ok {
+		t.Errorf("_unused is pulled:\n%s", Print(nodes))
+	}
+
+	// アーカイブがなければ解決できない
+	if _, err := Link(parseSources(t, main)); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
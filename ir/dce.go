@@ -0,0 +1,265 @@
+package ir
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// textUnit Textの中の1命令、またはラベルの定義
+type textUnit struct {
+	pos  int
+	size int
+}
+
+// splitText Textを命令とラベル定義に分ける。ラベル定義は後でNOPになるので1つ分の大きさ
+func splitText(text []Node) []textUnit {
+	var units []textUnit
+	for pos := 0; pos < len(text); {
+		size := 1
+		if op, ok := text[pos].(Operation); ok {
+			size += op.NumOperands()
+		}
+		units = append(units, textUnit{pos, size})
+		pos += size
+	}
+	return units
+}
+
+// fallsThrough 実行後に次の命令へ進むことがあるか
+func fallsThrough(nd Node) bool {
+	switch nd {
+	case JMP, RET, TAILCALL, TEXIT, IRET:
+		return false
+	default:
+		return true
+	}
+}
+
+// liveness エントリーポイントからたどれる命令
+type liveness struct {
+	units []textUnit
+	// unitAt 位置 -> units の番号
+	unitAt map[int]int
+	// reachable units ごとに、たどれる関数の中にあるか
+	reachable []bool
+	// usedData たどれる関数から参照される名前のうち、関数でないもの
+	usedData map[string]bool
+}
+
+// findReachable エントリーポイントからたどれる関数を探す
+// 関数はグローバルラベルから次のグローバルラベルの手前まで。call/jmp などの飛び先と、次の関数への流れ込みをたどる
+// 飛び先はラベルでも (+n) でもよい。エントリーポイントがないときや、pcを値として使うときはnil
+func findReachable(ir *IR) (*liveness, error) {
+	if ir.EntryPoint == "" {
+		return nil, nil
+	}
+	units := splitText(ir.Text)
+	unitAt := map[int]int{}
+	defines := map[string]int{}
+	// heads 関数の先頭。ファイルの中で解決済みのラベルは Locals にある。`__` から始まるものは関数の中のラベル
+	heads := map[int]bool{}
+	for i, u := range units {
+		unitAt[u.pos] = i
+		if label, ok := ir.Text[u.pos].(Label); ok && label.Define {
+			defines[label.Name] = i
+			heads[i] = true
+		}
+	}
+	for _, l := range ir.Locals {
+		if i, ok := unitAt[l.Pos]; ok && !strings.HasPrefix(l.Name, "__") {
+			heads[i] = true
+		}
+	}
+	// funcs 関数の最初の命令。units[funcs[k]:funcs[k+1]] がk番目の関数
+	funcs := []int{0}
+	funcOf := make([]int, len(units))
+	for i := range units {
+		if heads[i] && i != 0 {
+			funcs = append(funcs, i)
+		}
+		funcOf[i] = len(funcs) - 1
+	}
+	funcs = append(funcs, len(units))
+	entry, ok := defines[ir.EntryPoint]
+	if !ok {
+		return nil, nil
+	}
+
+	live := make([]bool, len(funcs)-1)
+	usedData := map[string]bool{}
+	stack := []int{funcOf[entry]}
+	for len(stack) != 0 {
+		k := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if live[k] {
+			continue
+		}
+		live[k] = true
+		for _, u := range units[funcs[k]:funcs[k+1]] {
+			head := ir.Text[u.pos]
+			for _, nd := range ir.Text[u.pos+1 : u.pos+u.size] {
+				switch nd := nd.(type) {
+				case Offset:
+					if nd.Target != PC {
+						continue
+					}
+					dst, ok := unitAt[u.pos+nd.Diff]
+					if !ok {
+						return nil, fmt.Errorf("%s: invalid target: %d", head.String(), u.pos+nd.Diff)
+					}
+					stack = append(stack, funcOf[dst])
+				case Label:
+					if dst, ok := defines[nd.Name]; ok {
+						stack = append(stack, funcOf[dst])
+					} else {
+						usedData[nd.Name] = true
+					}
+				case Register:
+					// pcを値として使うと、どこへ飛ぶか分からない
+					if nd == PC {
+						return nil, nil
+					}
+				}
+			}
+		}
+		last := units[funcs[k+1]-1]
+		if fallsThrough(ir.Text[last.pos]) && k+1 < len(live) {
+			stack = append(stack, k+1)
+		}
+	}
+	reachable := make([]bool, len(units))
+	for i := range units {
+		reachable[i] = live[funcOf[i]]
+	}
+	return &liveness{units, unitAt, reachable, usedData}, nil
+}
+
+// eliminateDeadCode エントリーポイントからたどれない関数を取り除く。たどれた関数は、その中の命令をすべて残す
+// dataOwners がnilでなければ、たどれる関数から参照されない .data の定数も取り除く。dataOwners は定数を定義したファイル
+// 同じファイルの定数は続けて並ぶので、最初に参照される定数より後ろは、参照されなくても残す
+// 残ったノードの元の位置を返す。何も取り除かなければnil
+func eliminateDeadCode(ir *IR, dataOwners map[string]int) ([]int, error) {
+	l, err := findReachable(ir)
+	if l == nil {
+		return nil, err
+	}
+	units, reachable, usedData := l.units, l.reachable, l.usedData
+
+	// 残す命令の新しい位置
+	newPos := map[int]int{}
+	pos := 0
+	for i, u := range units {
+		if reachable[i] {
+			newPos[u.pos] = pos
+			pos += u.size
+		}
+	}
+	var text []Node
+	var kept []int
+	for i, u := range units {
+		if !reachable[i] {
+			continue
+		}
+		text = append(text, ir.Text[u.pos])
+		for j := u.pos; j < u.pos+u.size; j++ {
+			kept = append(kept, j)
+		}
+		for _, nd := range ir.Text[u.pos+1 : u.pos+u.size] {
+			if off, ok := nd.(Offset); ok && off.Target == PC {
+				nd = Offset{PC, newPos[u.pos+off.Diff] - newPos[u.pos]}
+			}
+			text = append(text, nd)
+		}
+	}
+	var locals []LabelLocation
+	for _, l := range ir.Locals {
+		if p, ok := newPos[l.Pos]; ok {
+			locals = append(locals, LabelLocation{l.Name, p})
+		}
+	}
+	var constants []Constant
+	// referenced ファイルごとに、参照される定数がもう出てきたか
+	referenced := map[int]bool{}
+	for _, c := range ir.Constants {
+		if c.Mode == AUTO && dataOwners != nil {
+			owner := dataOwners[c.Name]
+			referenced[owner] = referenced[owner] || usedData[c.Name]
+			if !referenced[owner] {
+				continue
+			}
+		}
+		constants = append(constants, c)
+	}
+	ir.Text = text
+	ir.Locals = locals
+	ir.Constants = constants
+	return kept, nil
+}
+
+// dataOwners AUTO定数の名前 -> 定義したファイルの番号
+func dataOwners(irs []*IR) map[string]int {
+	owners := map[string]int{}
+	for i, ir := range irs {
+		for _, c := range ir.Constants {
+			if c.Mode == AUTO {
+				owners[c.Name] = i
+			}
+		}
+	}
+	return owners
+}
+
+// unusedSymbols どこからもimportも参照もされないexportと、エントリーポイントからたどれない関数のラベルを警告の文にする
+// 流れ込みでたどれるラベルや関数の中のラベルは、参照されていなくても警告しない
+func unusedSymbols(irs []*IR, merged *IR) []string {
+	var warnings []string
+	imported := map[string]bool{}
+	for _, ir := range irs {
+		for _, name := range ir.Imports {
+			imported[name] = true
+		}
+	}
+	referencedName := map[string]bool{}
+	var heads []LabelLocation
+	for _, u := range splitText(merged.Text) {
+		if label, ok := merged.Text[u.pos].(Label); ok && label.Define {
+			heads = append(heads, LabelLocation{label.Name, u.pos})
+			continue
+		}
+		for _, nd := range merged.Text[u.pos+1 : u.pos+u.size] {
+			if label, ok := nd.(Label); ok {
+				referencedName[label.Name] = true
+			}
+		}
+	}
+	// 同じファイルの中で使っているexportは、importされなくても警告しない
+	warned := map[string]bool{}
+	for _, ir := range irs {
+		for _, name := range ir.Exports {
+			if !imported[name] && !referencedName[name] {
+				warnings = append(warnings, fmt.Sprintf("%s is exported but never imported", name))
+				warned[name] = true
+			}
+		}
+	}
+
+	l, err := findReachable(merged)
+	if l == nil || err != nil {
+		return warnings
+	}
+	for _, local := range merged.Locals {
+		if !strings.HasPrefix(local.Name, "__") {
+			heads = append(heads, local)
+		}
+	}
+	sort.SliceStable(heads, func(i, j int) bool {
+		return heads[i].Pos < heads[j].Pos
+	})
+	for _, h := range heads {
+		if i, ok := l.unitAt[h.Pos]; ok && !l.reachable[i] && !warned[h.Name] {
+			warnings = append(warnings, fmt.Sprintf("label %s is unreachable", h.Name))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,165 @@
+package ir
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLink_EliminatesDeadCode(t *testing.T) {
+	lib := `
+.export _print
+.export _println
+.export _flush
+.section .data:
+    unused auto "bb"
+    used auto "a"
+    after auto 0
+.section .text:
+_print:
+    mov r1 used
+    call _flush
+    ret
+_println:
+    call _print
+    ret
+_flush:
+    ret
+`
+	main := `
+.import _print
+.section .text:
+    global _start
+_start:
+    call _print
+    ret
+_dead:
+    mov r1 1
+    ret
+`
+	var warnings []string
+	nodes, info, err := LinkWithDebugInfo(parseSources(t, lib, main), &LinkConfig{
+		StripData: true,
+		Warn:      func(msg string) { warnings = append(warnings, msg) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"_println", "_dead", "unused"} {
+		if _, ok := info.Lookup(name); ok {
+			t.Errorf("%s remains:\n%s", name, Print(nodes))
+		}
+	}
+	// after は参照されないが、used に続けて置かれているので残す
+	for _, name := range []string{"_start", "_print", "_flush", "used", "after"} {
+		if _, ok := info.Lookup(name); !ok {
+			t.Errorf("%s not found:\n%s", name, Print(nodes))
+		}
+	}
+	want := []string{
+		"_println is exported but never imported",
+		"label _dead is unreachable",
+	}
+	if diff := cmp.Diff(want, warnings); diff != "" {
+		t.Errorf("warnings diff: %s", diff)
+	}
+}
+
+// 関数の中の命令は、たどれなくても残す。データは StripData がなければすべて残す
+func TestLink_EliminatesWholeFunctions(t *testing.T) {
+	code := `
+.section .data:
+    num0 auto '0'
+    num1 auto '0'
+    newline auto '\n'
+.section .text:
+    global _start
+_start:
+    mov r1 num0
+    jmp __done
+    mov r1 2
+__done:
+    mov r0 0
+    syscall
+`
+	for _, stripData := range []bool{false, true} {
+		nodes, info, err := LinkWithDebugInfo(parseSources(t, code), &LinkConfig{StripData: stripData})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Node{MOV, R1, Number(0), JMP, Offset{PC, 5}, MOV, R1, Number(2)}
+		start, _ := info.Lookup("_start")
+		if diff := cmp.Diff(want, nodes[start.Addr+1:start.Addr+1+len(want)]); diff != "" {
+			t.Errorf("diff (-want +got):\n%s", diff)
+		}
+		for _, name := range []string{"num0", "num1", "newline"} {
+			if _, ok := info.Lookup(name); !ok {
+				t.Errorf("StripData=%v: %s not found:\n%s", stripData, name, Print(nodes))
+			}
+		}
+	}
+}
+
+func TestLink_KeepUnused(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    mov r0 0
+    syscall
+_f:
+    ret
+`
+	nodes, info, err := LinkWithDebugInfo(parseSources(t, code), &LinkConfig{KeepUnused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.Lookup("_f"); !ok {
+		t.Errorf("_f not found:\n%s", Print(nodes))
+	}
+}
+
+// 流れ込みでたどれるラベルや、参照されない関数の中のラベルは警告しない
+func TestLink_WarnsOnlyUnreachable(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    mov r1 0
+    jmp __skip
+__skip:
+_after:
+    add r1 1
+_exit:
+    mov r0 0
+    syscall
+`
+	var warnings []string
+	_, err := LinkWithConfig(parseSources(t, code), &LinkConfig{
+		KeepUnused: true,
+		Warn:       func(msg string) { warnings = append(warnings, msg) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v", warnings)
+	}
+}
+
+func parseSources(t *testing.T, codes ...string) []*IR {
+	t.Helper()
+	var irs []*IR
+	for _, code := range codes {
+		tokens, err := Tokenize([]rune(code), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ir, err := Parse(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		irs = append(irs, ir)
+	}
+	return irs
+}
@@ -0,0 +1,96 @@
+package ir
+
+import (
+	"sort"
+
+	"github.com/x0y14/minivm/vm"
+)
+
+// debugInfo リンク後のノードからデバッグ情報を作る
+// labels の位置は先頭に shift 個のノードを足す前のもの。origins[pos] はその位置を定義したファイル
+// entry は _pre が最後に飛ぶ先
+func debugInfo(nodes []Node, labels []LabelLocation, shift int, constants []Constant, irs []*IR, origins []string, entry string) *vm.DebugInfo {
+	var exports, imports []string
+	// entryPoints 各ファイルのglobalと、_pre が飛ぶ先
+	entryPoints := map[string]bool{entry: true}
+	// データ名 -> 定義したファイル
+	dataSources := map[string]string{}
+	for _, ir := range irs {
+		for _, c := range ir.Constants {
+			dataSources[c.Name] = ir.Source
+		}
+		exports = append(exports, ir.Exports...)
+		imports = append(imports, ir.Imports...)
+		if ir.EntryPoint != "" {
+			entryPoints[ir.EntryPoint] = true
+		}
+	}
+
+	// 関数の先頭: call/tailcall/spawnの飛び先と、export/エントリーポイント/_pre のラベル
+	starts := map[int]bool{}
+	for pc, nd := range nodes {
+		switch nd {
+		case CALL, TAILCALL, SPAWN:
+			if pc+1 < len(nodes) {
+				if off, ok := nodes[pc+1].(Offset); ok && off.Target == PC {
+					starts[pc+off.Diff] = true
+				}
+			}
+		}
+	}
+	for _, l := range labels {
+		if in(l.Name, exports) || entryPoints[l.Name] || l.Name == "_pre" {
+			starts[l.Pos+shift] = true
+		}
+	}
+	var sorted []int
+	for pc := range starts {
+		sorted = append(sorted, pc)
+	}
+	sort.Ints(sorted)
+	size := func(pc int) int {
+		i := sort.SearchInts(sorted, pc+1)
+		if i < len(sorted) {
+			return sorted[i] - pc
+		}
+		return len(nodes) - pc
+	}
+
+	info := &vm.DebugInfo{}
+	for _, l := range labels {
+		pc := l.Pos + shift
+		sym := vm.DebugSymbol{
+			Kind:     vm.SymbolLabel,
+			Name:     l.Name,
+			Addr:     pc,
+			Exported: in(l.Name, exports),
+			Imported: in(l.Name, imports),
+		}
+		if l.Pos < len(origins) {
+			sym.Source = origins[l.Pos]
+		}
+		if starts[pc] {
+			sym.Kind = vm.SymbolFunction
+			sym.Size = size(pc)
+		}
+		info.Symbols = append(info.Symbols, sym)
+	}
+	addr := dataAddresses(constants)
+	for _, c := range constants {
+		a, ok := addr[c.Name]
+		if !ok {
+			continue
+		}
+		info.Symbols = append(info.Symbols, vm.DebugSymbol{
+			Kind:     vm.SymbolData,
+			Name:     c.Name,
+			Addr:     a,
+			Size:     len(c.Values),
+			Exported: in(c.Name, exports),
+			Imported: in(c.Name, imports),
+			Source:   dataSources[c.Name],
+		})
+	}
+	info.Sort()
+	return info
+}
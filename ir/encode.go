@@ -0,0 +1,317 @@
+package ir
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// パース済みのIRを行ごとのテキストにする。.mar のメンバーはこの形で保存する
+//
+//	.module main
+//	.import _print
+//	.export _main
+//	.global _start
+//	.stack 1024
+//	.data msg auto 'h' 'i' 0
+//	.data msgLen sizeof msg
+//	.equ bufLen 64
+//	.local __loop 3
+//	.export write
+//	.macro write buf len
+//	mov r2 buf
+//	.endm
+//	.text
+//	_main:
+//	mov r1 msg
+//	jmp (-2)
+//	.end
+
+// encodeIR irを行に分けて書き出す
+func encodeIR(ir *IR) []string {
+	var lines []string
+	if ir.Module != "" {
+		lines = append(lines, ".module "+ir.Module)
+	}
+	for _, name := range ir.Imports {
+		lines = append(lines, ".import "+name)
+	}
+	for _, name := range ir.Exports {
+		lines = append(lines, ".export "+name)
+	}
+	if ir.EntryPoint != "" {
+		lines = append(lines, ".global "+ir.EntryPoint)
+	}
+	if ir.StackSize > 0 {
+		lines = append(lines, fmt.Sprintf(".stack %d", ir.StackSize))
+	}
+	if ir.HeapSize > 0 {
+		lines = append(lines, fmt.Sprintf(".heap %d", ir.HeapSize))
+	}
+	for _, c := range ir.Constants {
+		switch c.Mode {
+		case AUTO:
+			line := []string{".data", c.Name, "auto"}
+			for _, v := range c.Values {
+				switch v := v.(type) {
+				case ConstChar:
+					line = append(line, Character(v).String())
+				case ConstInt, ConstExpr:
+					line = append(line, v.String())
+				}
+			}
+			lines = append(lines, strings.Join(line, " "))
+		case SIZEOF:
+			lines = append(lines, fmt.Sprintf(".data %s sizeof %s", c.Name, c.Ref))
+		case EQU:
+			lines = append(lines, fmt.Sprintf(".equ %s %s", c.Name, c.Expr.String()))
+		}
+	}
+	for _, l := range ir.Locals {
+		lines = append(lines, fmt.Sprintf(".local %s %d", l.Name, l.Pos))
+	}
+	for _, m := range ir.Macros {
+		if !m.Exported {
+			continue
+		}
+		lines = append(lines, ".export "+m.Name)
+		lines = append(lines, strings.Join(append([]string{".macro", m.Name}, m.Params...), " "))
+		lines = append(lines, encodeText(m.Body)...)
+		lines = append(lines, ".endm")
+	}
+	lines = append(lines, ".text")
+	lines = append(lines, encodeText(ir.Text)...)
+	return append(lines, ".end")
+}
+
+// encodeText 命令とオペランドを1行にする
+func encodeText(nodes []Node) []string {
+	var lines []string
+	text := expand(nodes)
+	for pos := 0; pos < len(text); {
+		switch nd := text[pos].(type) {
+		case Operation:
+			line := []string{nd.String()}
+			pos++
+			for i := 0; i < nd.NumOperands() && pos < len(text); i++ {
+				line = append(line, encodeNode(text[pos]))
+				pos++
+			}
+			lines = append(lines, strings.Join(line, " "))
+		default:
+			lines = append(lines, encodeNode(nd))
+			pos++
+		}
+	}
+	return lines
+}
+
+func encodeNode(nd Node) string {
+	if label, ok := nd.(Label); ok && label.Define {
+		return label.Name + ":"
+	}
+	return nd.String()
+}
+
+// decodeIR encodeIRで書いた行を読む。.end の次の行の位置も返す
+func decodeIR(lines []string) (*IR, int, error) {
+	ir := &IR{
+		Imports:   []string{},
+		Exports:   []string{},
+		Constants: []Constant{},
+		Text:      []Node{},
+	}
+	inText := false
+	// macro 読んでいる途中のマクロ
+	var macro *Macro
+	for i, line := range lines {
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == ".end" {
+			exportMacros(ir)
+			return ir, i + 1, nil
+		}
+		if macro != nil && fields[0] == ".endm" {
+			ir.Macros = append(ir.Macros, *macro)
+			macro = nil
+			continue
+		}
+		if inText || macro != nil {
+			for _, field := range fields {
+				nd, err := decodeNode(field)
+				if err != nil {
+					return nil, 0, fmt.Errorf("%s: %w", line, err)
+				}
+				if macro != nil {
+					macro.Body = append(macro.Body, nd)
+				} else {
+					ir.Text = append(ir.Text, nd)
+				}
+			}
+			continue
+		}
+		switch {
+		case fields[0] == ".text":
+			inText = true
+		case fields[0] == ".macro" && len(fields) >= 2:
+			macro = &Macro{Name: fields[1], Params: fields[2:]}
+		case fields[0] == ".module" && len(fields) == 2:
+			ir.Module = fields[1]
+		case fields[0] == ".import" && len(fields) == 2:
+			ir.Imports = append(ir.Imports, fields[1])
+		case fields[0] == ".export" && len(fields) == 2:
+			ir.Exports = append(ir.Exports, fields[1])
+		case fields[0] == ".global" && len(fields) == 2:
+			ir.EntryPoint = fields[1]
+		case (fields[0] == ".stack" || fields[0] == ".heap") && len(fields) == 2:
+			size, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %w", line, err)
+			}
+			if fields[0] == ".stack" {
+				ir.StackSize = size
+			} else {
+				ir.HeapSize = size
+			}
+		case fields[0] == ".data" && len(fields) >= 3 && fields[2] == "auto":
+			c := Constant{Name: fields[1], Mode: AUTO}
+			for _, field := range fields[3:] {
+				nd, err := decodeNode(field)
+				if err != nil {
+					return nil, 0, fmt.Errorf("%s: %w", line, err)
+				}
+				switch nd := nd.(type) {
+				case Character:
+					c.Values = append(c.Values, ConstChar(nd))
+				case Number:
+					c.Values = append(c.Values, ConstInt(nd))
+				case Label, Expr:
+					c.Values = append(c.Values, ConstExpr{nd})
+				default:
+					return nil, 0, fmt.Errorf("%s: unsupported data: %s", line, field)
+				}
+			}
+			ir.Constants = append(ir.Constants, c)
+		case fields[0] == ".data" && len(fields) == 4 && fields[2] == "sizeof":
+			ir.Constants = append(ir.Constants, Constant{Name: fields[1], Mode: SIZEOF, Ref: fields[3]})
+		case fields[0] == ".equ" && len(fields) == 3:
+			x, err := decodeNode(fields[2])
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %w", line, err)
+			}
+			ir.Constants = append(ir.Constants, Constant{Name: fields[1], Mode: EQU, Expr: x})
+		case fields[0] == ".local" && len(fields) == 3:
+			pos, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %w", line, err)
+			}
+			ir.Locals = append(ir.Locals, LabelLocation{fields[1], pos})
+		default:
+			return nil, 0, fmt.Errorf("unsupported line: %s", line)
+		}
+	}
+	return nil, 0, fmt.Errorf("missing .end")
+}
+
+// splitFields 空白で区切る。'...' の中の空白では区切らない
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		if runes[i] == ' ' || runes[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		if runes[i] == '\'' {
+			i++
+			for i < len(runes) && runes[i] != '\'' {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if len(runes) <= i {
+				return nil, fmt.Errorf("unterminated char: %s", line)
+			}
+			i++
+		} else {
+			for i < len(runes) && runes[i] != ' ' && runes[i] != '\t' {
+				i++
+			}
+		}
+		fields = append(fields, string(runes[start:i]))
+	}
+	return fields, nil
+}
+
+func decodeNode(field string) (Node, error) {
+	if op, ok := isOperation(field); ok {
+		return op, nil
+	}
+	if reg, ok := isRegister(field); ok {
+		return reg, nil
+	}
+	if n, err := strconv.Atoi(field); err == nil {
+		return Number(n), nil
+	}
+	switch {
+	case strings.HasPrefix(field, "'"):
+		if field == "'\\0'" {
+			return Character(0), nil
+		}
+		r, err := strconv.Unquote(field)
+		if err != nil || len([]rune(r)) != 1 {
+			return nil, fmt.Errorf("broken char: %s", field)
+		}
+		return Character([]rune(r)[0]), nil
+	case strings.HasPrefix(field, "(") && strings.HasSuffix(field, ")"):
+		// `(A+B)*(C+D)` のような式も括弧で始まって終わる
+		if diff, err := strconv.Atoi(field[1 : len(field)-1]); err == nil {
+			return Offset{PC, diff}, nil
+		}
+		return decodeExpr(field)
+	case strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]"):
+		if nd, err := decodeOffset(field[1 : len(field)-1]); err == nil {
+			return nd, nil
+		}
+		// [bp-(LOCALS+1)]
+		return decodeExpr(field)
+	case strings.HasSuffix(field, ":"):
+		return Label{Define: true, Name: strings.TrimSuffix(field, ":")}, nil
+	case strings.ContainsAny(field, "+-*/("):
+		return decodeExpr(field)
+	default:
+		return Label{Define: false, Name: field}, nil
+	}
+}
+
+// decodeOffset `sp+1` `r1+r2*4` のような [] の中身を読む
+func decodeOffset(s string) (Node, error) {
+	i := strings.IndexAny(s, "+-")
+	if i < 0 {
+		return nil, fmt.Errorf("broken offset: [%s]", s)
+	}
+	base, ok := isRegister(s[:i])
+	if !ok {
+		return nil, fmt.Errorf("broken offset: [%s]", s)
+	}
+	if index, scale, ok := strings.Cut(s[i+1:], "*"); ok {
+		indexReg, ok := isRegister(index)
+		n, err := strconv.Atoi(scale)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("broken offset: [%s]", s)
+		}
+		return IndexedOffset{base, indexReg, n}, nil
+	}
+	diff, err := strconv.Atoi(s[i:])
+	if err != nil {
+		return nil, fmt.Errorf("broken offset: [%s]", s)
+	}
+	return Offset{base, diff}, nil
+}
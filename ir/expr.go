@@ -0,0 +1,238 @@
+package ir
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Expr `bufLen-1` `(LOCALS+1)*2` のような定数式。Leftがnilなら `-x`
+// 葉は Number Character Label(.equ と sizeof の名前)
+type Expr struct {
+	Op    TokenKind // Add Sub Mul Div
+	Left  Node
+	Right Node
+}
+
+func (e Expr) isNode() {}
+func (e Expr) String() string {
+	if e.Left == nil {
+		return "-" + exprOperand(e.Right)
+	}
+	return exprOperand(e.Left) + e.Op.String() + exprOperand(e.Right)
+}
+
+// exprOperand 式の中の式は括弧でくくる。文字は空白を含むことがあるので数値で書く
+func exprOperand(nd Node) string {
+	switch nd := nd.(type) {
+	case Expr:
+		return "(" + nd.String() + ")"
+	case Character:
+		return strconv.Itoa(int(nd))
+	}
+	return nd.String()
+}
+
+// ExprOffset `[bp-(LOCALS+1)]` のような、定数式で書いた相対位置。値が決まるとOffsetになる
+type ExprOffset struct {
+	Target Register
+	Diff   Node
+}
+
+func (o ExprOffset) isNode() {}
+func (o ExprOffset) String() string {
+	diff := o.Diff.String()
+	if e, ok := o.Diff.(Expr); !ok || e.Left != nil {
+		diff = "+" + diff
+	}
+	return "[" + o.Target.String() + diff + "]"
+}
+
+// ConstExpr `N*2` のような、リンクするまで値の決まらないデータ
+type ConstExpr struct {
+	Expr Node
+}
+
+func (c ConstExpr) isData() {}
+func (c ConstExpr) String() string {
+	return c.Expr.String()
+}
+
+// constData 式を読んだ結果をデータにする
+func constData(nd Node) ConstantData {
+	switch nd := nd.(type) {
+	case Number:
+		return ConstInt(nd)
+	case Character:
+		return ConstChar(nd)
+	}
+	return ConstExpr{nd}
+}
+
+// parseExpr `a+b` `a-b` を読む。`*` `/` の方が強い
+func (p *parser) parseExpr() (Node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.curt.Kind == Add || p.curt.Kind == Sub {
+		op := p.curt.Kind
+		p.curt = p.curt.Next
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = Expr{op, left, right}
+	}
+	return left, nil
+}
+
+// parseTerm `a*b` `a/b` を読む
+func (p *parser) parseTerm() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.curt.Kind == Mul || p.curt.Kind == Div {
+		op := p.curt.Kind
+		p.curt = p.curt.Next
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = Expr{op, left, right}
+	}
+	return left, nil
+}
+
+// parseUnary `-a` か、数値、文字、名前、`(式)` のどれか
+func (p *parser) parseUnary() (Node, error) {
+	switch p.curt.Kind {
+	case Sub:
+		p.curt = p.curt.Next
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Expr{Op: Sub, Right: x}, nil
+	case Lrb:
+		p.curt = p.curt.Next
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(Rrb); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case Integer:
+		v, err := p.curt.GetValueAsInteger()
+		if err != nil {
+			return nil, err
+		}
+		p.curt = p.curt.Next
+		return Number(v), nil
+	case Char:
+		v, err := p.curt.GetValueAsRune()
+		if err != nil {
+			return nil, err
+		}
+		p.curt = p.curt.Next
+		return Character(v), nil
+	case Identifier:
+		if _, yes := isRegister(string(p.curt.Raw)); yes {
+			return nil, fmt.Errorf("register in constant expression: %s", string(p.curt.Raw))
+		}
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		return Label{false, name}, nil
+	default:
+		return nil, fmt.Errorf("parse: unsupported token in expression: %s", p.curt.Kind.String())
+	}
+}
+
+// isOperator 式を続ける記号か
+func isOperator(kind TokenKind) bool {
+	return kind == Add || kind == Sub || kind == Mul || kind == Div
+}
+
+// mapLabels 式の中も含めて、ndのラベルをfで置き換える
+func mapLabels(nd Node, f func(Label) Node) Node {
+	switch nd := nd.(type) {
+	case Label:
+		return f(nd)
+	case Expr:
+		e := Expr{Op: nd.Op, Right: mapLabels(nd.Right, f)}
+		if nd.Left != nil {
+			e.Left = mapLabels(nd.Left, f)
+		}
+		return e
+	case ExprOffset:
+		return ExprOffset{nd.Target, mapLabels(nd.Diff, f)}
+	}
+	return nd
+}
+
+// renameLabels ndの中のラベルの参照をrenameで付け替える
+func renameLabels(nd Node, rename func(string) string) Node {
+	return mapLabels(nd, func(label Label) Node {
+		return Label{label.Define, rename(label.Name)}
+	})
+}
+
+// renameConstant cの名前と、cが参照している名前を付け替える
+func renameConstant(c Constant, rename func(string) string) Constant {
+	c.Name = rename(c.Name)
+	switch c.Mode {
+	case SIZEOF:
+		c.Ref = rename(c.Ref)
+	case EQU:
+		c.Expr = renameLabels(c.Expr, rename)
+	case AUTO:
+		values := make([]ConstantData, len(c.Values))
+		for i, v := range c.Values {
+			if e, ok := v.(ConstExpr); ok {
+				v = ConstExpr{renameLabels(e.Expr, rename)}
+			}
+			values[i] = v
+		}
+		c.Values = values
+	}
+	return c
+}
+
+// calc 数値どうしの計算
+func calc(op TokenKind, l, r int) (int, error) {
+	switch op {
+	case Add:
+		return l + r, nil
+	case Sub:
+		return l - r, nil
+	case Mul:
+		return l * r, nil
+	case Div:
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+	return 0, fmt.Errorf("unsupported operator: %s", op.String())
+}
+
+// decodeExpr encodeIRで書いた式を読む
+func decodeExpr(field string) (Node, error) {
+	tokens, err := Tokenize([]rune(field), true)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{curt: tokens, macros: map[string]Macro{}}
+	nd, err := p.parseOperand()
+	if err != nil {
+		return nil, fmt.Errorf("broken expression: %s: %w", field, err)
+	}
+	if p.curt.Kind != Eof {
+		return nil, fmt.Errorf("broken expression: %s", field)
+	}
+	return nd, nil
+}
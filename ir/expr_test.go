@@ -0,0 +1,202 @@
+package ir
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse_Expr(t *testing.T) {
+	code := `
+.equ ROWS 3
+.equ COLS ROWS+1
+.equ LOCALS 2
+.macro clear n
+    mov [bp-n] 0
+.endm
+.section .data:
+    buf auto 0, 0, 0, 0
+    bufLen sizeof buf
+    table auto ROWS*COLS, -1, 'a'+1
+.section .text:
+    global _start
+_start:
+    enter LOCALS+1
+    mov r3 bufLen-1
+    mov [bp-(LOCALS+1)] r3
+    mov r1 [sp+LOCALS*2]
+    alloc (ROWS*COLS-2)/2
+    clear LOCALS
+    ret
+`
+	want := `
+.section .text:
+    global _start
+_start:
+    enter 3
+    mov r3 3
+    mov [bp-3] r3
+    mov r1 [sp+4]
+    alloc 5
+    mov [bp-2] 0
+    ret
+`
+	irs := parseSources(t, code, want)
+	if diff := cmp.Diff(irs[1].Text, irs[0].Text); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	wantConstants := []Constant{
+		{Name: "ROWS", Mode: EQU, Expr: Number(3)},
+		{Name: "COLS", Mode: EQU, Expr: Number(4)},
+		{Name: "LOCALS", Mode: EQU, Expr: Number(2)},
+		{Name: "buf", Mode: AUTO, Values: []ConstantData{ConstInt(0), ConstInt(0), ConstInt(0), ConstInt(0)}},
+		{Name: "table", Mode: AUTO, Values: []ConstantData{ConstInt(12), ConstInt(-1), ConstInt(98)}},
+	}
+	if diff := cmp.Diff(wantConstants, irs[0].Constants); diff != "" {
+		t.Errorf("constants diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLink_Expr(t *testing.T) {
+	lib := `
+.export ROWS
+.export COLS
+.equ ROWS 3
+.equ COLS ROWS+1
+`
+	main := `
+.import ROWS
+.import COLS
+.equ CELLS ROWS*COLS
+.section .data:
+    table auto CELLS, CELLS/2
+.section .text:
+    global _start
+_start:
+    enter CELLS
+    mov [bp-(CELLS-1)] 1
+    mov r1 CELLS-1
+    mov r2 table
+    ret
+`
+	literal := `
+.section .data:
+    table auto 12, 6
+.section .text:
+    global _start
+_start:
+    enter 12
+    mov [bp-11] 1
+    mov r1 11
+    mov r2 table
+    ret
+`
+	// importした名前を含む式はリンクまで残る
+	irs := parseSources(t, main, lib)
+	if _, ok := irs[0].Text[2].(Expr); !ok {
+		t.Fatalf("text = %v", irs[0].Text)
+	}
+	want, err := Link(parseSources(t, literal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Link(irs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// 残った式は .mar と部分リンクした .mir にも書ける
+	archive, err := NewArchive([]Member{{"main.mir", irs[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := WriteArchive(&buf, archive); err != nil {
+		t.Fatal(err)
+	}
+	archive, err = ReadArchive(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = Link([]*IR{archive.Members[0].IR, irs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("archive diff (-want +got):\n%s", diff)
+	}
+	partial, err := PartialLink(parseSources(t, main), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = Link(parseSources(t, Format(partial), lib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("partial diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestExpr_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes []string
+		want  string
+	}{
+		{
+			name:  "cyclic",
+			codes: []string{".equ A B+1\n.equ B A*2\n.section .text:\n_start:\n    mov r1 A\n"},
+			want:  "equ cyclic ref: A",
+		},
+		{
+			name:  "not found",
+			codes: []string{".section .text:\n_start:\n    mov r1 N+1\n"},
+			want:  "constant not found: N",
+		},
+		{
+			name:  "data address",
+			codes: []string{".section .data:\n    buf auto 0\n.section .text:\n_start:\n    mov r1 buf+1\n"},
+			want:  "not a constant: buf",
+		},
+		{
+			name:  "register",
+			codes: []string{".section .text:\n_start:\n    mov r1 2*r2\n"},
+			want:  "register in constant expression: r2",
+		},
+		{
+			name:  "division by zero",
+			codes: []string{".equ Z 0\n.section .text:\n_start:\n    mov r1 1/Z\n"},
+			want:  "division by zero",
+		},
+		{
+			name:  "cyclic across files",
+			codes: []string{".import B\n.export A\n.equ A B+1\n.section .text:\n    global _start\n_start:\n    mov r1 A\n", ".import A\n.export B\n.equ B A+1\n"},
+			want:  "cyclic ref",
+		},
+		{
+			name:  "function in expression",
+			codes: []string{".import _f\n.section .text:\n    global _start\n_start:\n    mov r1 _f+1\n", ".export _f\n.section .text:\n_f:\n    ret\n"},
+			want:  "constant not found: _f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srcs []Source
+			for i, code := range tt.codes {
+				srcs = append(srcs, Source{Name: string(rune('a'+i)) + ".mir", Text: []rune(code)})
+			}
+			irs, err := ParseSources(srcs)
+			if err == nil {
+				_, err = LinkWithConfig(irs, &LinkConfig{KeepUnused: true})
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package ir
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Format ラベルが解決されていないirを .mir のソースにする
+// Textのラベルの定義はそのままラベルとして書く
+func Format(ir *IR) string {
+	var b strings.Builder
+	if ir.Module != "" {
+		b.WriteString(".module " + ir.Module + "\n")
+	}
+	for _, name := range ir.Imports {
+		b.WriteString(".import " + name + "\n")
+	}
+	for _, name := range ir.Exports {
+		b.WriteString(".export " + name + "\n")
+	}
+	if ir.StackSize > 0 {
+		b.WriteString(".stack " + strconv.Itoa(ir.StackSize) + "\n")
+	}
+	if ir.HeapSize > 0 {
+		b.WriteString(".heap " + strconv.Itoa(ir.HeapSize) + "\n")
+	}
+	var data []Constant
+	for _, c := range ir.Constants {
+		if c.Mode == EQU {
+			b.WriteString(".equ " + c.Name + " " + sourceNode(c.Expr) + "\n")
+			continue
+		}
+		data = append(data, c)
+	}
+	// 展開済みなので、残すのはほかのファイルから使うexportしたマクロだけ
+	for _, m := range ir.Macros {
+		if !m.Exported {
+			continue
+		}
+		b.WriteString("\n.export " + m.Name + "\n")
+		b.WriteString(strings.TrimRight(".macro "+m.Name+" "+strings.Join(m.Params, ", "), " ") + "\n")
+		formatText(&b, m.Body)
+		b.WriteString(".endm\n")
+	}
+	if len(data) != 0 {
+		b.WriteString("\n.section .data:\n")
+		for _, c := range data {
+			switch c.Mode {
+			case AUTO:
+				var values []string
+				for _, v := range c.Values {
+					switch v := v.(type) {
+					case ConstChar:
+						values = append(values, sourceChar(rune(v)))
+					case ConstInt, ConstExpr:
+						values = append(values, v.String())
+					}
+				}
+				b.WriteString("    " + c.Name + " auto " + strings.Join(values, ", ") + "\n")
+			case SIZEOF:
+				b.WriteString("    " + c.Name + " sizeof " + c.Ref + "\n")
+			}
+		}
+	}
+	b.WriteString("\n.section .text:\n")
+	if ir.EntryPoint != "" {
+		b.WriteString("    global " + ir.EntryPoint + "\n")
+	}
+	formatText(&b, ir.Text)
+	return b.String()
+}
+
+// formatText 命令を1行ずつ、ラベルの定義はインデントせずに書く
+func formatText(b *strings.Builder, nodes []Node) {
+	text := expand(nodes)
+	for pos := 0; pos < len(text); {
+		switch nd := text[pos].(type) {
+		case Operation:
+			line := []string{nd.String()}
+			pos++
+			for i := 0; i < nd.NumOperands() && pos < len(text); i++ {
+				line = append(line, sourceNode(text[pos]))
+				pos++
+			}
+			b.WriteString("    " + strings.Join(line, " ") + "\n")
+		case Label:
+			if nd.Define {
+				b.WriteString(nd.Name + ":\n")
+			} else {
+				b.WriteString("    " + nd.Name + "\n")
+			}
+			pos++
+		default:
+			b.WriteString("    " + sourceNode(nd) + "\n")
+			pos++
+		}
+	}
+}
+
+// sourceNode .mir で書ける形にする
+func sourceNode(nd Node) string {
+	if c, ok := nd.(Character); ok {
+		return sourceChar(rune(c))
+	}
+	return nd.String()
+}
+
+// sourceChar Tokenizeが読めるエスケープだけを使って文字を書く
+func sourceChar(r rune) string {
+	switch r {
+	case 0:
+		return `'\0'`
+	case '\n':
+		return `'\n'`
+	case '\t':
+		return `'\t'`
+	case '\\':
+		return `'\\'`
+	case '\'':
+		return `'\''`
+	default:
+		return "'" + string(r) + "'"
+	}
+}
@@ -0,0 +1,102 @@
+package ir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PathEnv .include と .import "file" を探すディレクトリを並べる環境変数
+const PathEnv = "MINIVM_PATH"
+
+// SearchPaths .include と .import "file" を探すディレクトリ。前にあるものを優先する
+type SearchPaths []string
+
+// SearchPathsFromEnv dirs(-I)の後ろに MINIVM_PATH のディレクトリを足す
+func SearchPathsFromEnv(dirs []string) SearchPaths {
+	paths := append(SearchPaths{}, dirs...)
+	return append(paths, filepath.SplitList(os.Getenv(PathEnv))...)
+}
+
+// Find nameを、fromと同じディレクトリ、pathsの順に探す
+func (s SearchPaths) Find(name, from string) (string, error) {
+	if filepath.IsAbs(name) {
+		if _, err := os.Stat(name); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	dirs := append([]string{filepath.Dir(from)}, s...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: file not found: %s", from, name)
+}
+
+// Include srcの `.include "file.mir"` の行をファイルの中身に置き換える
+// 読み込んだファイルの .include も展開する。同じファイルは最初の1度だけ読み込み、2度目からは空の行にする
+// 自分自身を読み込むとエラーになる。返すSourceの Lines は、各行を書いたファイルと行
+func (s SearchPaths) Include(src Source) (Source, error) {
+	inc := &includer{search: s, done: map[string]bool{filepath.Clean(src.Name): true}}
+	lines, at, err := inc.include(src.Name, string(src.Text), []string{src.Name})
+	if err != nil {
+		return Source{}, err
+	}
+	return Source{Name: src.Name, Text: []rune(strings.Join(lines, "\n")), Lines: at}, nil
+}
+
+// includer 1つのファイルの .include を展開する
+type includer struct {
+	search SearchPaths
+	// done 読み込んだファイル
+	done map[string]bool
+}
+
+// include textの行と、各行を書いたファイルと行を返す
+func (inc *includer) include(from, text string, stack []string) ([]string, []SourceLine, error) {
+	var lines []string
+	var at []SourceLine
+	for i, line := range strings.Split(text, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), ".include")
+		if !ok {
+			lines = append(lines, line)
+			at = append(at, SourceLine{from, i + 1})
+			continue
+		}
+		name, err := strconv.Unquote(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: broken .include: %s", from, i+1, line)
+		}
+		path, err := inc.search.Find(name, from)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range stack {
+			if filepath.Clean(p) == filepath.Clean(path) {
+				return nil, nil, fmt.Errorf("%s: cyclic .include: %s", from, path)
+			}
+		}
+		if inc.done[filepath.Clean(path)] {
+			lines = append(lines, "")
+			at = append(at, SourceLine{from, i + 1})
+			continue
+		}
+		inc.done[filepath.Clean(path)] = true
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		included, includedAt, err := inc.include(path, string(b), append(stack, path))
+		if err != nil {
+			return nil, nil, err
+		}
+		lines = append(lines, included...)
+		at = append(at, includedAt...)
+	}
+	return lines, at, nil
+}
@@ -0,0 +1,172 @@
+package ir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeFiles dirの下にfilesを書く。キーはdirからの相対パス
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchPaths_Find(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/main.mir": "",
+		"app/fmt.mir":  "",
+		"inc/fmt.mir":  "",
+		"inc/lib.mir":  "",
+		"env/lib.mir":  "",
+		"env/io.mir":   "",
+	})
+	t.Setenv(PathEnv, filepath.Join(dir, "env"))
+	search := SearchPathsFromEnv([]string{filepath.Join(dir, "inc")})
+	from := filepath.Join(dir, "app", "main.mir")
+	// 読み込むファイルと同じディレクトリ、-I、MINIVM_PATH の順に探す
+	for name, want := range map[string]string{
+		"fmt.mir": "app/fmt.mir",
+		"lib.mir": "inc/lib.mir",
+		"io.mir":  "env/io.mir",
+	} {
+		got, err := search.Find(name, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != filepath.Join(dir, want) {
+			t.Errorf("Find(%s) = %s, want %s", name, got, want)
+		}
+	}
+	if _, err := search.Find("none.mir", from); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSearchPaths_Include(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"inc/defs.inc": ".include \"more.inc\"\n.export _f\n",
+		"inc/more.inc": ".import _g\n",
+		"loop/a.inc":   ".include \"b.inc\"\n",
+		"loop/b.inc":   ".include \"a.inc\"\n",
+	})
+	search := SearchPaths{filepath.Join(dir, "inc")}
+	src, err := search.Include(Source{Name: filepath.Join(dir, "main.mir"), Text: []rune(`
+.include "defs.inc"
+.section .text:
+_f:
+    call _g
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	irs, err := ParseSources([]Source{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"_g"}, irs[0].Imports); diff != "" {
+		t.Errorf("imports diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"_f"}, irs[0].Exports); diff != "" {
+		t.Errorf("exports diff (-want +got):\n%s", diff)
+	}
+
+	_, err = search.Include(Source{Name: filepath.Join(dir, "loop", "main.mir"), Text: []rune(`.include "a.inc"`)})
+	if err == nil || !strings.Contains(err.Error(), "cyclic .include") {
+		t.Errorf("err = %v, want cyclic .include", err)
+	}
+}
+
+func TestSearchPaths_IncludeOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.inc":      ".include \"common.inc\"\n",
+		"b.inc":      ".include \"common.inc\"\n",
+		"common.inc": ".macro exit\n    mov r0 0\n    syscall\n.endm\n",
+	})
+	// a.inc と b.inc の両方から読み込んでも、マクロの定義は1つ
+	src, err := SearchPaths{}.Include(Source{Name: filepath.Join(dir, "main.mir"), Text: []rune(`
+.include "a.inc"
+.include "b.inc"
+.section .text:
+_start:
+    exit
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(src.Text), ".macro exit"); n != 1 {
+		t.Fatalf("included %d times:\n%s", n, string(src.Text))
+	}
+	if _, err := ParseSources([]Source{src}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchPaths_IncludeErrorLine(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"defs.inc":  ".export _f\n.export 'ab'\n",
+		"parse.inc": "\n.stack x\n",
+	})
+	main := filepath.Join(dir, "main.mir")
+	src, err := SearchPaths{}.Include(Source{Name: main, Text: []rune(`
+.include "defs.inc"
+.section .text:
+_f:
+    ret
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 展開した後の3行目ではなく、defs.inc の2行目
+	_, err = ParseSources([]Source{src})
+	if want := filepath.Join(dir, "defs.inc") + ":2: "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("err = %v, want %s...", err, want)
+	}
+
+	src, err = SearchPaths{}.Include(Source{Name: main, Text: []rune(".include \"parse.inc\"\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseSources([]Source{src})
+	if want := filepath.Join(dir, "parse.inc") + ":2: "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("err = %v, want %s...", err, want)
+	}
+
+	// .include のないファイルは自分の行
+	_, err = ParseSources([]Source{{Name: "main.mir", Text: []rune("\n\n    mov r0 'ab'\n")}})
+	if err == nil || !strings.HasPrefix(err.Error(), "main.mir:3: ") {
+		t.Errorf("err = %v, want main.mir:3: ...", err)
+	}
+}
+
+func TestParse_ImportFile(t *testing.T) {
+	irs := parseSources(t, `
+.import "fmt.mir"
+.import "libmath.mar"
+.import _print
+.section .text:
+_start:
+    call _print
+`)
+	if diff := cmp.Diff([]string{"fmt.mir", "libmath.mar"}, irs[0].Requires); diff != "" {
+		t.Errorf("requires diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"_print"}, irs[0].Imports); diff != "" {
+		t.Errorf("imports diff (-want +got):\n%s", diff)
+	}
+}
@@ -16,10 +16,34 @@ func isOperation(ident string) (Operation, bool) {
 		return STORE, true
 	case "load":
 		return LOAD, true
+	case "store8":
+		return STORE8, true
+	case "store16":
+		return STORE16, true
+	case "store32":
+		return STORE32, true
+	case "store64":
+		return STORE64, true
+	case "load8":
+		return LOAD8, true
+	case "load16":
+		return LOAD16, true
+	case "load32":
+		return LOAD32, true
+	case "load64":
+		return LOAD64, true
+	case "lea":
+		return LEA, true
 	case "call":
 		return CALL, true
 	case "ret":
 		return RET, true
+	case "enter":
+		return ENTER, true
+	case "leave":
+		return LEAVE, true
+	case "tailcall":
+		return TAILCALL, true
 	case "jmp":
 		return JMP, true
 	case "jz":
@@ -38,6 +62,66 @@ func isOperation(ident string) (Operation, bool) {
 		return LT, true
 	case "le":
 		return LE, true
+	case "sadd":
+		return SADD, true
+	case "ssub":
+		return SSUB, true
+	case "seq":
+		return SEQ, true
+	case "sne":
+		return SNE, true
+	case "slt":
+		return SLT, true
+	case "sle":
+		return SLE, true
+	case "dup":
+		return DUP, true
+	case "swap":
+		return SWAP, true
+	case "over":
+		return OVER, true
+	case "drop":
+		return DROP, true
+	case "rot":
+		return ROT, true
+	case "spawn":
+		return SPAWN, true
+	case "yield":
+		return YIELD, true
+	case "join":
+		return JOIN, true
+	case "texit":
+		return TEXIT, true
+	case "chan":
+		return CHAN, true
+	case "send":
+		return SEND, true
+	case "recv":
+		return RECV, true
+	case "close":
+		return CLOSE, true
+	case "lock":
+		return LOCK, true
+	case "unlock":
+		return UNLOCK, true
+	case "cas":
+		return CAS, true
+	case "try":
+		return TRY, true
+	case "endtry":
+		return ENDTRY, true
+	case "throw":
+		return THROW, true
+	case "setvec":
+		return SETVEC, true
+	case "int":
+		return INT, true
+	case "iret":
+		return IRET, true
+	case "cli":
+		return CLI, true
+	case "sti":
+		return STI, true
 	case "syscall":
 		return SYSCALL, true
 	default:
@@ -1,8 +1,12 @@
 package ir
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+
+	"github.com/x0y14/minivm/vm"
 )
 
 func merge(dst, src *IR) (*IR, error) {
@@ -26,6 +30,11 @@ func merge(dst, src *IR) (*IR, error) {
 			mergedText = append(mergedText, nd)
 		}
 	}
+	// srcのラベルはdstの後ろにずれる
+	mergedLocals := dst.Locals
+	for _, l := range src.Locals {
+		mergedLocals = append(mergedLocals, LabelLocation{l.Name, l.Pos + len(dst.Text)})
+	}
 	merged := &IR{
 		Id:         dst.Id,
 		EntryPoint: dst.EntryPoint,
@@ -33,22 +42,95 @@ func merge(dst, src *IR) (*IR, error) {
 		Exports:    append(dst.Exports, src.Exports...),
 		Constants:  append(dst.Constants, src.Constants...),
 		Text:       mergedText,
+		Locals:     mergedLocals,
 	}
 	merged.Imports = mergedImports
 	return merged, nil
 }
 
-func solveData(ir *IR) ([]Node, error) {
-	// 1) データ定数(AUTO)の基底アドレスを計算してマップ化
+// scopePrivate exportされていないデータの名前を、ほかのファイルとぶつからないように `buf_1` のように付け替える
+// locals ならローカルラベルの名前も付け替える。irsは書き換えず、付け替えたコピーを返す
+func scopePrivate(irs []*IR, locals bool) []*IR {
+	// used 使われている名前。付け替え先はこれとぶつからないようにする
+	used := map[string]bool{}
+	for _, ir := range irs {
+		used[ir.EntryPoint] = true
+		for _, name := range ir.Imports {
+			used[name] = true
+		}
+		for _, name := range ir.Exports {
+			used[name] = true
+		}
+		for _, nd := range ir.Text {
+			if label, ok := nd.(Label); ok && label.Define {
+				used[label.Name] = true
+			}
+		}
+	}
+
+	scoped := make([]*IR, 0, len(irs))
+	for _, ir := range irs {
+		rename := map[string]string{}
+		private := func(name string) {
+			newName := name
+			for i := 1; used[newName]; i++ {
+				newName = fmt.Sprintf("%s_%d", name, i)
+			}
+			used[newName] = true
+			rename[name] = newName
+		}
+		for _, c := range ir.Constants {
+			if !in(c.Name, ir.Exports) {
+				private(c.Name)
+			}
+		}
+		if locals {
+			for _, l := range ir.Locals {
+				private(l.Name)
+			}
+		}
+		renamed := func(name string) string {
+			if newName, ok := rename[name]; ok {
+				return newName
+			}
+			return name
+		}
+
+		copied := *ir
+		copied.Constants = make([]Constant, 0, len(ir.Constants))
+		for _, c := range ir.Constants {
+			copied.Constants = append(copied.Constants, renameConstant(c, renamed))
+		}
+		copied.Text = make([]Node, 0, len(ir.Text))
+		for _, nd := range ir.Text {
+			copied.Text = append(copied.Text, renameLabels(nd, renamed))
+		}
+		copied.Locals = nil
+		for _, l := range ir.Locals {
+			copied.Locals = append(copied.Locals, LabelLocation{renamed(l.Name), l.Pos})
+		}
+		scoped = append(scoped, &copied)
+	}
+	return scoped
+}
+
+// dataAddresses データ定数(AUTO)の基底アドレス
+func dataAddresses(constants []Constant) map[string]int {
 	addr := make(map[string]int)
 	hp := 0
-	for _, c := range ir.Constants {
+	for _, c := range constants {
 		if c.Mode != AUTO {
 			continue
 		}
 		addr[c.Name] = hp
 		hp += len(c.Values)
 	}
+	return addr
+}
+
+func solveData(ir *IR, byteMemory bool) ([]Node, error) {
+	// 1) データ定数(AUTO)の基底アドレスを計算してマップ化
+	addr := dataAddresses(ir.Constants)
 
 	// 2) ir.Text を一度だけ走査し、該当 Label を Number(アドレス) に置換
 	result := make([]Node, 0, len(ir.Text))
@@ -73,6 +155,15 @@ func solveData(ir *IR) ([]Node, error) {
 		// 長さ分を確保して捨てレジスタにPOP（既存仕様を踏襲）
 		pre = append(pre, ALLOC, Number(len(c.Values)), POP, R10)
 		for i, v := range c.Values {
+			// バイトメモリでは1要素1バイトで配置する
+			if byteMemory {
+				b := constValue(v)
+				if b < -128 || 255 < b {
+					return nil, fmt.Errorf("data %s[%d] does not fit in a byte: %d", c.Name, i, b)
+				}
+				pre = append(pre, STORE8, Number(base+i), Number(b))
+				continue
+			}
 			switch v := v.(type) {
 			case ConstChar:
 				pre = append(pre, STORE, Number(base+i), Character(v))
@@ -84,11 +175,12 @@ func solveData(ir *IR) ([]Node, error) {
 	return pre, nil
 }
 
-// real entry point, error
-func solve(ir *IR) (int, error) {
+// real entry point, label locations, error
+func solve(ir *IR) (int, []LabelLocation, error) {
 	preLocation := 0
 
 	var preResult []Node
+	var locations []LabelLocation
 	labelLocations := map[string]int{}
 	// ラベル定義の位置だけ全て取得する
 	for pc, nd := range ir.Text {
@@ -101,6 +193,7 @@ func solve(ir *IR) (int, error) {
 		// 定義かつexportされていなかったら
 		if label.Define {
 			labelLocations[label.Name] = pc
+			locations = append(locations, LabelLocation{label.Name, pc})
 			// 無操作と入れ替える
 			preResult = append(preResult, NOP)
 			if label.Name == "_pre" {
@@ -115,7 +208,12 @@ func solve(ir *IR) (int, error) {
 	}
 
 	var result []Node
+	// opPC 直前の命令の位置
+	opPC := 0
 	for pc, nd := range preResult {
+		if _, ok := nd.(Operation); ok {
+			opPC = pc
+		}
 		label, ok := nd.(Label)
 		// ラベルでなければそのまま
 		if !ok {
@@ -125,8 +223,8 @@ func solve(ir *IR) (int, error) {
 		// ラベル呼び出し かつ 場所が記録されている
 		dst, ok := labelLocations[label.Name]
 		if !label.Define && ok {
-			// pc-1なのはjmpなどのOPが基準になるから
-			result = append(result, Offset{PC, dst - (pc - 1)})
+			// jmpなどのOPが基準になる
+			result = append(result, Offset{PC, dst - opPC})
 			continue
 		} else {
 			result = append(result, nd)
@@ -135,28 +233,186 @@ func solve(ir *IR) (int, error) {
 	}
 
 	ir.Text = result
-	return preLocation, nil
+	return preLocation, locations, nil
+}
+
+// LinkConfig リンク時の設定
+type LinkConfig struct {
+	// ByteMemory vm.ByteMemory 向けにデータを1要素1バイトで配置する
+	ByteMemory bool
+	// Optimize リンク後にのぞき穴最適化をかける
+	Optimize bool
+	// KeepUnused エントリーポイントからたどれない関数も残す
+	KeepUnused bool
+	// StripData たどれる関数から参照されない .data の定数も取り除く
+	// 参照される定数より後ろに並ぶものは、続けて置かれていることを前提にしたコードのために残す
+	StripData bool
+	// Warn nilでなければ、importされないexportや参照されないラベルをこれで知らせる
+	Warn func(msg string)
+	// Archives 足りないimportを解決するメンバーだけをここから取り出してリンクする
+	Archives []*Archive
+	// Objects 空でなければ、irsをコンパイルしてこれらと再配置表でつなぐ
+	Objects []*Object
+	// Entry _pre の最後に飛ぶ先。空ならglobalで指定したもの、それもなければ _start
+	Entry string
+	// Startup nilでなければ先頭に置くスタートアップ。_pre からはこのglobalへ飛び、
+	// この中の main への参照はエントリーポイントになる
+	Startup *IR
+}
+
+// Source リンクする .mir ファイルの名前と中身
+type Source struct {
+	Name string
+	Text []rune
+	// Lines Textの各行を書いたファイルと行。.include を展開したときにつく。nilならすべてNameの行
+	Lines []SourceLine
+}
+
+// SourceLine ファイルの名前と行(1から)
+type SourceLine struct {
+	File string
+	Line int
+}
+
+// wrapError errにファイルの名前をつける。行のわかるエラーは、その行を書いたファイルと行にする
+func (src Source) wrapError(err error) error {
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) {
+		return fmt.Errorf("%s: %w", src.Name, err)
+	}
+	at := SourceLine{src.Name, lineErr.Line}
+	if 0 < lineErr.Line && lineErr.Line <= len(src.Lines) {
+		at = src.Lines[lineErr.Line-1]
+	}
+	return fmt.Errorf("%s:%d: %w", at.File, at.Line, lineErr.Err)
+}
+
+// ParseSources srcsを並行にTokenize/Parseする。結果はsrcsと同じ順に並ぶ
+// 複数のファイルが失敗した場合は、srcsで先にあるファイルのエラーを返す
+func ParseSources(srcs []Source) ([]*IR, error) {
+	irs := make([]*IR, len(srcs))
+	errs := make([]error, len(srcs))
+	var wg sync.WaitGroup
+	for i, src := range srcs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens, err := Tokenize(src.Text, true)
+			if err != nil {
+				errs[i] = src.wrapError(err)
+				return
+			}
+			ir, err := Parse(tokens)
+			if err != nil {
+				errs[i] = src.wrapError(err)
+				return
+			}
+			ir.Source = src.Name
+			irs[i] = ir
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return irs, nil
+}
+
+// LinkSources srcsを並行にパースしてからリンクする
+func LinkSources(srcs []Source, config *LinkConfig) ([]Node, error) {
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		return nil, err
+	}
+	return LinkWithConfig(irs, config)
 }
 
 func Link(irs []*IR) ([]Node, error) {
-	globalTable := &SymbolTable{"global", make(map[string]Symbol)}
-	// ラベル解決
+	return LinkWithConfig(irs, &LinkConfig{})
+}
+
+func LinkWithConfig(irs []*IR, config *LinkConfig) ([]Node, error) {
+	nodes, _, err := LinkWithDebugInfo(irs, config)
+	return nodes, err
+}
+
+// LinkWithDebugInfo リンクし、ラベルとPCの対応表も返す
+func LinkWithDebugInfo(irs []*IR, config *LinkConfig) ([]Node, *vm.DebugInfo, error) {
+	p, err := LinkProgram(irs, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Nodes, p.Info, nil
+}
+
+// Program リンクした結果
+type Program struct {
+	Nodes []Node
+	// Info ラベルとPCの対応表
+	Info *vm.DebugInfo
+	// Resources .stack .heap をまとめ、ヒープには _pre が確保する .data を足したもの
+	Resources vm.Resources
+}
+
+// LinkProgram リンクし、対応表とプログラムに必要な大きさも返す
+func LinkProgram(irs []*IR, config *LinkConfig) (*Program, error) {
+	if len(config.Objects) > 0 {
+		return linkObjects(irs, config)
+	}
+	// シンボルを集める前に、importしたマクロを展開する
+	irs, err := ExpandMacros(irs, config.Archives)
+	if err != nil {
+		return nil, err
+	}
+	// アーカイブから必要なメンバーを足す
+	pulled, err := pullMembers(irs, config.Archives)
+	if err != nil {
+		return nil, err
+	}
+	irs = append(irs[:len(irs):len(irs)], pulled...)
+
 	var entryPoint string
 	entryCount := 0
-	irMap := map[string]*IR{}
-	for i, ir := range irs {
-		// 適当にIRに名前をつける
-		ir.Id = strconv.Itoa(i)
+	for _, ir := range irs {
 		if ir.EntryPoint != "" {
 			entryCount++
 			entryPoint = ir.EntryPoint
 		}
-		irMap[ir.Id] = ir
 	}
 	// エントリーポイントが複数存在しないかチェック
 	if entryCount > 1 {
 		return nil, fmt.Errorf("too many entryPoint: %d", entryCount)
 	}
+	// --entry があればそちらを優先する。どちらもなければ _start
+	if config.Entry != "" {
+		entryPoint = config.Entry
+	}
+	if entryPoint == "" {
+		entryPoint = "_start"
+	}
+	// スタートアップを先頭に置き、_pre からはスタートアップへ飛ぶ
+	if config.Startup != nil {
+		if err := checkStartup(config.Startup, irs); err != nil {
+			return nil, err
+		}
+		stub := bindStartup(config.Startup, entryPoint)
+		irs = append([]*IR{stub}, irs...)
+		entryPoint = stub.EntryPoint
+	}
+
+	// exportされていないデータはファイルの中だけの名前
+	irs = scopePrivate(irs, false)
+
+	globalTable := &SymbolTable{"global", make(map[string]Symbol)}
+	// ラベル解決
+	irMap := map[string]*IR{}
+	for i, ir := range irs {
+		// 適当にIRに名前をつける
+		ir.Id = strconv.Itoa(i)
+		irMap[ir.Id] = ir
+	}
 
 	resultIr := &IR{
 		Id:         "",
@@ -166,7 +422,12 @@ func Link(irs []*IR) ([]Node, error) {
 		EntryPoint: entryPoint,
 		Text:       []Node{},
 	}
+	// origins Textの各ノードを定義したファイル
+	var origins []string
 	for _, ir := range irs {
+		for range ir.Text {
+			origins = append(origins, ir.Source)
+		}
 		mergedIr, err := merge(resultIr, ir)
 		if err != nil {
 			return nil, err
@@ -187,29 +448,70 @@ func Link(irs []*IR) ([]Node, error) {
 	if len(unsolved) > 0 {
 		return nil, fmt.Errorf("unsolved label exists: %v", unsolved)
 	}
+	if sym, ok := globalTable.Symbols[entryPoint]; !ok || sym.Kind != Function {
+		return nil, fmt.Errorf("entry point not found: %s", entryPoint)
+	}
 
-	// sizeofを解決する
-	_, nds, err := solveSizeof([]string{}, resultIr.Constants, resultIr.Text)
+	// sizeof と定数式を解決する
+	constants, nds, err := solveConstants([]string{}, resultIr.Constants, resultIr.Text)
 	if err != nil {
 		return nil, err
 	}
+	resultIr.Constants = constants
 	resultIr.Text = nds
 
+	if config.Warn != nil {
+		for _, msg := range unusedSymbols(irs, resultIr) {
+			config.Warn(msg)
+		}
+	}
+	// たどれない関数と、StripData なら使われないデータを取り除く
+	if !config.KeepUnused {
+		var owners map[string]int
+		if config.StripData {
+			owners = dataOwners(irs)
+		}
+		kept, err := eliminateDeadCode(resultIr, owners)
+		if err != nil {
+			return nil, err
+		}
+		if kept != nil {
+			keptOrigins := make([]string, len(kept))
+			for i, pos := range kept {
+				keptOrigins[i] = origins[pos]
+			}
+			origins = keptOrigins
+		}
+	}
+
 	// 定数解決
-	preScript, err := solveData(resultIr)
+	preScript, err := solveData(resultIr, config.ByteMemory)
 	if err != nil {
 		return nil, err
 	}
 
 	resultIr.Text = append(resultIr.Text, Label{Define: true, Name: "_pre"})
 	resultIr.Text = append(resultIr.Text, preScript...)
-	resultIr.Text = append(resultIr.Text, JMP, Label{false, "_start"})
-	preLocation, err := solve(resultIr)
+	resultIr.Text = append(resultIr.Text, JMP, Label{false, entryPoint})
+	preLocation, globals, err := solve(resultIr)
 	if err != nil {
 		return nil, err
 	}
 	resultIr.Text = append([]Node{
 		JMP, Offset{PC, preLocation + 2}, // 2 == len(JMP, (...))
 	}, resultIr.Text...)
-	return resultIr.Text, nil
+	labels := append(resultIr.Locals, globals...)
+	info := debugInfo(resultIr.Text, labels, 2, resultIr.Constants, irs, origins, entryPoint)
+	// 取り除いた後に残ったデータの分だけヒープを足す
+	p := &Program{Nodes: resultIr.Text, Info: info, Resources: resources(irs, resultIr.Constants)}
+	if !config.Optimize {
+		return p, nil
+	}
+	optimized, pcMap, err := optimize(resultIr.Text)
+	if err != nil {
+		return nil, err
+	}
+	remapDebugInfo(info, pcMap)
+	p.Nodes = optimized
+	return p, nil
 }
@@ -1,9 +1,11 @@
 package ir
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/x0y14/minivm/vm"
 )
 
 // AUTO 定数ラベルが load/store のオペランドから除去され、数値になること
@@ -90,12 +92,12 @@ _start:
 		t.Fatal(err)
 	}
 
-	// mov r1 2 が存在すること（"hi" の長さ）
+	// mov r1 3 が存在すること（"hi" と終端の '\0' の長さ）
 	found := false
 	for i := 0; i+2 < len(nodes); i++ {
 		if op, ok := nodes[i].(Operation); ok && op == MOV {
 			if r, ok := nodes[i+1].(Register); ok && r == R1 {
-				if n, ok := nodes[i+2].(Number); ok && int(n) == 2 {
+				if n, ok := nodes[i+2].(Number); ok && int(n) == 3 {
 					found = true
 					break
 				}
@@ -103,7 +105,7 @@ _start:
 		}
 	}
 	if !found {
-		t.Fatalf("MOV r1 2 (sizeof resolution) not found in linked output")
+		t.Fatalf("MOV r1 3 (sizeof resolution) not found in linked output")
 	}
 
 	// ラベル sz が残っていないこと
@@ -138,11 +140,11 @@ _start:
 		t.Fatal(err)
 	}
 
-	// プリスクリプト中に ALLOC 2, POP r10 があること
+	// プリスクリプト中に ALLOC 3, POP r10 があること（"AB" と終端の '\0'）
 	foundAlloc := false
 	for i := 0; i+3 < len(nodes); i++ {
 		if op, ok := nodes[i].(Operation); ok && op == ALLOC {
-			if n, ok := nodes[i+1].(Number); ok && int(n) == 2 {
+			if n, ok := nodes[i+1].(Number); ok && int(n) == 3 {
 				if op2, ok := nodes[i+2].(Operation); ok && op2 == POP {
 					if r, ok := nodes[i+3].(Register); ok && r == R10 {
 						foundAlloc = true
@@ -153,7 +155,7 @@ _start:
 		}
 	}
 	if !foundAlloc {
-		t.Fatalf("pre-script ALLOC 2; POP r10 not found")
+		t.Fatalf("pre-script ALLOC 3; POP r10 not found")
 	}
 
 	// data[0]='A', data[1]='B' の STORE があること
@@ -485,3 +487,473 @@ func TestLink_RelativeOffsetCalculation(t *testing.T) {
 		})
 	}
 }
+
+// バイトメモリではデータが STORE8 で1要素1バイトずつ配置されること
+func TestLinkWithConfig_ByteMemoryData(t *testing.T) {
+	code := `
+.section .data:
+    data auto 'A', '\0'
+
+.section .text:
+    global _start
+_start:
+    mov r1 data
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := LinkWithConfig([]*IR{ir}, &LinkConfig{ByteMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Node{
+		ALLOC, Number(2), POP, R10,
+		STORE8, Number(0), Number('A'),
+		STORE8, Number(1), Number(0),
+	}
+	found := false
+	for i := 0; i+len(want) <= len(nodes); i++ {
+		if cmp.Equal(want, nodes[i:i+len(want)]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("byte pre-script not found:\n%s", Print(nodes))
+	}
+}
+
+func TestLinkWithConfig_ByteMemoryDataOverflow(t *testing.T) {
+	code := `
+.section .data:
+    data auto 256
+
+.section .text:
+    global _start
+_start:
+    mov r1 data
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinkWithConfig([]*IR{ir}, &LinkConfig{ByteMemory: true}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestLink_FrameInstructions(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    mov r1 3
+    call _f
+    mov r0 0
+    syscall
+_f:
+    enter 1
+    eq r1 0
+    jz __done
+    sub r1 1
+    tailcall _f
+__done:
+    leave
+    ret
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := Link([]*IR{ir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		NOP, // _f
+		ENTER, Number(1),
+		EQ, R1, Number(0),
+		JZ, Offset{PC, 7},
+		SUB, R1, Number(1),
+		TAILCALL, Offset{PC, -11},
+		NOP, // __done
+		LEAVE,
+		RET,
+	}
+	found := false
+	for i := 0; i+len(want) <= len(nodes); i++ {
+		if cmp.Equal(want, nodes[i:i+len(want)]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("frame instructions not found:\n%s", Print(nodes))
+	}
+}
+
+func TestLink_ThreadInstructions(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    spawn _worker
+    join r0
+    mov r0 0
+    syscall
+_worker:
+    yield
+    texit
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := Link([]*IR{ir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		NOP, // _start
+		SPAWN, Offset{PC, 8},
+		JOIN, R0,
+		MOV, R0, Number(0),
+		SYSCALL,
+		NOP, // _worker
+		YIELD,
+		TEXIT,
+	}
+	found := false
+	for i := 0; i+len(want) <= len(nodes); i++ {
+		if cmp.Equal(want, nodes[i:i+len(want)]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("thread instructions not found:\n%s", Print(nodes))
+	}
+}
+
+func TestLinkSources_MatchesSequentialLink(t *testing.T) {
+	main := `
+.import _add
+.section .text:
+    global _start
+_start:
+    mov r1 1
+    mov r2 2
+    call _add
+    mov r0 0
+    syscall
+`
+	lib := `
+.export _add
+.section .text:
+_add:
+    mov r0 r1
+    add r0 r2
+    ret
+`
+	var irs []*IR
+	for _, code := range []string{main, lib} {
+		tokens, err := Tokenize([]rune(code), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ir, err := Parse(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		irs = append(irs, ir)
+	}
+	want, err := Link(irs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LinkSources([]Source{
+		{Name: "main.mir", Text: []rune(main)},
+		{Name: "lib.mir", Text: []rune(lib)},
+	}, &LinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff:\n%s", diff)
+	}
+}
+
+func TestParseSources_ReportsFileName(t *testing.T) {
+	_, err := ParseSources([]Source{
+		{Name: "ok.mir", Text: []rune(".section .text:\n_f:\n    ret\n")},
+		{Name: "broken.mir", Text: []rune(".section .text:\n    mov r0 `\n")},
+	})
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "broken.mir") {
+		t.Errorf("error %q does not mention broken.mir", err.Error())
+	}
+}
+
+// 2番目のオペランドのラベルも命令の位置を基準にする
+func TestLink_LabelInSecondOperand(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    setvec 0 __handler
+    nop
+__handler:
+    iret
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := Link([]*IR{ir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		SETVEC, Number(0), Offset{PC, 4},
+		NOP,
+		NOP, // __handler
+		IRET,
+	}
+	found := false
+	for i := 0; i+len(want) <= len(nodes); i++ {
+		if cmp.Equal(want, nodes[i:i+len(want)]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("setvec not found:\n%s", Print(nodes))
+	}
+}
+
+func TestLinkWithDebugInfo(t *testing.T) {
+	code := `
+.section .data:
+    msg auto "hi"
+.section .text:
+    global _start
+_start:
+    call _f
+    mov r0 0
+    syscall
+_f:
+    mov r1 1
+_f_done:
+    ret
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, info, err := LinkWithDebugInfo([]*IR{ir}, &LinkConfig{KeepUnused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []vm.DebugSymbol{
+		{Kind: vm.SymbolFunction, Name: "_start", Addr: 2, Size: 7},
+		{Kind: vm.SymbolFunction, Name: "_f", Addr: 9, Size: 6},
+		{Kind: vm.SymbolLabel, Name: "_f_done", Addr: 13},
+		{Kind: vm.SymbolData, Name: "msg", Addr: 0, Size: 3},
+	}
+	for _, want := range tests {
+		got, ok := info.Lookup(want.Name)
+		if !ok {
+			t.Errorf("%s not found", want.Name)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s diff: %s", want.Name, diff)
+		}
+	}
+	// ラベルの位置にはNOPが置かれている
+	if nodes[13] != NOP || nodes[14] != RET {
+		t.Errorf("unexpected nodes at _f_done:\n%s", Print(nodes))
+	}
+}
+
+// exportされていないデータとラベルはファイルごとに別のもの
+func TestLink_PrivateSymbolsAreFileLocal(t *testing.T) {
+	a := `
+.import fmt.print
+.section .data:
+    buf auto "a"
+.section .text:
+    global _start
+_start:
+    mov r1 buf
+__loop:
+    call fmt.print
+    mov r0 0
+    syscall
+`
+	b := `
+.module fmt
+.export print
+.section .data:
+    buf auto "bb"
+.section .text:
+print:
+    mov r2 buf
+__loop:
+    ret
+`
+	nodes, info, err := LinkWithDebugInfo(parseSources(t, a, b), &LinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.Lookup("fmt.print"); !ok {
+		t.Errorf("fmt.print not found:\n%s", Print(nodes))
+	}
+	bufA, okA := info.Lookup("buf")
+	bufB, okB := info.Lookup("buf_1")
+	if !okA || !okB || bufA.Addr == bufB.Addr || bufA.Size != 2 || bufB.Size != 3 {
+		t.Errorf("buf = %+v, buf_1 = %+v", bufA, bufB)
+	}
+}
+
+func TestLink_EntryPoint(t *testing.T) {
+	code := `
+.export _alt
+.section .text:
+    global main
+main:
+    mov r0 1
+    ret
+_alt:
+    mov r0 2
+    ret
+`
+	tests := []struct {
+		name   string
+		config *LinkConfig
+		want   string
+	}{
+		{"global", &LinkConfig{KeepUnused: true}, "main"},
+		{"entry", &LinkConfig{KeepUnused: true, Entry: "_alt"}, "_alt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, info, err := LinkWithDebugInfo(parseSources(t, code), tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// _pre は最後にエントリーポイントへ飛ぶ
+			off, ok := nodes[len(nodes)-1].(Offset)
+			if !ok || nodes[len(nodes)-2] != JMP {
+				t.Fatalf("last node is not jmp:\n%s", Print(nodes))
+			}
+			entry, ok := info.Lookup(tt.want)
+			if !ok || len(nodes)-2+off.Diff != entry.Addr {
+				t.Errorf("_pre does not jump to %s:\n%s", tt.want, Print(nodes))
+			}
+		})
+	}
+
+	if _, err := LinkWithConfig(parseSources(t, code), &LinkConfig{Entry: "_none"}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestLink_Startup(t *testing.T) {
+	code := `
+.section .text:
+    global main
+main:
+    mov r0 7
+    ret
+`
+	startup, err := DefaultStartup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, info, err := LinkWithDebugInfo(parseSources(t, code), &LinkConfig{Startup: startup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, ok := info.Lookup("_start")
+	if !ok || start.Source != "crt0" {
+		t.Fatalf("_start = %+v\n%s", start, Print(nodes))
+	}
+	main, ok := info.Lookup("main")
+	if !ok {
+		t.Fatalf("main not found:\n%s", Print(nodes))
+	}
+	// _start: nop; call main; mov r1 r0; mov r0 0; syscall
+	want := []Node{
+		NOP,
+		CALL, Offset{PC, main.Addr - (start.Addr + 1)},
+		MOV, R1, R0,
+		MOV, R0, Number(0),
+		SYSCALL,
+	}
+	if diff := cmp.Diff(want, nodes[start.Addr:start.Addr+len(want)]); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLink_StartupConflict(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    call main
+    ret
+main:
+    mov r0 7
+    ret
+`
+	startup, err := DefaultStartup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "main.mir: _start is also defined by the startup crt0"
+	srcs := []Source{{Name: "main.mir", Text: []rune(code)}}
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinkWithConfig(irs, &LinkConfig{Startup: startup}); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	objs, err := CompileSources(srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinkWithConfig(nil, &LinkConfig{Startup: startup, Objects: objs}); err == nil || err.Error() != want {
+		t.Errorf("objects: got %v, want %s", err, want)
+	}
+}
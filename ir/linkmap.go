@@ -0,0 +1,130 @@
+package ir
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/x0y14/minivm/vm"
+)
+
+// WriteMap リンクマップを書き出す。関数とラベルはPC順、データはヒープのアドレス順に並べる
+// リンカが足した _pre のファイルは `-` になる
+//
+//	# text
+//	PC  SIZE  KIND   NAME     SOURCE    FLAGS
+//	2   11    func   _start   main.mir
+//	# data
+//	ADDR  LEN  NAME     SOURCE   FLAGS
+//	0     2    newline  fmt.mir
+func WriteMap(w io.Writer, info *vm.DebugInfo) error {
+	symbols := make([]vm.DebugSymbol, len(info.Symbols))
+	copy(symbols, info.Symbols)
+	sorted := &vm.DebugInfo{Symbols: symbols}
+	sorted.Sort()
+
+	source := func(sym vm.DebugSymbol) string {
+		if sym.Source == "" {
+			return "-"
+		}
+		return sym.Source
+	}
+	// flags 行末に空白を残さないよう、なければ空にする
+	flags := func(sym vm.DebugSymbol) string {
+		var f []string
+		if sym.Exported {
+			f = append(f, "export")
+		}
+		if sym.Imported {
+			f = append(f, "import")
+		}
+		if len(f) == 0 {
+			return ""
+		}
+		return "\t" + strings.Join(f, ",")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "# text")
+	fmt.Fprintln(tw, "PC\tSIZE\tKIND\tNAME\tSOURCE\tFLAGS")
+	for _, sym := range sorted.Symbols {
+		if sym.Kind == vm.SymbolData {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s%s\n", sym.Addr, sym.Size, sym.Kind.String(), sym.Name, source(sym), flags(sym))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "# data")
+	fmt.Fprintln(tw, "ADDR\tLEN\tNAME\tSOURCE\tFLAGS")
+	for _, sym := range sorted.Symbols {
+		if sym.Kind != vm.SymbolData {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s%s\n", sym.Addr, sym.Size, sym.Name, source(sym), flags(sym))
+	}
+	return tw.Flush()
+}
+
+// NameListEntry nm の1行
+type NameListEntry struct {
+	// Addr Textでの位置か、ファイルの中でのデータの位置
+	Addr int
+	// Type T: exportした関数かエントリーポイント, t: ローカルラベル, D/d: データ, U: import
+	Type rune
+	Name string
+}
+
+// NameList リンク前のirのシンボルを名前順に返す
+func NameList(ir *IR) []NameListEntry {
+	var entries []NameListEntry
+	for _, name := range ir.Imports {
+		entries = append(entries, NameListEntry{0, 'U', name})
+	}
+	for pos, nd := range ir.Text {
+		if label, ok := nd.(Label); ok && label.Define {
+			entries = append(entries, NameListEntry{pos, 'T', label.Name})
+		}
+	}
+	for _, l := range ir.Locals {
+		entries = append(entries, NameListEntry{l.Pos, 't', l.Name})
+	}
+	addr := dataAddresses(ir.Constants)
+	for _, c := range ir.Constants {
+		a, ok := addr[c.Name]
+		if !ok {
+			continue
+		}
+		typ := 'd'
+		if in(c.Name, ir.Exports) {
+			typ = 'D'
+		}
+		entries = append(entries, NameListEntry{a, typ, c.Name})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// WriteNameList nm の形で書き出す。importにはアドレスがない
+//
+//	0000 T _print
+//	     U _strlen
+func WriteNameList(w io.Writer, ir *IR) error {
+	for _, e := range NameList(ir) {
+		addr := fmt.Sprintf("%04d", e.Addr)
+		if e.Type == 'U' {
+			addr = "    "
+		}
+		if _, err := fmt.Fprintf(w, "%s %c %s\n", addr, e.Type, e.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package ir
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteMap(t *testing.T) {
+	srcs := []Source{
+		{Name: "main.mir", Text: []rune(`
+.import _print
+.section .data:
+    msg auto "hi"
+.section .text:
+    global _start
+_start:
+    mov r2 msg
+    call _print
+    mov r0 0
+    syscall
+`)},
+		{Name: "fmt.mir", Text: []rune(`
+.export _print
+.section .text:
+_print:
+    mov r0 1
+__done:
+    ret
+`)},
+	}
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, info, err := LinkWithDebugInfo(irs, &LinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteMap(&buf, info); err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		got = append(got, strings.Fields(line))
+	}
+	want := [][]string{
+		{"#", "text"},
+		{"PC", "SIZE", "KIND", "NAME", "SOURCE", "FLAGS"},
+		{"2", "10", "func", "_start", "main.mir"},
+		{"12", "6", "func", "_print", "fmt.mir", "export,import"},
+		{"16", "0", "label", "__done", "fmt.mir"},
+		{"18", "16", "func", "_pre", "-"},
+		{"#", "data"},
+		{"ADDR", "LEN", "NAME", "SOURCE", "FLAGS"},
+		{"0", "3", "msg", "main.mir"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s\n%s", diff, buf.String())
+	}
+}
+
+func TestNameList(t *testing.T) {
+	code := `
+.import _print
+.export _f
+.export msg
+.section .data:
+    buf auto 1, 2
+    msg auto "hi"
+.section .text:
+_f:
+    call _print
+__loop:
+    jmp __loop
+`
+	irs := parseSources(t, code)
+	want := []NameListEntry{
+		{3, 't', "__loop"},
+		{0, 'T', "_f"},
+		{0, 'U', "_print"},
+		{0, 'd', "buf"},
+		{2, 'D', "msg"},
+	}
+	if diff := cmp.Diff(want, NameList(irs[0])); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,293 @@
+package ir
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Macro `.macro name a, b` から `.endm` までで定義したマクロ
+//
+//	.macro write buf, len
+//	    mov r0 1
+//	    mov r1 1
+//	    mov r2 buf
+//	    mov r3 len
+//	    syscall
+//	.endm
+type Macro struct {
+	Name   string
+	Params []string
+	// Body ラベルは解決していない命令列。中のマクロ呼び出しは定義したときに展開してある
+	Body     []Node
+	Exported bool
+}
+
+// MacroCall `write msg, msgLen` のようなマクロ呼び出し。引数は同じ行に並べる
+type MacroCall struct {
+	Name string
+	Args []Node
+}
+
+func (m MacroCall) isNode() {}
+func (m MacroCall) String() string {
+	line := []string{m.Name}
+	for _, arg := range m.Args {
+		line = append(line, sourceNode(arg))
+	}
+	return strings.Join(line, " ")
+}
+
+// exportMacros exportしたマクロに印をつける。マクロはシンボルではないのでExportsから外す
+func exportMacros(ir *IR) {
+	for i, m := range ir.Macros {
+		if in(m.Name, ir.Exports) {
+			ir.Macros[i].Exported = true
+			ir.Exports = slices.DeleteFunc(ir.Exports, func(name string) bool { return name == m.Name })
+		}
+	}
+}
+
+// parseMacro `.macro` の後ろから `.endm` までを読む
+func (p *parser) parseMacro() (Macro, error) {
+	id, err := p.expect(Identifier)
+	if err != nil {
+		return Macro{}, err
+	}
+	m := Macro{Name: string(id.Raw)}
+	if _, ok := isOperation(m.Name); ok {
+		return Macro{}, fmt.Errorf("macro %s: name is an instruction", m.Name)
+	}
+	if _, ok := p.macros[m.Name]; ok {
+		return Macro{}, fmt.Errorf("macro exists: %s", m.Name)
+	}
+	// 引数は同じ行に並べる
+	for p.curt.Kind != Eof && p.curt.Position.Line == id.Position.Line {
+		if p.consume(Comma) != nil {
+			continue
+		}
+		param, err := p.expect(Identifier)
+		if err != nil {
+			return Macro{}, fmt.Errorf("macro %s: %w", m.Name, err)
+		}
+		if in(string(param.Raw), m.Params) {
+			return Macro{}, fmt.Errorf("macro %s: duplicate param: %s", m.Name, string(param.Raw))
+		}
+		m.Params = append(m.Params, string(param.Raw))
+	}
+	body, err := p.parseText()
+	if err != nil {
+		return Macro{}, fmt.Errorf("macro %s: %w", m.Name, err)
+	}
+	if p.consume(Dot) == nil || p.consumeIdent("endm") == nil {
+		return Macro{}, fmt.Errorf("macro %s: missing .endm", m.Name)
+	}
+	body = expand(body)
+	// 中で使えるのは先に定義したマクロだけ
+	if imported := importedMacros(body, p.macros); len(imported) != 0 {
+		return Macro{}, fmt.Errorf("macro %s: imported macro in body: %s", m.Name, imported[0])
+	}
+	if body, err = expandMacros(body, p.macros, &p.expansions); err != nil {
+		return Macro{}, fmt.Errorf("macro %s: %w", m.Name, err)
+	}
+	// `1:` は展開のたびに付け替えられるよう、ここで名前にしておく
+	if m.Body, err = solveNumericLabels(body); err != nil {
+		return Macro{}, fmt.Errorf("macro %s: %w", m.Name, err)
+	}
+	return m, nil
+}
+
+// parseMacroCall 命令の位置にあるマクロの名前なら、同じ行の引数と一緒に読む
+func (p *parser) parseMacroCall() (Node, bool, error) {
+	start := p.curt
+	name, err := p.parseName()
+	if err != nil {
+		return nil, false, err
+	}
+	_, local := p.macros[name]
+	if p.curt.Kind == Colon || (!local && !in(name, p.imports)) {
+		p.curt = start
+		return nil, false, nil
+	}
+	call := MacroCall{Name: name}
+	for p.curt.Kind != Eof && p.curt.Kind != Comment && p.curt.Position.Line == start.Position.Line {
+		if p.consume(Comma) != nil {
+			continue
+		}
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, false, fmt.Errorf("macro %s: %w", name, err)
+		}
+		call.Args = append(call.Args, arg)
+	}
+	return call, true, nil
+}
+
+// importedMacros nodesで呼んでいる、macrosにないマクロの名前
+func importedMacros(nodes []Node, macros map[string]Macro) []string {
+	var names []string
+	for _, nd := range nodes {
+		if call, ok := nd.(MacroCall); ok {
+			if _, ok := macros[call.Name]; !ok && !in(call.Name, names) {
+				names = append(names, call.Name)
+			}
+		}
+	}
+	return names
+}
+
+// hygienicName n回目の展開でマクロの中のラベルにつける名前。usedにある名前とはぶつからないようにする
+func hygienicName(name string, n int, used map[string]bool) string {
+	newName := fmt.Sprintf("%s__m%d", name, n)
+	for i := 1; used[newName]; i++ {
+		newName = fmt.Sprintf("%s__m%d_%d", name, n, i)
+	}
+	used[newName] = true
+	return newName
+}
+
+// labelNames nodesとマクロの本体に出てくるラベルの名前
+func labelNames(nodes []Node, macros map[string]Macro) map[string]bool {
+	names := map[string]bool{}
+	record := func(label Label) Node {
+		names[label.Name] = true
+		return label
+	}
+	var walk func(nodes []Node)
+	walk = func(nodes []Node) {
+		for _, nd := range nodes {
+			if call, ok := nd.(MacroCall); ok {
+				walk(call.Args)
+				continue
+			}
+			mapLabels(nd, record)
+		}
+	}
+	walk(nodes)
+	for _, m := range macros {
+		walk(m.Body)
+	}
+	return names
+}
+
+// expandMacros nodesのマクロ呼び出しを本体に置き換える
+// 引数の名前は渡された値に、本体で定義したラベルは展開ごとに別の名前にする
+// 別の名前は、nodesやマクロの本体に出てくるラベルとはぶつからない
+func expandMacros(nodes []Node, macros map[string]Macro, expansions *int) ([]Node, error) {
+	used := labelNames(nodes, macros)
+	var result []Node
+	for _, nd := range nodes {
+		call, ok := nd.(MacroCall)
+		if !ok {
+			result = append(result, nd)
+			continue
+		}
+		m, ok := macros[call.Name]
+		if !ok {
+			return nil, fmt.Errorf("macro not found: %s", call.Name)
+		}
+		if len(call.Args) != len(m.Params) {
+			return nil, fmt.Errorf("macro %s: want %d args, got %d", m.Name, len(m.Params), len(call.Args))
+		}
+		n := *expansions
+		*expansions++
+		locals := map[string]string{}
+		for _, b := range m.Body {
+			if label, ok := b.(Label); ok && label.Define {
+				locals[label.Name] = hygienicName(label.Name, n, used)
+			}
+		}
+		// `n-1` のような式の中の引数も置き換える
+		replace := func(label Label) Node {
+			if newName, ok := locals[label.Name]; ok {
+				return Label{label.Define, newName}
+			}
+			if !label.Define && in(label.Name, m.Params) {
+				return call.Args[slices.Index(m.Params, label.Name)]
+			}
+			return label
+		}
+		for _, b := range m.Body {
+			result = append(result, mapLabels(b, replace))
+		}
+	}
+	return result, nil
+}
+
+// ExpandMacros importしたマクロを使っているirを展開し、ラベルを解決する
+// マクロはirsとarchivesのメンバーがexportしたものから探す。展開しなかったirはそのまま返す
+func ExpandMacros(irs []*IR, archives []*Archive) ([]*IR, error) {
+	exported := map[string]Macro{}
+	define := func(ir *IR) error {
+		for _, m := range ir.Macros {
+			if !m.Exported {
+				continue
+			}
+			if _, ok := exported[m.Name]; ok {
+				return fmt.Errorf("macro exists: %s", m.Name)
+			}
+			exported[m.Name] = m
+		}
+		return nil
+	}
+	for _, ir := range irs {
+		if err := define(ir); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range archives {
+		for _, m := range a.Members {
+			if err := define(m.IR); err != nil {
+				return nil, fmt.Errorf("%s: %w", m.Name, err)
+			}
+		}
+	}
+
+	result := make([]*IR, len(irs))
+	for i, ir := range irs {
+		result[i] = ir
+		if !hasMacroCalls(ir.Text) {
+			continue
+		}
+		// 自分のファイルのマクロを優先する
+		macros := map[string]Macro{}
+		for name, m := range exported {
+			macros[name] = m
+		}
+		for _, m := range ir.Macros {
+			macros[m.Name] = m
+		}
+		expansions := 0
+		program, err := expandMacros(ir.Text, macros, &expansions)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ir.Source, err)
+		}
+		expanded := *ir
+		expanded.Constants = append([]Constant{}, ir.Constants...)
+		if err := solveText(&expanded, program); err != nil {
+			return nil, fmt.Errorf("%s: %w", ir.Source, err)
+		}
+		result[i] = &expanded
+	}
+	return result, nil
+}
+
+func hasMacroCalls(nodes []Node) bool {
+	for _, nd := range nodes {
+		if _, ok := nd.(MacroCall); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandedSource マクロを展開したirを .mir のソースにする。link --expand-macros で使う
+func ExpandedSource(ir *IR) (string, error) {
+	text, err := unsolveLabel(ir)
+	if err != nil {
+		return "", err
+	}
+	expanded := *ir
+	expanded.Text = text
+	return Format(&expanded), nil
+}
@@ -0,0 +1,204 @@
+package ir
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const macroLib = `
+.export write
+.macro write buf, len
+    mov r0 1
+    mov r1 1
+    mov r2 buf
+    mov r3 len
+    syscall
+.endm
+.export _nop
+.section .text:
+_nop:
+    ret
+`
+
+func TestParse_Macro(t *testing.T) {
+	code := `
+.macro count reg, n
+    mov reg 0
+1:
+    add reg 1
+    lt reg n
+    jnz 1b
+.endm
+.section .text:
+_start:
+    count r1 3
+    count r2, 5
+    jmp 1f
+1:
+    ret
+`
+	// 展開ごとに本体のラベルは別の名前になり、呼び出し元の `1:` ともぶつからない
+	want := `
+.section .text:
+_start:
+    mov r1 0
+__1_0__m0:
+    add r1 1
+    lt r1 3
+    jnz __1_0__m0
+    mov r2 0
+__1_0__m1:
+    add r2 1
+    lt r2 5
+    jnz __1_0__m1
+    jmp 1f
+1:
+    ret
+`
+	irs := parseSources(t, code, want)
+	if diff := cmp.Diff(irs[1].Text, irs[0].Text); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	if len(irs[0].Macros) != 1 || irs[0].Macros[0].Exported {
+		t.Errorf("macros = %v", irs[0].Macros)
+	}
+}
+
+func TestParse_MacroNameCollision(t *testing.T) {
+	code := `
+.macro spin
+__loop:
+    jmp __loop
+.endm
+.section .text:
+_start:
+    spin
+    jmp __loop__m0
+__loop__m0:
+    ret
+`
+	// 展開した名前が呼び出し元のラベルとぶつかれば、別の名前にする
+	want := `
+.section .text:
+_start:
+__loop__m0_1:
+    jmp __loop__m0_1
+    jmp __loop__m0
+__loop__m0:
+    ret
+`
+	irs := parseSources(t, code, want)
+	if diff := cmp.Diff(irs[1].Text, irs[0].Text); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLink_ImportedMacro(t *testing.T) {
+	main := `
+.import write
+.section .data:
+    msg auto "hi"
+    msgLen sizeof msg
+.section .text:
+    global _start
+_start:
+    write msg, msgLen
+__loop:
+    jmp __loop
+`
+	expanded := `
+.section .data:
+    msg auto "hi"
+.section .text:
+    global _start
+_start:
+    mov r0 1
+    mov r1 1
+    mov r2 msg
+    mov r3 3
+    syscall
+__loop:
+    jmp __loop
+`
+	irs := parseSources(t, main, macroLib)
+	// importしたマクロはリンクまで展開しない
+	if !hasMacroCalls(irs[0].Text) || len(irs[0].Imports) != 0 {
+		t.Fatalf("text = %v, imports = %v", irs[0].Text, irs[0].Imports)
+	}
+	got, err := LinkWithConfig(irs, &LinkConfig{KeepUnused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := LinkWithConfig(parseSources(t, expanded, macroLib), &LinkConfig{KeepUnused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// アーカイブと部分リンクした .mir からも使える
+	archive, err := NewArchive([]Member{{"lib.mir", parseSources(t, macroLib)[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := WriteArchive(&buf, archive); err != nil {
+		t.Fatal(err)
+	}
+	archive, err = ReadArchive(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinkWithConfig(parseSources(t, main), &LinkConfig{Archives: []*Archive{archive}}); err != nil {
+		t.Errorf("link with archive: %v", err)
+	}
+	lib, err := PartialLink(parseSources(t, macroLib), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinkWithConfig(parseSources(t, main, Format(lib)), &LinkConfig{}); err != nil {
+		t.Errorf("link with partial: %v\n%s", err, Format(lib))
+	}
+}
+
+func TestMacro_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes []string
+		want  string
+	}{
+		{
+			name:  "args",
+			codes: []string{".macro m a\n    mov r1 a\n.endm\n.section .text:\n_start:\n    m 1 2\n"},
+			want:  "want 1 args, got 2",
+		},
+		{
+			name:  "missing endm",
+			codes: []string{".macro m a\n    mov r1 a\n.section .text:\n_start:\n    ret\n"},
+			want:  "missing .endm",
+		},
+		{
+			name:  "not exported",
+			codes: []string{".import m\n.section .text:\n_start:\n    m\n", ".macro m\n    ret\n.endm\n.section .text:\n_f:\n    ret\n"},
+			want:  "macro not found: m",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srcs []Source
+			for i, code := range tt.codes {
+				srcs = append(srcs, Source{Name: string(rune('a'+i)) + ".mir", Text: []rune(code)})
+			}
+			irs, err := ParseSources(srcs)
+			if err == nil {
+				_, err = Link(irs)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
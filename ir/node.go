@@ -2,6 +2,7 @@ package ir
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -29,8 +30,20 @@ const (
 	ALLOC
 	STORE
 	LOAD
+	STORE8
+	STORE16
+	STORE32
+	STORE64
+	LOAD8
+	LOAD16
+	LOAD32
+	LOAD64
+	LEA
 	CALL
 	RET
+	ENTER
+	LEAVE
+	TAILCALL
 	JMP
 	JZ
 	JNZ
@@ -40,55 +53,169 @@ const (
 	NE
 	LT
 	LE
+	SADD
+	SSUB
+	SEQ
+	SNE
+	SLT
+	SLE
+	DUP
+	SWAP
+	OVER
+	DROP
+	ROT
+	SPAWN
+	YIELD
+	JOIN
+	TEXIT
+	CHAN
+	SEND
+	RECV
+	CLOSE
+	LOCK
+	UNLOCK
+	CAS
+	TRY
+	ENDTRY
+	THROW
+	SETVEC
+	INT
+	IRET
+	CLI
+	STI
 	SYSCALL
 )
 
 func (o Operation) isNode() {}
 func (o Operation) String() string {
 	return []string{
-		NOP:     "nop",
-		MOV:     "mov",
-		PUSH:    "push",
-		POP:     "pop",
-		ALLOC:   "alloc",
-		STORE:   "store",
-		LOAD:    "load",
-		CALL:    "call",
-		RET:     "ret",
-		JMP:     "jmp",
-		JZ:      "jz",
-		JNZ:     "jnz",
-		ADD:     "add",
-		SUB:     "sub",
-		EQ:      "eq",
-		NE:      "ne",
-		LT:      "lt",
-		LE:      "le",
-		SYSCALL: "syscall",
+		NOP:      "nop",
+		MOV:      "mov",
+		PUSH:     "push",
+		POP:      "pop",
+		ALLOC:    "alloc",
+		STORE:    "store",
+		LOAD:     "load",
+		STORE8:   "store8",
+		STORE16:  "store16",
+		STORE32:  "store32",
+		STORE64:  "store64",
+		LOAD8:    "load8",
+		LOAD16:   "load16",
+		LOAD32:   "load32",
+		LOAD64:   "load64",
+		LEA:      "lea",
+		CALL:     "call",
+		RET:      "ret",
+		ENTER:    "enter",
+		LEAVE:    "leave",
+		TAILCALL: "tailcall",
+		JMP:      "jmp",
+		JZ:       "jz",
+		JNZ:      "jnz",
+		ADD:      "add",
+		SUB:      "sub",
+		EQ:       "eq",
+		NE:       "ne",
+		LT:       "lt",
+		LE:       "le",
+		SADD:     "sadd",
+		SSUB:     "ssub",
+		SEQ:      "seq",
+		SNE:      "sne",
+		SLT:      "slt",
+		SLE:      "sle",
+		DUP:      "dup",
+		SWAP:     "swap",
+		OVER:     "over",
+		DROP:     "drop",
+		ROT:      "rot",
+		SPAWN:    "spawn",
+		YIELD:    "yield",
+		JOIN:     "join",
+		TEXIT:    "texit",
+		CHAN:     "chan",
+		SEND:     "send",
+		RECV:     "recv",
+		CLOSE:    "close",
+		LOCK:     "lock",
+		UNLOCK:   "unlock",
+		CAS:      "cas",
+		TRY:      "try",
+		ENDTRY:   "endtry",
+		THROW:    "throw",
+		SETVEC:   "setvec",
+		INT:      "int",
+		IRET:     "iret",
+		CLI:      "cli",
+		STI:      "sti",
+		SYSCALL:  "syscall",
 	}[o]
 }
 
 func (o Operation) NumOperands() int {
 	return []int{
-		NOP:     0,
-		MOV:     2,
-		PUSH:    1,
-		POP:     1,
-		ALLOC:   1,
-		STORE:   2,
-		LOAD:    2,
-		CALL:    1,
-		RET:     0,
-		JMP:     1,
-		JZ:      1,
-		JNZ:     1,
-		ADD:     2,
-		SUB:     2,
-		EQ:      2,
-		NE:      2,
-		LT:      2,
-		LE:      2,
-		SYSCALL: 0,
+		NOP:      0,
+		MOV:      2,
+		PUSH:     1,
+		POP:      1,
+		ALLOC:    1,
+		STORE:    2,
+		LOAD:     2,
+		STORE8:   2,
+		STORE16:  2,
+		STORE32:  2,
+		STORE64:  2,
+		LOAD8:    2,
+		LOAD16:   2,
+		LOAD32:   2,
+		LOAD64:   2,
+		LEA:      2,
+		CALL:     1,
+		RET:      0,
+		ENTER:    1,
+		LEAVE:    0,
+		TAILCALL: 1,
+		JMP:      1,
+		JZ:       1,
+		JNZ:      1,
+		ADD:      2,
+		SUB:      2,
+		EQ:       2,
+		NE:       2,
+		LT:       2,
+		LE:       2,
+		SADD:     0,
+		SSUB:     0,
+		SEQ:      0,
+		SNE:      0,
+		SLT:      0,
+		SLE:      0,
+		DUP:      0,
+		SWAP:     0,
+		OVER:     0,
+		DROP:     0,
+		ROT:      0,
+		SPAWN:    1,
+		YIELD:    0,
+		JOIN:     1,
+		TEXIT:    0,
+		CHAN:     1,
+		SEND:     2,
+		RECV:     2,
+		CLOSE:    1,
+		LOCK:     1,
+		UNLOCK:   1,
+		CAS:      2,
+		TRY:      1,
+		ENDTRY:   0,
+		THROW:    1,
+		SETVEC:   2,
+		INT:      1,
+		IRET:     0,
+		CLI:      0,
+		STI:      0,
+		SYSCALL:  0,
 	}[o]
 }
 
@@ -137,6 +264,9 @@ const (
 )
 
 func (r Register) isNode() {}
+func (r Register) isGeneral() bool {
+	return R0 <= r && r <= R10
+}
 func (r Register) String() string {
 	return []string{
 		PC:  "pc",
@@ -158,7 +288,7 @@ func (r Register) String() string {
 	}[r]
 }
 
-// Offset `[sp+1]`のような相対位置
+// Offset `[sp+1]` `[r1+4]`のような相対位置
 type Offset struct {
 	Target Register
 	Diff   int
@@ -172,6 +302,18 @@ func (o Offset) String() string {
 	return fmt.Sprintf("[%s%+d]", o.Target.String(), o.Diff)
 }
 
+// IndexedOffset `[r1+r2*4]`のようなレジスタ相対位置
+type IndexedOffset struct {
+	Base  Register
+	Index Register
+	Scale int
+}
+
+func (i IndexedOffset) isNode() {}
+func (i IndexedOffset) String() string {
+	return fmt.Sprintf("[%s+%s*%d]", i.Base.String(), i.Index.String(), i.Scale)
+}
+
 type Number int
 
 func (n Number) isNode() {}
@@ -199,55 +341,164 @@ func (l Label) String() string {
 	return l.Name
 }
 
-var curt *Token
+// parser 1回のParseの状態。呼び出しごとに作るので並行に呼び出せる
+type parser struct {
+	curt *Token
+	// macros ここまでに定義したマクロ。imports と合わせてマクロ呼び出しを見分ける
+	macros  map[string]Macro
+	imports []string
+	// expansions 展開した回数。展開したラベルの名前に使う
+	expansions int
+}
 
-func expect(kind TokenKind) (*Token, error) {
-	if curt.Kind != kind {
-		return nil, fmt.Errorf("want=%s, got=%s", kind.String(), curt.Kind.String())
+func (p *parser) expect(kind TokenKind) (*Token, error) {
+	if p.curt.Kind != kind {
+		return nil, fmt.Errorf("want=%s, got=%s", kind.String(), p.curt.Kind.String())
 	}
-	v := *curt
-	curt = curt.Next
+	v := *p.curt
+	p.curt = p.curt.Next
 	return &v, nil
 }
-func expectIdent(id string) error {
-	if curt.Kind != Identifier {
-		return fmt.Errorf("want=%s, got=%s", Identifier.String(), curt.Kind.String())
+func (p *parser) expectIdent(id string) error {
+	if p.curt.Kind != Identifier {
+		return fmt.Errorf("want=%s, got=%s", Identifier.String(), p.curt.Kind.String())
 	}
-	v := *curt
+	v := *p.curt
 	if string(v.Raw) != id {
 		return fmt.Errorf("want=%s, got=%s", id, string(v.Raw))
 	}
-	curt = curt.Next
+	p.curt = p.curt.Next
 	return nil
 }
-func consume(kind TokenKind) *Token {
-	if curt.Kind != kind {
+func (p *parser) consume(kind TokenKind) *Token {
+	if p.curt.Kind != kind {
 		return nil
 	}
-	v := *curt
-	curt = curt.Next
+	v := *p.curt
+	p.curt = p.curt.Next
 	return &v
 }
-func consumeIdent(id string) *Token {
-	if curt.Kind != Identifier {
+func (p *parser) consumeIdent(id string) *Token {
+	if p.curt.Kind != Identifier {
 		return nil
 	}
-	v := *curt
+	v := *p.curt
 	if string(v.Raw) != id {
 		return nil
 	}
-	curt = curt.Next
+	p.curt = p.curt.Next
 	return &v
 }
 
-func parseStackOffset() ([]Node, error) {
+// follows p.curt が prev の直後に空白なしで続いているか
+func (p *parser) follows(prev *Token) bool {
+	width := len(prev.Raw)
+	if width == 0 {
+		// 記号は1文字
+		width = 1
+	}
+	return p.curt.Position.Line == prev.Position.Line &&
+		p.curt.Position.StartedAt == prev.Position.StartedAt+width
+}
+
+// parseName `println` や `fmt.println` のような名前
+func (p *parser) parseName() (string, error) {
+	id, err := p.expect(Identifier)
+	if err != nil {
+		return "", err
+	}
+	name := string(id.Raw)
+	for p.curt.Kind == Dot && p.follows(id) {
+		dot := p.curt
+		if dot.Next.Kind != Identifier {
+			break
+		}
+		p.curt = dot.Next
+		if !p.follows(dot) {
+			p.curt = dot
+			break
+		}
+		id, _ = p.expect(Identifier)
+		name += "." + string(id.Raw)
+	}
+	return name, nil
+}
+
+func (p *parser) parseRegisterOffset(base Register) ([]Node, error) {
+	// [r1]
+	if p.consume(Rcb) != nil {
+		return []Node{Offset{base, 0}}, nil
+	}
+
+	// index * scale
+	if p.curt.Kind == Add && p.curt.Next.Kind == Identifier {
+		if index, yes := isRegister(string(p.curt.Next.Raw)); yes {
+			if !index.isGeneral() {
+				return nil, fmt.Errorf("unsupported index register: %s", string(p.curt.Next.Raw))
+			}
+			p.curt = p.curt.Next.Next
+			if _, err := p.expect(Mul); err != nil {
+				return nil, err
+			}
+			scale, err := p.expect(Integer)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(Rcb); err != nil {
+				return nil, err
+			}
+			v, err := scale.GetValueAsInteger()
+			if err != nil {
+				return nil, err
+			}
+			return []Node{IndexedOffset{base, index, v}}, nil
+		}
+	}
+
+	diff, err := p.parseOffsetDiff(base)
+	if err != nil {
+		return nil, err
+	}
+	return []Node{diff}, nil
+}
+
+// parseOffsetDiff `[sp+1]` `[bp-(LOCALS+1)]` の `+1` `-(LOCALS+1)` と `]` を読む
+// 数値ならOffset、名前を含む式ならExprOffsetにする
+func (p *parser) parseOffsetDiff(base Register) (Node, error) {
+	if p.curt.Kind != Add && p.curt.Kind != Sub {
+		return nil, fmt.Errorf("syntax err")
+	}
+	// `-` は単項マイナスとして式に含める
+	p.consume(Add)
+	diff, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	// ]
+	if _, err := p.expect(Rcb); err != nil {
+		return nil, err
+	}
+
+	switch d := diff.(type) {
+	case Number:
+		return Offset{base, int(d)}, nil
+	case Expr:
+		if n, ok := d.Right.(Number); ok && d.Left == nil {
+			return Offset{base, -int(n)}, nil
+		}
+	}
+	return ExprOffset{base, diff}, nil
+}
+
+func (p *parser) parseStackOffset() ([]Node, error) {
 	// [
-	if _, err := expect(Lcb); err != nil {
+	if _, err := p.expect(Lcb); err != nil {
 		return nil, err
 	}
 
 	// sp / bp
-	id, err := expect(Identifier)
+	id, err := p.expect(Identifier)
 	if err != nil {
 		return nil, err
 	}
@@ -258,111 +509,139 @@ func parseStackOffset() ([]Node, error) {
 	case "bp":
 		reg = BP
 	default:
+		// [r1+4] / [r1+r2*4]
+		if base, yes := isRegister(string(id.Raw)); yes && base.isGeneral() {
+			return p.parseRegisterOffset(base)
+		}
 		return nil, fmt.Errorf("unsupported register: %s", string(id.Raw))
 	}
 
-	// +
-	plus := consume(Add)
-	// -
-	minus := consume(Sub)
-	if plus != nil && minus != nil {
-		return nil, fmt.Errorf("syntax err")
-	}
-
-	// diff
-	diff, err := expect(Integer)
+	diff, err := p.parseOffsetDiff(reg)
 	if err != nil {
 		return nil, err
 	}
-
-	// ]
-	if _, err := expect(Rcb); err != nil {
-		return nil, err
-	}
-
-	v, err := diff.GetValueAsInteger()
-	if err != nil {
-		return nil, err
-	}
-	if minus != nil {
-		return []Node{Offset{reg, -v}}, nil
-	}
-	return []Node{Offset{reg, v}}, nil
+	return []Node{diff}, nil
 }
 
-func parseLabel() ([]Node, error) {
-	// id
-	id, err := expect(Identifier)
+func (p *parser) parseLabel() ([]Node, error) {
+	// id, module.id
+	name, err := p.parseName()
 	if err != nil {
 		return nil, err
 	}
 
 	// :
 	var define = false
-	if t := consume(Colon); t != nil {
+	if t := p.consume(Colon); t != nil {
 		define = true
 	}
 
-	return []Node{Label{define, string(id.Raw)}}, nil
+	return []Node{Label{define, name}}, nil
+}
+
+// parseNumericLabel `1:` を定義、`1b` `1f` を参照にする。名前は数字から始まるので普通のラベルとぶつからない
+func (p *parser) parseNumericLabel() ([]Node, bool) {
+	num := p.curt
+	next := num.Next
+	p.curt = next
+	switch {
+	case next.Kind == Colon && p.follows(num):
+		p.curt = next.Next
+		return []Node{Label{true, string(num.Raw)}}, true
+	case next.Kind == Identifier && p.follows(num) && (string(next.Raw) == "b" || string(next.Raw) == "f"):
+		p.curt = next.Next
+		return []Node{Label{false, string(num.Raw) + string(next.Raw)}}, true
+	}
+	p.curt = num
+	return nil, false
 }
 
-func parseText() ([]Node, error) {
+// parseText 命令列を読む。`.endm` などのディレクティブの手前で止まる
+func (p *parser) parseText() ([]Node, error) {
 	var nodes []Node
+	// operands 直前の命令がまだ取るオペランドの数。0なら次は命令かラベルかマクロ呼び出し
+	operands := 0
 loop:
 	for {
-		switch curt.Kind {
-		case Eof:
+		switch p.curt.Kind {
+		case Eof, Dot:
 			break loop
 		case Comment:
-			curt = curt.Next
+			p.curt = p.curt.Next
+			continue
 		case Identifier:
-			if op, yes := isOperation(string(curt.Raw)); yes {
+			if op, yes := isOperation(string(p.curt.Raw)); yes {
 				nodes = append(nodes, op)
-				curt = curt.Next
-				continue
-			}
-			if reg, yes := isRegister(string(curt.Raw)); yes {
-				nodes = append(nodes, reg)
-				curt = curt.Next
+				p.curt = p.curt.Next
+				operands = op.NumOperands()
 				continue
 			}
-			nds, err := parseLabel()
-			if err != nil {
-				return nil, err
-			}
-			nodes = append(nodes, nds...)
-		case Integer:
-			v, err := curt.GetValueAsInteger()
-			if err != nil {
-				return nil, err
-			}
-			nodes = append(nodes, Number(v))
-			curt = curt.Next
-		case Char:
-			v, err := curt.GetValueAsRune()
-			if err != nil {
-				return nil, err
-			}
-			nodes = append(nodes, Character(v))
-			curt = curt.Next
-		case Lcb:
-			nds, err := parseStackOffset()
-			if err != nil {
-				return nil, err
+			if operands == 0 {
+				call, ok, err := p.parseMacroCall()
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					nodes = append(nodes, call)
+					continue
+				}
 			}
-			nodes = append(nodes, nds...)
-		default:
-			return nil, fmt.Errorf("parse: unsupported token: %s", curt.Kind.String())
+		}
+		nd, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, nd)
+		if label, ok := nd.(Label); !ok || !label.Define {
+			operands = max(operands-1, 0)
 		}
 	}
 	return nodes, nil
 }
 
+// parseOperand レジスタ、数値、文字、ラベル、`[sp+1]`、`bufLen-1` のような定数式のどれか1つを読む
+func (p *parser) parseOperand() (Node, error) {
+	switch p.curt.Kind {
+	case Identifier:
+		if reg, yes := isRegister(string(p.curt.Raw)); yes {
+			p.curt = p.curt.Next
+			return reg, nil
+		}
+		start := p.curt
+		nds, err := p.parseLabel()
+		if err != nil {
+			return nil, err
+		}
+		if label := nds[0].(Label); label.Define || !isOperator(p.curt.Kind) {
+			return label, nil
+		}
+		p.curt = start
+		return p.parseExpr()
+	case Integer:
+		if nds, ok := p.parseNumericLabel(); ok {
+			return nds[0], nil
+		}
+		return p.parseExpr()
+	case Char, Lrb, Sub:
+		return p.parseExpr()
+	case Lcb:
+		nds, err := p.parseStackOffset()
+		if err != nil {
+			return nil, err
+		}
+		return nds[0], nil
+	default:
+		return nil, fmt.Errorf("parse: unsupported token: %s", p.curt.Kind.String())
+	}
+}
+
 type DataMode int
 
 const (
 	AUTO DataMode = iota
 	SIZEOF
+	// EQU `.equ ROWS 3` で名前をつけた定数。メモリには置かない
+	EQU
 )
 
 type ConstantData interface {
@@ -392,38 +671,71 @@ type Constant struct {
 	Mode   DataMode
 	Values []ConstantData // msg auto "hello" <- "hello"
 	Ref    string         // msg sizeof ref <- ref
+	Expr   Node           // .equ ROWS 2+1 <- 2+1
 }
 
 type IR struct {
-	Id         string
+	Id string
+	// Source 読み込んだファイルの名前。リンクマップに出す
+	Source string
+	// Module `.module fmt` の名前。exportした名前は `fmt.println` のようになる
+	Module     string
 	Imports    []string
 	Exports    []string
 	Constants  []Constant
 	EntryPoint string
 	Text       []Node
+	// Locals Parseで解決した、exportされていないラベルのTextでの位置
+	Locals []LabelLocation
+	// StackSize / HeapSize `.stack 1024` `.heap 4096` で指定した大きさ。0は指定なし
+	StackSize int
+	HeapSize  int
+	// Macros このファイルで定義したマクロ
+	Macros []Macro
+	// Requires `.import "fmt.mir"` で名指ししたファイル。CLIが探して一緒にリンクする
+	Requires []string
+}
+
+// LabelLocation ラベルの名前とTextでの位置
+type LabelLocation struct {
+	Name string
+	Pos  int
 }
 
 type ParseMode int
 
-func parseImport() (string, error) {
-	id, err := expect(Identifier)
+func (p *parser) parseImport() (string, error) {
+	return p.parseName()
+}
+
+// parseSize `.stack` `.heap` の大きさ。1以上
+func (p *parser) parseSize(directive string) (int, error) {
+	tok, err := p.expect(Integer)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	return string(id.Raw), nil
+	size, err := tok.GetValueAsInteger()
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf(".%s: size must be positive: %d", directive, size)
+	}
+	return size, nil
 }
 
-func parseExport() (string, error) {
-	id, err := expect(Identifier)
+func (p *parser) parseExport() (string, error) {
+	name, err := p.parseName()
 	if err != nil {
 		return "", nil
 	}
-	return string(id.Raw), nil
+	return name, nil
 }
 
-func parseArray() ([]ConstantData, error) {
+// parseArray `auto` に続く値を読む。lineはデータの名前の行
+func (p *parser) parseArray(line int) ([]ConstantData, error) {
 	// "hi" -> 'h','i'
-	if str := consume(String); str != nil {
+	if str := p.consume(String); str != nil {
 		var arr []ConstantData
 		for _, r := range str.Raw {
 			arr = append(arr, ConstChar(r))
@@ -432,40 +744,37 @@ func parseArray() ([]ConstantData, error) {
 		return arr, nil
 	}
 
-	// arr
+	// arr。最初の値が次の行にあれば、それは次のデータの名前
 	var arr []ConstantData
-	for curt.Kind != Eof {
-		if i := consume(Integer); i != nil {
-			i64, err := strconv.ParseInt(string(i.Raw), 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			arr = append(arr, ConstInt(int(i64)))
-		} else if c := consume(Char); c != nil {
-			arr = append(arr, ConstChar(c.Raw[0]))
+	for p.curt.Kind != Eof && (len(arr) != 0 || p.curt.Position.Line == line) {
+		// 10, 'h', ROWS*COLS, ...
+		v, err := p.parseExpr()
+		if err != nil {
+			return nil, err
 		}
+		arr = append(arr, constData(v))
 
-		if comma := consume(Comma); comma == nil {
+		if comma := p.consume(Comma); comma == nil {
 			break
 		}
 	}
 
 	return arr, nil
 }
-func parseConstants() ([]Constant, error) {
+func (p *parser) parseConstants() ([]Constant, error) {
 	var constants []Constant
-	for curt.Kind != Eof {
+	for p.curt.Kind != Eof {
 		// msg, arr, ...
-		id := consume(Identifier)
+		id := p.consume(Identifier)
 		if id == nil {
 			break
 		}
 
 		// auto, ...
 		switch {
-		case consumeIdent("auto") != nil:
+		case p.consumeIdent("auto") != nil:
 			// "hello", 10,10,10, 'h','i', ...
-			arr, err := parseArray()
+			arr, err := p.parseArray(id.Position.Line)
 			if err != nil {
 				return nil, err
 			}
@@ -476,8 +785,8 @@ func parseConstants() ([]Constant, error) {
 				Values: arr,
 				Ref:    "",
 			})
-		case consumeIdent("sizeof") != nil:
-			ref, err := expect(Identifier)
+		case p.consumeIdent("sizeof") != nil:
+			ref, err := p.parseName()
 			if err != nil {
 				return nil, err
 			}
@@ -486,30 +795,44 @@ func parseConstants() ([]Constant, error) {
 				Name:   string(id.Raw),
 				Mode:   SIZEOF,
 				Values: nil,
-				Ref:    string(ref.Raw),
+				Ref:    ref,
 			})
 		default:
-			return nil, fmt.Errorf("unsupported data mode: %s", curt.Kind.String())
+			return nil, fmt.Errorf("unsupported data mode: %s", p.curt.Kind.String())
 		}
 
 	}
 	return constants, nil
 }
 
-func parseEntryPoint() (string, error) {
+// parseEqu `.equ ROWS 3` `.equ CELLS ROWS*COLS` の名前と式
+func (p *parser) parseEqu() (Constant, error) {
+	id, err := p.expect(Identifier)
+	if err != nil {
+		return Constant{}, err
+	}
+	x, err := p.parseExpr()
+	if err != nil {
+		return Constant{}, fmt.Errorf(".equ %s: %w", string(id.Raw), err)
+	}
+	return Constant{Name: string(id.Raw), Mode: EQU, Expr: x}, nil
+}
+
+func (p *parser) parseEntryPoint() (string, error) {
 	// エントリーポイントなかった
-	if err := expectIdent("global"); err != nil {
+	if err := p.expectIdent("global"); err != nil {
 		return "", nil
 	}
-	id, err := expect(Identifier)
+	id, err := p.expect(Identifier)
 	if err != nil {
 		return "", err
 	}
 	return string(id.Raw), nil
 }
 
-func solveLabel(exports []string, nodes []Node) ([]Node, error) {
+func solveLabel(exports []string, nodes []Node) ([]Node, []LabelLocation, error) {
 	var preResult []Node
+	var locals []LabelLocation
 	labelLocations := map[string]int{}
 	// ラベル定義の位置だけ全て取得する
 	for _, nd := range nodes {
@@ -521,7 +844,12 @@ func solveLabel(exports []string, nodes []Node) ([]Node, error) {
 		}
 		// 定義かつexportされていなかったら
 		if label.Define && !in(label.Name, exports) {
+			// ローカルラベルはファイルの中で1つだけ
+			if _, ok := labelLocations[label.Name]; ok {
+				return nil, nil, fmt.Errorf("label exists: %s", label.Name)
+			}
 			labelLocations[label.Name] = len(preResult)
+			locals = append(locals, LabelLocation{label.Name, len(preResult)})
 			// 無操作と入れ替える
 			preResult = append(preResult, NOP)
 			continue
@@ -533,7 +861,12 @@ func solveLabel(exports []string, nodes []Node) ([]Node, error) {
 	}
 
 	var result []Node
+	// opPC 直前の命令の位置
+	opPC := 0
 	for pc, nd := range preResult {
+		if _, ok := nd.(Operation); ok {
+			opPC = pc
+		}
 		label, ok := nd.(Label)
 		// ラベルでなければそのまま
 		if !ok {
@@ -543,8 +876,8 @@ func solveLabel(exports []string, nodes []Node) ([]Node, error) {
 		// ラベル呼び出し かつ 場所が記録されている
 		dst, ok := labelLocations[label.Name]
 		if !label.Define && ok {
-			// pc-1なのはjmpなどのOPが基準になるから
-			result = append(result, Offset{PC, dst - (pc - 1)})
+			// jmpなどのOPが基準になる
+			result = append(result, Offset{PC, dst - opPC})
 			continue
 		} else {
 			result = append(result, nd)
@@ -552,17 +885,118 @@ func solveLabel(exports []string, nodes []Node) ([]Node, error) {
 		}
 	}
 
+	return result, locals, nil
+}
+
+// numericLabelName n個目の `1:` の名前
+func numericLabelName(num string, n int) string {
+	return fmt.Sprintf("__%s_%d", num, n)
+}
+
+// solveNumericLabels `1:` に名前をつけ、`1b` を直前の、`1f` を直後の `1:` の名前にする
+func solveNumericLabels(nodes []Node) ([]Node, error) {
+	// 数字 -> 定義の位置
+	defines := map[string][]int{}
+	for pos, nd := range nodes {
+		if label, ok := nd.(Label); ok && label.Define && isNumeric([]rune(label.Name)[0]) {
+			defines[label.Name] = append(defines[label.Name], pos)
+		}
+	}
+	result := make([]Node, len(nodes))
+	for pos, nd := range nodes {
+		label, ok := nd.(Label)
+		if !ok || !isNumeric([]rune(label.Name)[0]) {
+			result[pos] = nd
+			continue
+		}
+		if label.Define {
+			n := 0
+			for defines[label.Name][n] != pos {
+				n++
+			}
+			result[pos] = Label{true, numericLabelName(label.Name, n)}
+			continue
+		}
+		num, dir := label.Name[:len(label.Name)-1], label.Name[len(label.Name)-1]
+		found := -1
+		for n, def := range defines[num] {
+			if dir == 'b' && def < pos {
+				found = n
+			}
+			if dir == 'f' && pos < def {
+				found = n
+				break
+			}
+		}
+		if found < 0 {
+			return nil, fmt.Errorf("numeric label not found: %s", label.Name)
+		}
+		result[pos] = Label{false, numericLabelName(num, found)}
+	}
 	return result, nil
 }
 
-func solveSizeof(imports []string, constants []Constant, nodes []Node) ([]Constant, []Node, error) {
+// qualify `.module` のファイルでexportした名前を `module.name` にする
+func qualify(ir *IR) {
+	qualified := map[string]string{}
+	for i, name := range ir.Exports {
+		if name != ir.EntryPoint && !strings.HasPrefix(name, ir.Module+".") {
+			qualified[name] = ir.Module + "." + name
+			ir.Exports[i] = qualified[name]
+		}
+	}
+	rename := func(name string) string {
+		if q, ok := qualified[name]; ok {
+			return q
+		}
+		return name
+	}
+	for i, c := range ir.Constants {
+		ir.Constants[i] = renameConstant(c, rename)
+	}
+	for i, m := range ir.Macros {
+		if m.Exported && !strings.HasPrefix(m.Name, ir.Module+".") {
+			qualified[m.Name] = ir.Module + "." + m.Name
+			ir.Macros[i].Name = qualified[m.Name]
+		}
+	}
+	for i, m := range ir.Macros {
+		body := make([]Node, len(m.Body))
+		for j, nd := range m.Body {
+			body[j] = renameLabels(nd, rename)
+		}
+		ir.Macros[i].Body = body
+	}
+	for i, nd := range ir.Text {
+		switch nd := nd.(type) {
+		case Label:
+			if nd.Name != ir.EntryPoint {
+				ir.Text[i] = Label{nd.Define, rename(nd.Name)}
+			}
+		case MacroCall:
+			// リンク時に展開する呼び出し
+			args := make([]Node, len(nd.Args))
+			for j, arg := range nd.Args {
+				args[j] = renameLabels(arg, rename)
+			}
+			ir.Text[i] = MacroCall{rename(nd.Name), args}
+		default:
+			// importした名前の残った式
+			ir.Text[i] = renameLabels(nd, rename)
+		}
+	}
+}
+
+// solveConstants sizeof と .equ の名前、定数式を数値にする
+// importした名前を含むものは、その名前だけを残してリンク時に解く
+func solveConstants(imports []string, constants []Constant, nodes []Node) ([]Constant, []Node, error) {
 	// 定数名 -> Constant マップ
 	cmap := make(map[string]Constant)
 	for _, c := range constants {
 		cmap[c.Name] = c
 	}
 
-	// sizeof を再帰的に解く（循環検出）
+	// sizeof と .equ を再帰的に解く（循環検出）
 	visited := make(map[string]bool)
 	var sizeOf func(name string) (int, error)
 	sizeOf = func(name string) (int, error) {
@@ -585,52 +1019,162 @@ func solveSizeof(imports []string, constants []Constant, nodes []Node) ([]Consta
 			return 0, fmt.Errorf("unsupported data mode for sizeof: %s", name)
 		}
 	}
+	// 解決された SIZEOF 定数名のセット
+	resolvedSizeof := make(map[string]bool)
+	var fold func(nd Node) (Node, error)
+	// value 名前の値。importした名前ならnil
+	value := func(name string) (Node, error) {
+		if in(name, imports) {
+			return nil, nil
+		}
+		if visited[name] {
+			return nil, fmt.Errorf("equ cyclic ref: %s", name)
+		}
+		c, ok := cmap[name]
+		if !ok {
+			return nil, fmt.Errorf("constant not found: %s", name)
+		}
+		visited[name] = true
+		defer func() { visited[name] = false }()
+
+		switch c.Mode {
+		case SIZEOF:
+			sz, err := sizeOf(c.Ref)
+			resolvedSizeof[name] = err == nil
+			return Number(sz), err
+		case EQU:
+			v, err := fold(c.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			return v, nil
+		default:
+			// データのアドレスはリンクするまで決まらない
+			return nil, fmt.Errorf("not a constant: %s", name)
+		}
+	}
+	// fold 式を計算する。importした名前が残れば式のまま返す
+	fold = func(nd Node) (Node, error) {
+		switch nd := nd.(type) {
+		case Number:
+			return nd, nil
+		case Character:
+			return Number(nd), nil
+		case Label:
+			v, err := value(nd.Name)
+			if err != nil || v == nil {
+				return nd, err
+			}
+			return v, nil
+		case Expr:
+			l, r := Node(Number(0)), Node(nil)
+			var err error
+			if nd.Left != nil {
+				if l, err = fold(nd.Left); err != nil {
+					return nil, err
+				}
+			}
+			if r, err = fold(nd.Right); err != nil {
+				return nil, err
+			}
+			ln, lok := l.(Number)
+			rn, rok := r.(Number)
+			if !lok || !rok {
+				if nd.Left == nil {
+					l = nil
+				}
+				return Expr{nd.Op, l, r}, nil
+			}
+			v, err := calc(nd.Op, int(ln), int(rn))
+			return Number(v), err
+		default:
+			return nil, fmt.Errorf("not a constant: %s", nd.String())
+		}
+	}
 
 	// newConstant は元のコピー。解決済み SIZEOF 定数を後で除外する。
 	newConstant := make([]Constant, len(constants))
 	copy(newConstant, constants)
+	// .equ の式とデータの中の式を計算しておく
+	for i, c := range newConstant {
+		switch c.Mode {
+		case EQU:
+			v, err := value(c.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if v != nil {
+				newConstant[i].Expr = v
+			}
+		case AUTO:
+			var values []ConstantData
+			for j, d := range c.Values {
+				e, ok := d.(ConstExpr)
+				if !ok {
+					continue
+				}
+				v, err := fold(e.Expr)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %w", c.Name, err)
+				}
+				if values == nil {
+					values = append([]ConstantData{}, c.Values...)
+				}
+				values[j] = constData(v)
+			}
+			if values != nil {
+				newConstant[i].Values = values
+			}
+		}
+	}
 
-	// 解決された SIZEOF 定数名のセット
-	resolvedSizeof := make(map[string]bool)
+	// solveNode オペランド1つを解く
+	solveNode := func(nd Node) (Node, error) {
+		switch v := nd.(type) {
+		case Label:
+			// 定義ラベルは置換しない。参照ラベルで sizeof / .equ の定数があれば置換。
+			if c, ok := cmap[v.Name]; ok && !v.Define && c.Mode != AUTO {
+				x, err := value(v.Name)
+				if err != nil || x == nil {
+					return nd, err
+				}
+				return x, nil
+			}
+		case Expr:
+			return fold(v)
+		case ExprOffset:
+			diff, err := fold(v.Diff)
+			if err != nil {
+				return nil, err
+			}
+			if n, ok := diff.(Number); ok {
+				return Offset{v.Target, int(n)}, nil
+			}
+			return ExprOffset{v.Target, diff}, nil
+		}
+		return nd, nil
+	}
 
 	var result []Node
 	for _, n := range nodes {
 		switch v := n.(type) {
-		case Label:
-			// 定義ラベルは置換しない。参照ラベルで sizeof 定数があれば置換。
-			if !v.Define {
-				if c, ok := cmap[v.Name]; ok && c.Mode == SIZEOF && !in(v.Name, imports) {
-					sz, err := sizeOf(c.Ref)
-					if err != nil {
-						return nil, nil, err
-					}
-					result = append(result, Number(sz))
-					resolvedSizeof[v.Name] = true
-					continue
-				}
-			}
-			result = append(result, v)
 		case Instruction:
-			// 引数内の sizeof 参照を置換
+			// 引数内の sizeof 参照や式を置換
 			newArgs := make([]Node, 0, len(v.Args))
 			for _, a := range v.Args {
-				if lb, ok := a.(Label); ok && !lb.Define && !in(lb.Name, imports) {
-					if c, ok := cmap[lb.Name]; ok && c.Mode == SIZEOF {
-						sz, err := sizeOf(c.Ref)
-						if err != nil {
-							return nil, nil, err
-						}
-						newArgs = append(newArgs, Number(sz))
-						resolvedSizeof[lb.Name] = true
-						continue
-					}
+				a, err := solveNode(a)
+				if err != nil {
+					return nil, nil, err
 				}
 				newArgs = append(newArgs, a)
 			}
 			result = append(result, Instruction{Op: v.Op, Args: newArgs})
 		default:
-			// その他のノードはそのまま
-			result = append(result, n)
+			nd, err := solveNode(n)
+			if err != nil {
+				return nil, nil, err
+			}
+			result = append(result, nd)
 		}
 	}
 
@@ -647,7 +1191,17 @@ func solveSizeof(imports []string, constants []Constant, nodes []Node) ([]Consta
 	return filtered, result, nil
 }
 
+// Parse エラーには、読んでいた行をつける。最後まで読んでから見つかったエラーには行をつけない
 func Parse(token *Token) (*IR, error) {
+	p := &parser{curt: token, macros: map[string]Macro{}}
+	ir, err := p.parse()
+	if err != nil && p.curt.Kind != Eof {
+		return nil, &LineError{Line: p.curt.Position.Line + 1, Err: err}
+	}
+	return ir, err
+}
+
+func (p *parser) parse() (*IR, error) {
 	ir := IR{}
 	ir.Imports = make([]string, 0)
 	ir.Exports = make([]string, 0)
@@ -655,80 +1209,146 @@ func Parse(token *Token) (*IR, error) {
 	ir.EntryPoint = ""
 	ir.Text = make([]Node, 0)
 
-	curt = token
 loop:
 	for {
-		switch curt.Kind {
+		switch p.curt.Kind {
 		case Eof:
 			break loop
 		case Dot: // sections
-			_, _ = expect(Dot)
+			_, _ = p.expect(Dot)
 			switch {
-			case consumeIdent("import") != nil:
-				import_, err := parseImport()
+			case p.consumeIdent("import") != nil:
+				// .import "fmt.mir" はシンボルではなくファイルを名指しする
+				if file := p.consume(String); file != nil {
+					ir.Requires = append(ir.Requires, string(file.Raw))
+					continue
+				}
+				import_, err := p.parseImport()
 				if err != nil {
 					return nil, err
 				}
 				ir.Imports = append(ir.Imports, import_)
-			case consumeIdent("export") != nil:
-				export, err := parseExport()
+				p.imports = ir.Imports
+			case p.consumeIdent("macro") != nil:
+				m, err := p.parseMacro()
+				if err != nil {
+					return nil, err
+				}
+				ir.Macros = append(ir.Macros, m)
+				p.macros[m.Name] = m
+			case p.consumeIdent("module") != nil:
+				module, err := p.expect(Identifier)
+				if err != nil {
+					return nil, err
+				}
+				ir.Module = string(module.Raw)
+			case p.consumeIdent("stack") != nil:
+				size, err := p.parseSize("stack")
+				if err != nil {
+					return nil, err
+				}
+				ir.StackSize = size
+			case p.consumeIdent("heap") != nil:
+				size, err := p.parseSize("heap")
+				if err != nil {
+					return nil, err
+				}
+				ir.HeapSize = size
+			case p.consumeIdent("equ") != nil:
+				c, err := p.parseEqu()
+				if err != nil {
+					return nil, err
+				}
+				ir.Constants = append(ir.Constants, c)
+			case p.consumeIdent("export") != nil:
+				export, err := p.parseExport()
 				if err != nil {
 					return nil, err
 				}
 				ir.Exports = append(ir.Exports, export)
-			case consumeIdent("section") != nil:
-				_, err := expect(Dot)
+			case p.consumeIdent("section") != nil:
+				_, err := p.expect(Dot)
 				if err != nil {
 					return nil, err
 				}
 				switch {
-				case consumeIdent("data") != nil:
-					_, err := expect(Colon)
+				case p.consumeIdent("data") != nil:
+					_, err := p.expect(Colon)
 					if err != nil {
 						return nil, err
 					}
-					constants, err := parseConstants()
+					constants, err := p.parseConstants()
 					if err != nil {
 						return nil, err
 					}
-					ir.Constants = constants
-				case consumeIdent("text") != nil:
-					_, err := expect(Colon)
+					ir.Constants = append(ir.Constants, constants...)
+				case p.consumeIdent("text") != nil:
+					_, err := p.expect(Colon)
 					if err != nil {
 						return nil, err
 					}
-					entrypoint, err := parseEntryPoint()
+					entrypoint, err := p.parseEntryPoint()
 					if err != nil {
 						return nil, err
 					}
 					ir.EntryPoint = entrypoint
 				default:
-					return nil, fmt.Errorf("unsupported directive: %s", curt.Kind.String())
+					return nil, fmt.Errorf("unsupported directive: %s", p.curt.Kind.String())
 				}
 			default:
-				return nil, fmt.Errorf("unsupported directive: %s", curt.Kind.String())
+				return nil, fmt.Errorf("unsupported directive: %s", p.curt.Kind.String())
 			}
 		default:
-			program, err := parseText()
-			program = expand(program)
+			program, err := p.parseText()
 			if err != nil {
 				return nil, err
 			}
-			exports := ir.Exports
-			if ir.EntryPoint != "" {
-				exports = append(exports, ir.EntryPoint)
+			if p.curt.Kind != Eof {
+				return nil, fmt.Errorf("parse: unsupported token: %s", p.curt.Kind.String())
+			}
+			program = expand(program)
+			// importしたマクロを使っていれば、展開とラベルの解決はリンク時まで待つ
+			if imported := importedMacros(program, p.macros); len(imported) != 0 {
+				ir.Text = program
+				ir.Imports = slices.DeleteFunc(ir.Imports, func(name string) bool { return in(name, imported) })
+				break
 			}
-			program, err = solveLabel(exports, program)
+			program, err = expandMacros(program, p.macros, &p.expansions)
 			if err != nil {
 				return nil, err
 			}
-			newConstants, program, err := solveSizeof(ir.Imports, ir.Constants, program)
-			if err != nil {
+			if err := solveText(&ir, program); err != nil {
 				return nil, err
 			}
-			ir.Constants = newConstants
-			ir.Text = program
 		}
 	}
+	exportMacros(&ir)
+	if ir.Module != "" {
+		qualify(&ir)
+	}
 	return &ir, nil
 }
+
+// solveText 数字のラベル、ローカルラベル、sizeof と定数式を解決してTextにする。マクロは展開済みであること
+func solveText(ir *IR, program []Node) error {
+	program, err := solveNumericLabels(program)
+	if err != nil {
+		return err
+	}
+	exports := ir.Exports
+	if ir.EntryPoint != "" {
+		exports = append(exports[:len(exports):len(exports)], ir.EntryPoint)
+	}
+	program, locals, err := solveLabel(exports, program)
+	if err != nil {
+		return err
+	}
+	ir.Locals = locals
+	newConstants, program, err := solveConstants(ir.Imports, ir.Constants, program)
+	if err != nil {
+		return err
+	}
+	ir.Constants = newConstants
+	ir.Text = program
+	return nil
+}
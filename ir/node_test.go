@@ -59,7 +59,7 @@ _start:
 		t.Fatalf("exports does not contain _print_fizz: %v", irObj.Exports)
 	}
 
-	// constants の msg が AUTO かつ 値が "hello" であること
+	// constants の msg が AUTO かつ 値が "hello" と終端の '\0' であること
 	if len(irObj.Constants) < 1 {
 		t.Fatalf("constants want=1, got=0")
 	}
@@ -67,7 +67,7 @@ _start:
 	if cst.Mode != AUTO {
 		t.Fatalf("msg mode want=AUTO got=%v", cst.Mode)
 	}
-	exp := "hello"
+	exp := "hello\x00"
 	if len(cst.Values) != len(exp) {
 		t.Fatalf("msg values length want=%d got=%d", len(exp), len(cst.Values))
 	}
@@ -169,6 +169,7 @@ _lib_ret:
 
 					NOP,
 				}),
+				Locals: []LabelLocation{{"_mul_loop", 25}, {"_mul_done", 39}, {"_lib_ret", 42}},
 			},
 		},
 		{
@@ -230,6 +231,7 @@ _after_mul:
 					Instruction{Op: MOV, Args: []Node{R0, Number(0)}},
 					Instruction{Op: SYSCALL, Args: []Node{}},
 				}),
+				Locals: []LabelLocation{{"_after_add", 9}, {"_after_sub", 21}, {"_after_mul", 30}},
 			},
 		},
 	}
@@ -250,3 +252,129 @@ _after_mul:
 		})
 	}
 }
+
+func TestParse_RegisterRelativeOperands(t *testing.T) {
+	input := `
+.section .text:
+    global _start
+_start:
+    load r3 [r1+4]
+    store [r1+r2*2] r3
+    mov [r1-1] 0
+`
+	toks, err := Tokenize([]rune(input), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	irObj, err := Parse(toks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Node{
+		Label{Define: true, Name: "_start"},
+		LOAD, R3, Offset{R1, 4},
+		STORE, IndexedOffset{R1, R2, 2}, R3,
+		MOV, Offset{R1, -1}, Number(0),
+	}
+	if diff := cmp.Diff(expect, irObj.Text); diff != "" {
+		t.Errorf("diff: %s", diff)
+	}
+}
+
+func TestParse_NumericLabels(t *testing.T) {
+	input := `
+.section .text:
+    global _start
+_start:
+1:
+    sub r1 1
+    jz 1f
+    jmp 1b
+1:
+    jmp 1b
+`
+	toks, err := Tokenize([]rune(input), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	irObj, err := Parse(toks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		Label{Define: true, Name: "_start"},
+		NOP, // 1:
+		SUB, R1, Number(1),
+		JZ, Offset{PC, 4}, // 1f
+		JMP, Offset{PC, -6}, // 1b
+		NOP,                 // 1:
+		JMP, Offset{PC, -1}, // 1b
+	}
+	if diff := cmp.Diff(want, irObj.Text); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// 後ろに `1:` がなければエラー
+	toks, err = Tokenize([]rune(".section .text:\n_f:\n    jmp 1f\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(toks); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestParse_DuplicateLocalLabel(t *testing.T) {
+	input := `
+.section .text:
+_f:
+__loop:
+    jmp __loop
+_g:
+__loop:
+    jmp __loop
+`
+	toks, err := Tokenize([]rune(input), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(toks); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestParse_Module(t *testing.T) {
+	input := `
+.module fmt
+.export println
+.import str.len
+.section .text:
+println:
+    call str.len
+    call println
+    ret
+`
+	toks, err := Tokenize([]rune(input), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	irObj, err := Parse(toks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"fmt.println"}, irObj.Exports); diff != "" {
+		t.Errorf("exports diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"str.len"}, irObj.Imports); diff != "" {
+		t.Errorf("imports diff (-want +got):\n%s", diff)
+	}
+	want := []Node{
+		Label{Define: true, Name: "fmt.println"},
+		CALL, Label{Define: false, Name: "str.len"},
+		CALL, Label{Define: false, Name: "fmt.println"},
+		RET,
+	}
+	if diff := cmp.Diff(want, irObj.Text); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,421 @@
+package ir
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// objectMagic .mobj の1行目
+const objectMagic = "!<minivm-obj>"
+
+// ObjectSymbol オブジェクトが定義する、または必要とするシンボル
+type ObjectSymbol struct {
+	Kind SymbolKind
+	Name string
+	// Pos Functionのとき、Textでの位置
+	Pos      int
+	Exported bool
+}
+
+// Relocation Text[Pos] にシンボル Name の位置を入れる。リンク時にPC相対かデータのアドレスになる
+type Relocation struct {
+	Pos  int
+	Name string
+}
+
+// Object .mobj 再配置可能なオブジェクト
+// ファイルの中で閉じたラベルは解決済みで、Textにはラベルが残っていない
+type Object struct {
+	Name        string
+	Symbols     []ObjectSymbol
+	Relocations []Relocation
+	// IR ラベルの定義をNOPに、参照を0に置き換えたもの
+	IR *IR
+}
+
+// Compile パース済みのirからオブジェクトを作る
+func Compile(name string, ir *IR) *Object {
+	obj := &Object{Name: name}
+	for _, imp := range ir.Imports {
+		obj.Symbols = append(obj.Symbols, ObjectSymbol{Kind: Unknown, Name: imp})
+	}
+	for _, c := range ir.Constants {
+		obj.Symbols = append(obj.Symbols, ObjectSymbol{Kind: Data, Name: c.Name, Exported: in(c.Name, ir.Exports)})
+	}
+	text := make([]Node, 0, len(ir.Text))
+	for pos, nd := range ir.Text {
+		label, ok := nd.(Label)
+		if !ok {
+			text = append(text, nd)
+			continue
+		}
+		if label.Define {
+			obj.Symbols = append(obj.Symbols, ObjectSymbol{
+				Kind:     Function,
+				Name:     label.Name,
+				Pos:      pos,
+				Exported: in(label.Name, ir.Exports),
+			})
+			text = append(text, NOP)
+			continue
+		}
+		obj.Relocations = append(obj.Relocations, Relocation{pos, label.Name})
+		text = append(text, Number(0))
+	}
+	obj.IR = &IR{
+		Module:     ir.Module,
+		Imports:    ir.Imports,
+		Exports:    ir.Exports,
+		Constants:  ir.Constants,
+		EntryPoint: ir.EntryPoint,
+		Text:       text,
+		Locals:     ir.Locals,
+		StackSize:  ir.StackSize,
+		HeapSize:   ir.HeapSize,
+		Macros:     ir.Macros,
+	}
+	return obj
+}
+
+// CompileSources srcsを並行にパースしてオブジェクトにする
+func CompileSources(srcs []Source) ([]*Object, error) {
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		return nil, err
+	}
+	if irs, err = ExpandMacros(irs, nil); err != nil {
+		return nil, err
+	}
+	var objs []*Object
+	for i, src := range srcs {
+		objs = append(objs, Compile(src.Name, irs[i]))
+	}
+	return objs, nil
+}
+
+// Relocate Textをbaseの位置に置いた命令列を返す。再配置表の位置にだけ、関数ならそこへのPC相対の位置を、
+// それ以外なら values の値(データのアドレスや定数)を書き込む。funcs は置いた後の関数の位置
+func (o *Object) Relocate(base int, funcs, values map[string]int) ([]Node, error) {
+	text := make([]Node, len(o.IR.Text))
+	copy(text, o.IR.Text)
+	// opPos オペランドの位置 -> その命令の位置。PC相対の位置は命令が基準になる
+	opPos := map[int]int{}
+	for _, u := range splitText(text) {
+		for i := u.pos + 1; i < u.pos+u.size; i++ {
+			opPos[i] = u.pos
+		}
+	}
+	for _, r := range o.Relocations {
+		op, ok := opPos[r.Pos]
+		if !ok || text[r.Pos] != Number(0) {
+			return nil, fmt.Errorf("%s: broken relocation: %s at %d", o.Name, r.Name, r.Pos)
+		}
+		if dst, ok := funcs[r.Name]; ok {
+			text[r.Pos] = Offset{PC, dst - (base + op)}
+			continue
+		}
+		v, ok := values[r.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: undefined: %s", o.Name, r.Name)
+		}
+		text[r.Pos] = Number(v)
+	}
+	return text, nil
+}
+
+// Labeled シンボル表と再配置表をラベルに戻したIR。nm やアーカイブから取り出すメンバーを決めるのに使う
+func (o *Object) Labeled() (*IR, error) {
+	text := make([]Node, len(o.IR.Text))
+	copy(text, o.IR.Text)
+	for _, sym := range o.Symbols {
+		if sym.Kind != Function {
+			continue
+		}
+		if sym.Pos < 0 || len(text) <= sym.Pos || text[sym.Pos] != NOP {
+			return nil, fmt.Errorf("%s: broken symbol: %s at %d", o.Name, sym.Name, sym.Pos)
+		}
+		text[sym.Pos] = Label{Define: true, Name: sym.Name}
+	}
+	for _, r := range o.Relocations {
+		if r.Pos < 0 || len(text) <= r.Pos || text[r.Pos] != Number(0) {
+			return nil, fmt.Errorf("%s: broken relocation: %s at %d", o.Name, r.Name, r.Pos)
+		}
+		text[r.Pos] = Label{Define: false, Name: r.Name}
+	}
+	ir := *o.IR
+	ir.Source = o.Name
+	ir.Text = text
+	return &ir, nil
+}
+
+// linkObjects irsをコンパイルし、config.Objects と並べて再配置表でつなぐ
+// オブジェクトの中で解決済みの命令はそのまま置く。たどれない関数や使われないデータは取り除かない
+func linkObjects(irs []*IR, config *LinkConfig) (*Program, error) {
+	irs, err := ExpandMacros(irs, config.Archives)
+	if err != nil {
+		return nil, err
+	}
+	var objs []*Object
+	for _, ir := range irs {
+		objs = append(objs, Compile(ir.Source, ir))
+	}
+	objs = append(objs, config.Objects...)
+
+	// アーカイブから足りないメンバーを取り出す
+	views := make([]*IR, 0, len(objs))
+	for _, obj := range objs {
+		view, err := obj.Labeled()
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	pulled, err := pullMembers(views, config.Archives)
+	if err != nil {
+		return nil, err
+	}
+	if pulled, err = ExpandMacros(pulled, config.Archives); err != nil {
+		return nil, err
+	}
+	for _, ir := range pulled {
+		objs = append(objs, Compile(ir.Source, ir))
+	}
+
+	var entryPoint string
+	entryCount := 0
+	for _, obj := range objs {
+		if obj.IR.EntryPoint != "" {
+			entryCount++
+			entryPoint = obj.IR.EntryPoint
+		}
+	}
+	if entryCount > 1 {
+		return nil, fmt.Errorf("too many entryPoint: %d", entryCount)
+	}
+	if config.Entry != "" {
+		entryPoint = config.Entry
+	}
+	if entryPoint == "" {
+		entryPoint = "_start"
+	}
+	if config.Startup != nil {
+		if err := checkStartup(config.Startup, append(views, pulled...)); err != nil {
+			return nil, err
+		}
+		stub := bindStartup(config.Startup, entryPoint)
+		objs = append([]*Object{Compile(stub.Source, stub)}, objs...)
+		entryPoint = stub.EntryPoint
+	}
+
+	// 並べる。先頭には _pre へのジャンプを置く
+	scoped := make([]*IR, 0, len(objs))
+	for _, obj := range objs {
+		ir := *obj.IR
+		ir.Source = obj.Name
+		scoped = append(scoped, &ir)
+	}
+	scoped = scopePrivate(scoped, false)
+	text := []Node{JMP, Offset{PC, 0}}
+	bases := make([]int, len(objs))
+	funcs := map[string]int{}
+	var labels []LabelLocation
+	var origins []string
+	var constants []Constant
+	for i, obj := range objs {
+		bases[i] = len(text)
+		for _, sym := range obj.Symbols {
+			if sym.Kind != Function {
+				continue
+			}
+			if _, ok := funcs[sym.Name]; ok {
+				return nil, fmt.Errorf("label exists: %s", sym.Name)
+			}
+			funcs[sym.Name] = bases[i] + sym.Pos
+			labels = append(labels, LabelLocation{sym.Name, bases[i] + sym.Pos - 2})
+		}
+		for _, l := range scoped[i].Locals {
+			labels = append(labels, LabelLocation{l.Name, bases[i] + l.Pos - 2})
+		}
+		text = append(text, scoped[i].Text...)
+		for range scoped[i].Text {
+			origins = append(origins, obj.Name)
+		}
+		constants = append(constants, scoped[i].Constants...)
+	}
+	if _, ok := funcs[entryPoint]; !ok {
+		return nil, fmt.Errorf("entry point not found: %s", entryPoint)
+	}
+
+	// 再配置する名前を、付け替えたデータの名前にする
+	relocs := make([][]Relocation, len(objs))
+	var probes []Node
+	for i, obj := range objs {
+		rename := map[string]string{}
+		for j, c := range obj.IR.Constants {
+			rename[c.Name] = scoped[i].Constants[j].Name
+		}
+		for _, r := range obj.Relocations {
+			if newName, ok := rename[r.Name]; ok {
+				r.Name = newName
+			}
+			relocs[i] = append(relocs[i], r)
+			if _, ok := funcs[r.Name]; !ok {
+				probes = append(probes, Label{false, r.Name})
+			}
+		}
+	}
+	// sizeof と定数式を解決する。再配置する名前の値は、後ろに足したラベルを解決して得る
+	constants, nds, err := solveConstants([]string{}, constants, append(text, probes...))
+	if err != nil {
+		return nil, err
+	}
+	text = nds[:len(text)]
+	values := dataAddresses(constants)
+	for i, probe := range probes {
+		switch nd := nds[len(text)+i].(type) {
+		case Number:
+			values[probe.(Label).Name] = int(nd)
+		case Label:
+			// データのアドレスはラベルのまま残る
+		default:
+			return nil, fmt.Errorf("unsupported relocation value: %s", nd.String())
+		}
+	}
+
+	for i, obj := range objs {
+		end := len(text)
+		if i+1 < len(objs) {
+			end = bases[i+1]
+		}
+		placed := &Object{Name: obj.Name, Relocations: relocs[i], IR: &IR{Text: text[bases[i]:end]}}
+		relocated, err := placed.Relocate(bases[i], funcs, values)
+		if err != nil {
+			return nil, err
+		}
+		copy(text[bases[i]:end], relocated)
+	}
+
+	// _pre でデータを用意してからエントリーポイントへ飛ぶ
+	preScript, err := solveData(&IR{Constants: constants}, config.ByteMemory)
+	if err != nil {
+		return nil, err
+	}
+	pre := len(text)
+	labels = append(labels, LabelLocation{"_pre", pre - 2})
+	text[1] = Offset{PC, pre}
+	text = append(text, NOP)
+	text = append(text, preScript...)
+	text = append(text, JMP, Offset{PC, funcs[entryPoint] - len(text)})
+
+	info := debugInfo(text, labels, 2, constants, scoped, origins, entryPoint)
+	p := &Program{Nodes: text, Info: info, Resources: resources(scoped, constants)}
+	if !config.Optimize {
+		return p, nil
+	}
+	optimized, pcMap, err := optimize(text)
+	if err != nil {
+		return nil, err
+	}
+	remapDebugInfo(info, pcMap)
+	p.Nodes = optimized
+	return p, nil
+}
+
+func (k SymbolKind) String() string {
+	switch k {
+	case Data:
+		return "data"
+	case Function:
+		return "func"
+	case Unknown:
+		return "import"
+	default:
+		return "undefined"
+	}
+}
+
+// WriteObject オブジェクトを書き出す
+//
+//	!<minivm-obj>
+//	.symbol func _start 0 export
+//	.reloc 5 _print
+//	.import _print
+//	...
+//	.end
+func WriteObject(w io.Writer, o *Object) error {
+	lines := []string{objectMagic}
+	for _, sym := range o.Symbols {
+		line := fmt.Sprintf(".symbol %s %s %d", sym.Kind.String(), sym.Name, sym.Pos)
+		if sym.Exported {
+			line += " export"
+		}
+		lines = append(lines, line)
+	}
+	for _, r := range o.Relocations {
+		lines = append(lines, fmt.Sprintf(".reloc %d %s", r.Pos, r.Name))
+	}
+	lines = append(lines, encodeIR(o.IR)...)
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// ReadObject WriteObjectで書いたオブジェクトを読む
+func ReadObject(name string, r io.Reader) (*Object, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || lines[0] != objectMagic {
+		return nil, fmt.Errorf("object: not a minivm object")
+	}
+	o := &Object{Name: name}
+	i := 1
+	for ; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == ".symbol" && (len(fields) == 4 || len(fields) == 5) {
+			sym := ObjectSymbol{Name: fields[2], Exported: len(fields) == 5 && fields[4] == "export"}
+			switch fields[1] {
+			case "data":
+				sym.Kind = Data
+			case "func":
+				sym.Kind = Function
+			case "import":
+				sym.Kind = Unknown
+			default:
+				return nil, fmt.Errorf("object: unsupported symbol kind: %s", lines[i])
+			}
+			pos, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("object: %s: %w", lines[i], err)
+			}
+			sym.Pos = pos
+			o.Symbols = append(o.Symbols, sym)
+			continue
+		}
+		if fields[0] == ".reloc" && len(fields) == 3 {
+			pos, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("object: %s: %w", lines[i], err)
+			}
+			o.Relocations = append(o.Relocations, Relocation{pos, fields[2]})
+			continue
+		}
+		break
+	}
+	ir, _, err := decodeIR(lines[i:])
+	if err != nil {
+		return nil, fmt.Errorf("object: %w", err)
+	}
+	o.IR = ir
+	return o, nil
+}
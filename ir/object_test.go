@@ -0,0 +1,192 @@
+package ir
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestObject_WriteReadAndRelocate(t *testing.T) {
+	srcs := readExampleSources(t, "calc/main.mir", "calc/lib.mir", "calc/fmt.mir")
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// オブジェクトはたどれない関数を取り除かない
+	want, err := LinkWithConfig(irs, &LinkConfig{KeepUnused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err := CompileSources(srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read []*Object
+	for i, obj := range objs {
+		// オブジェクトのTextにはラベルが残らない
+		for _, nd := range obj.IR.Text {
+			if _, ok := nd.(Label); ok {
+				t.Fatalf("%s: label remains: %v", obj.Name, nd)
+			}
+		}
+		var buf bytes.Buffer
+		if err := WriteObject(&buf, obj); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadObject(obj.Name, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(obj, got); diff != "" {
+			t.Fatalf("%s: diff (-want +got):\n%s", obj.Name, diff)
+		}
+		ir, err := got.Labeled()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(irs[i].Text, ir.Text); diff != "" {
+			t.Fatalf("%s: labeled text diff (-want +got):\n%s", obj.Name, diff)
+		}
+		read = append(read, got)
+	}
+
+	got, err := LinkWithConfig(nil, &LinkConfig{Objects: read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestObject_Symbols(t *testing.T) {
+	code := `
+.import _print
+.export _main
+.section .data:
+    msg auto "hi"
+.section .text:
+_main:
+    mov r1 msg
+    call _print
+__loop:
+    jmp __loop
+`
+	irs := parseSources(t, code)
+	obj := Compile("main.mir", irs[0])
+	wantSymbols := []ObjectSymbol{
+		{Kind: Unknown, Name: "_print"},
+		{Kind: Data, Name: "msg"},
+		{Kind: Function, Name: "_main", Pos: 0, Exported: true},
+	}
+	if diff := cmp.Diff(wantSymbols, obj.Symbols); diff != "" {
+		t.Errorf("symbols diff (-want +got):\n%s", diff)
+	}
+	wantRelocations := []Relocation{
+		{Pos: 3, Name: "msg"},
+		{Pos: 5, Name: "_print"},
+	}
+	if diff := cmp.Diff(wantRelocations, obj.Relocations); diff != "" {
+		t.Errorf("relocations diff (-want +got):\n%s", diff)
+	}
+
+	// 再配置表が壊れていればエラー
+	obj.Relocations = append(obj.Relocations, Relocation{Pos: 1, Name: "_print"})
+	if _, err := obj.Relocate(0, map[string]int{"_print": 0}, map[string]int{"msg": 0}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if _, err := obj.Labeled(); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestObject_RelocateMoves(t *testing.T) {
+	irs := parseSources(t, `
+.import _print
+.section .data:
+    pad auto 0, 0
+    msg auto "hi"
+.section .text:
+_main:
+    mov r1 msg
+    call _print
+`)
+	obj := Compile("main.mir", irs[0])
+	values := map[string]int{"pad": 0, "msg": 2}
+	tests := []struct {
+		name string
+		base int
+		want []Node
+	}{
+		// _main は NOP の1つ分で、mov は base+1、call は base+4 にある
+		{"head", 2, []Node{NOP, MOV, R1, Number(2), CALL, Offset{PC, 14}}},
+		{"moved", 10, []Node{NOP, MOV, R1, Number(2), CALL, Offset{PC, 6}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := obj.Relocate(tt.base, map[string]int{"_print": 20}, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+	// 元のTextは書き換えない
+	if obj.IR.Text[5] != Number(0) {
+		t.Errorf("text rewritten: %v", obj.IR.Text[5])
+	}
+}
+
+func TestLink_Objects(t *testing.T) {
+	lib := parseSources(t, `
+.export _f
+.section .text:
+_f:
+    mov r0 7
+    ret
+`)
+	main := parseSources(t, `
+.import _f
+.section .text:
+    global _start
+_start:
+    call _f
+    mov r1 r0
+    mov r0 0
+    syscall
+`)
+	tests := []struct {
+		name    string
+		irs     []*IR
+		objects []*Object
+		want    []*IR
+	}{
+		{"ir and object", main, []*Object{Compile("lib.mir", lib[0])}, []*IR{main[0], lib[0]}},
+		// main.mir が lib.mir の後ろに置かれ、call の位置が動く
+		{"objects", nil, []*Object{Compile("lib.mir", lib[0]), Compile("main.mir", main[0])}, []*IR{lib[0], main[0]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := LinkWithConfig(tt.want, &LinkConfig{KeepUnused: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := LinkWithConfig(tt.irs, &LinkConfig{Objects: tt.objects})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// 足りない関数はエラー
+	if _, err := LinkWithConfig(main, &LinkConfig{Objects: []*Object{Compile("main.mir", main[0])}}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,415 @@
+package ir
+
+import (
+	"fmt"
+
+	"github.com/x0y14/minivm/vm"
+)
+
+// inst 最適化中の1命令
+type inst struct {
+	op   Operation
+	args []Node
+	// targets args[i] が (+n) ならその飛び先の命令の番号、そうでなければ -1
+	targets []int
+}
+
+// Optimize リンク後のノード列にのぞき穴最適化をかける
+// 実行結果は変えずに、ラベルのNOP・飛び先がジャンプのジャンプ・不要なmov・重複した比較を取り除き、定数の計算を畳み込む
+func Optimize(nodes []Node) ([]Node, error) {
+	optimized, _, err := optimize(nodes)
+	return optimized, err
+}
+
+// optimize 最適化後のノード列と、元のPC -> 新しいPC の対応を返す
+// 元のPCが消えた命令なら、そこから実行したときに最初に実行される命令のPCになる
+func optimize(nodes []Node) ([]Node, map[int]int, error) {
+	nodes = expand(nodes)
+	insts, pcs, err := decode(nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	// pcを値として読み書きする命令があると位置を変えられない
+	for _, in := range insts {
+		for _, arg := range in.args {
+			if arg == PC {
+				return nodes, identityPcs(pcs), nil
+			}
+		}
+	}
+
+	// origin 元の命令番号 -> 今の命令番号
+	origin := make([]int, len(insts))
+	for i := range origin {
+		origin[i] = i
+	}
+	for {
+		deleted, changed := peephole(insts)
+		if !changed {
+			break
+		}
+		var remap []int
+		insts, remap = compact(insts, deleted)
+		for i, cur := range origin {
+			origin[i] = remap[cur]
+		}
+	}
+
+	optimized, newPcs := encode(insts)
+	pcMap := make(map[int]int, len(pcs))
+	for i, pc := range pcs {
+		pcMap[pc] = newPcs[origin[i]]
+	}
+	// 末尾(どの命令でもない位置)
+	pcMap[len(nodes)] = len(optimized)
+	return optimized, pcMap, nil
+}
+
+// decode ノード列を命令に分け、PC相対のオペランドを命令の番号にする
+func decode(nodes []Node) ([]inst, []int, error) {
+	var insts []inst
+	var pcs []int
+	index := map[int]int{}
+	for pc := 0; pc < len(nodes); {
+		op, ok := nodes[pc].(Operation)
+		if !ok {
+			return nil, nil, fmt.Errorf("optimize: pc %d: unexpected node: %s", pc, nodes[pc].String())
+		}
+		if len(nodes) <= pc+op.NumOperands() {
+			return nil, nil, fmt.Errorf("optimize: pc %d: %s: missing operands", pc, op.String())
+		}
+		index[pc] = len(insts)
+		pcs = append(pcs, pc)
+		args := append([]Node{}, nodes[pc+1:pc+1+op.NumOperands()]...)
+		insts = append(insts, inst{op: op, args: args})
+		pc += op.NumOperands() + 1
+	}
+	for i := range insts {
+		insts[i].targets = make([]int, len(insts[i].args))
+		for j, arg := range insts[i].args {
+			insts[i].targets[j] = -1
+			off, ok := arg.(Offset)
+			if !ok || off.Target != PC {
+				continue
+			}
+			target, ok := index[pcs[i]+off.Diff]
+			if !ok {
+				return nil, nil, fmt.Errorf("optimize: pc %d: %s: invalid target: %d", pcs[i], insts[i].op.String(), pcs[i]+off.Diff)
+			}
+			insts[i].targets[j] = target
+		}
+	}
+	return insts, pcs, nil
+}
+
+// encode 命令をノード列に戻し、PC相対のオペランドを計算し直す
+func encode(insts []inst) ([]Node, []int) {
+	pcs := make([]int, len(insts)+1)
+	pc := 0
+	for i, in := range insts {
+		pcs[i] = pc
+		pc += len(in.args) + 1
+	}
+	pcs[len(insts)] = pc
+
+	var nodes []Node
+	for i, in := range insts {
+		nodes = append(nodes, in.op)
+		for j, arg := range in.args {
+			if t := in.targets[j]; t != -1 {
+				arg = Offset{PC, pcs[t] - pcs[i]}
+			}
+			nodes = append(nodes, arg)
+		}
+	}
+	return nodes, pcs
+}
+
+func identityPcs(pcs []int) map[int]int {
+	m := make(map[int]int, len(pcs))
+	for _, pc := range pcs {
+		m[pc] = pc
+	}
+	return m
+}
+
+// compact deletedの命令を取り除く。消えた命令への参照は次に残っている命令へ付け替える
+// 返り値の remap は 古い命令番号 -> 新しい命令番号
+func compact(insts []inst, deleted []bool) ([]inst, []int) {
+	remap := make([]int, len(insts)+1)
+	n := 0
+	for i := range insts {
+		remap[i] = n
+		if !deleted[i] {
+			n++
+		}
+	}
+	remap[len(insts)] = n
+
+	var result []inst
+	for i, in := range insts {
+		if deleted[i] {
+			continue
+		}
+		targets := make([]int, len(in.targets))
+		for j, t := range in.targets {
+			if t == -1 {
+				targets[j] = -1
+				continue
+			}
+			targets[j] = remap[t]
+		}
+		result = append(result, inst{op: in.op, args: in.args, targets: targets})
+	}
+	return result, remap
+}
+
+// peephole 1回分の書き換え。消す命令に印をつけ、置き換える命令はその場で書き換える
+func peephole(insts []inst) ([]bool, bool) {
+	deleted := make([]bool, len(insts))
+	changed := false
+
+	// ジャンプの飛び先になっている命令
+	isTarget := make([]bool, len(insts)+1)
+	for _, in := range insts {
+		for _, t := range in.targets {
+			if t != -1 {
+				isTarget[t] = true
+			}
+		}
+	}
+
+	for i := range insts {
+		in := &insts[i]
+		// ラベルだったNOP
+		if in.op == NOP && i+1 < len(insts) {
+			deleted[i] = true
+			changed = true
+			continue
+		}
+		// ジャンプ先がjmpなら、その先へ直接飛ぶ
+		for j, t := range in.targets {
+			if t == -1 {
+				continue
+			}
+			if final := threadJump(insts, t); final != t {
+				in.targets[j] = final
+				changed = true
+			}
+		}
+		// 次の命令へのジャンプ
+		if (in.op == JMP || in.op == JZ || in.op == JNZ) && in.targets[0] == i+1 {
+			deleted[i] = true
+			changed = true
+			continue
+		}
+		// mov x x
+		if in.op == MOV && in.args[0] == in.args[1] {
+			if r, ok := in.args[0].(Register); ok && r.isGeneral() {
+				deleted[i] = true
+				changed = true
+				continue
+			}
+		}
+	}
+
+	// 2命令の組。2つ目がジャンプの飛び先なら別の経路から来るので触らない
+	for i := 0; i+1 < len(insts); i++ {
+		if deleted[i] || deleted[i+1] || isTarget[i+1] {
+			continue
+		}
+		a, b := &insts[i], &insts[i+1]
+		switch {
+		case isDeadMove(a, b):
+			// mov r1 x; mov r1 y -> mov r1 y
+			deleted[i] = true
+			changed = true
+		case a.op == MOV && b.op == MOV && a.args[0] == b.args[1] && a.args[1] == b.args[0] && isGeneralRegister(a.args[0]) && isGeneralRegister(a.args[1]):
+			// mov r1 r2; mov r2 r1 -> mov r1 r2
+			deleted[i+1] = true
+			changed = true
+		case foldConstant(insts, i):
+			deleted[i+1] = true
+			changed = true
+		case i+3 < len(insts) && isRedundantCompare(insts, i, isTarget):
+			deleted[i+2] = true
+			if insts[i+1].op == insts[i+3].op {
+				// 1つ目で飛ばなかったなら2つ目も飛ばない
+				deleted[i+3] = true
+			} else {
+				// 1つ目で飛ばなかったなら2つ目は必ず飛ぶ
+				insts[i+3].op = JMP
+			}
+			changed = true
+		}
+		if deleted[i] || deleted[i+1] {
+			// 書き換えた命令を同じ回で続けて使わない
+			i++
+		}
+	}
+	return deleted, changed
+}
+
+// threadJump tから始まるjmpの連鎖をたどった最後の飛び先
+func threadJump(insts []inst, t int) int {
+	start := t
+	visited := map[int]bool{}
+	for insts[t].op == JMP {
+		// jmpだけのループはそのままにする
+		if visited[t] {
+			return start
+		}
+		visited[t] = true
+		t = insts[t].targets[0]
+	}
+	return t
+}
+
+func isGeneralRegister(n Node) bool {
+	r, ok := n.(Register)
+	return ok && r.isGeneral()
+}
+
+// isConstantOrRegister 読んでもフォルトしないオペランド
+func isConstantOrRegister(n Node) bool {
+	switch n := n.(type) {
+	case Register:
+		return n != ZF
+	case Number, Character:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDeadMove aで書いたレジスタを読まずにbが上書きする
+func isDeadMove(a, b *inst) bool {
+	if a.op != MOV || b.op != MOV || a.args[0] != b.args[0] || !isGeneralRegister(a.args[0]) {
+		return false
+	}
+	return isConstantOrRegister(a.args[1]) && !reads(b.args[1], a.args[0].(Register))
+}
+
+// reads オペランドnを評価するときにレジスタrを読むか
+func reads(n Node, r Register) bool {
+	switch n := n.(type) {
+	case Register:
+		return n == r
+	case Offset:
+		return n.Target == r
+	case IndexedOffset:
+		return n.Base == r || n.Index == r
+	default:
+		return false
+	}
+}
+
+// foldConstant 定数同士の計算を1命令にまとめる
+//
+//	add r1 2; add r1 3 -> add r1 5
+//	mov r1 2; add r1 3 -> mov r1 5 (zfが後で使われないとき)
+func foldConstant(insts []inst, i int) bool {
+	a, b := &insts[i], &insts[i+1]
+	if (a.op != MOV && a.op != ADD && a.op != SUB) || (b.op != ADD && b.op != SUB) {
+		return false
+	}
+	dst, ok := a.args[0].(Register)
+	if !ok || !dst.isGeneral() || b.args[0] != dst {
+		return false
+	}
+	x, ok := a.args[1].(Number)
+	if !ok {
+		return false
+	}
+	y, ok := b.args[1].(Number)
+	if !ok {
+		return false
+	}
+	switch a.op {
+	case ADD, SUB:
+		// 足してから引いても引いてから足してもsubの結果はIntegerになるので、どちらかがsubならsubにまとめる
+		sum := signed(a.op, x) + signed(b.op, y)
+		if a.op == ADD && b.op == ADD {
+			a.args = []Node{dst, sum}
+		} else {
+			a.op = SUB
+			a.args = []Node{dst, -sum}
+		}
+		return true
+	case MOV:
+		if !zfDead(insts, i+2) {
+			return false
+		}
+		a.args = []Node{dst, x + signed(b.op, y)}
+		return true
+	}
+	return false
+}
+
+func signed(op Operation, n Number) Number {
+	if op == SUB {
+		return -n
+	}
+	return n
+}
+
+// zfDead i番目から先でzfを読む前に上書きするならtrue
+func zfDead(insts []inst, i int) bool {
+	for ; i < len(insts); i++ {
+		in := insts[i]
+		switch in.op {
+		case EQ, NE, LT, LE:
+			return isConstantOrRegister(in.args[0]) && isConstantOrRegister(in.args[1])
+		case MOV:
+			if !isConstantOrRegister(in.args[0]) || !isConstantOrRegister(in.args[1]) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// isRedundantCompare 同じ比較とジャンプが2回続いている
+//
+//	eq r1 0; jz L1; eq r1 0; jz L2
+func isRedundantCompare(insts []inst, i int, isTarget []bool) bool {
+	a, ja, b, jb := insts[i], insts[i+1], insts[i+2], insts[i+3]
+	switch a.op {
+	case EQ, NE, LT, LE:
+	default:
+		return false
+	}
+	if a.op != b.op || a.args[0] != b.args[0] || a.args[1] != b.args[1] {
+		return false
+	}
+	if !isConstantOrRegister(a.args[0]) || !isConstantOrRegister(a.args[1]) {
+		return false
+	}
+	if (ja.op != JZ && ja.op != JNZ) || (jb.op != JZ && jb.op != JNZ) {
+		return false
+	}
+	// 途中から入ってくるとzfが比較の結果とは限らない
+	return !isTarget[i+1] && !isTarget[i+2] && !isTarget[i+3]
+}
+
+// remapDebugInfo 最適化でずれたPCにデバッグ情報を合わせる
+func remapDebugInfo(info *vm.DebugInfo, pcMap map[int]int) {
+	for i, sym := range info.Symbols {
+		if sym.Kind == vm.SymbolData {
+			continue
+		}
+		start, ok := pcMap[sym.Addr]
+		if !ok {
+			continue
+		}
+		if sym.Kind == vm.SymbolFunction {
+			if end, ok := pcMap[sym.Addr+sym.Size]; ok {
+				info.Symbols[i].Size = end - start
+			}
+		}
+		info.Symbols[i].Addr = start
+	}
+	info.Sort()
+}
@@ -0,0 +1,184 @@
+package ir
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  []Node
+		expect []Node
+	}{
+		{
+			"remove label nops",
+			[]Node{
+				JMP, Offset{PC, 3},
+				NOP,
+				NOP, // _start
+				MOV, R1, Number(1),
+				JMP, Offset{PC, -4},
+			},
+			[]Node{
+				MOV, R1, Number(1),
+				JMP, Offset{PC, -3},
+			},
+		},
+		{
+			"thread jumps",
+			[]Node{
+				JZ, Offset{PC, 4},
+				SYSCALL,
+				RET,
+				JMP, Offset{PC, 3},
+				RET,
+				SYSCALL,
+			},
+			[]Node{
+				JZ, Offset{PC, 7},
+				SYSCALL,
+				RET,
+				JMP, Offset{PC, 3},
+				RET,
+				SYSCALL,
+			},
+		},
+		{
+			"jump to next",
+			[]Node{
+				JMP, Offset{PC, 2},
+				JNZ, Offset{PC, 2},
+				SYSCALL,
+			},
+			[]Node{
+				SYSCALL,
+			},
+		},
+		{
+			"dead moves",
+			[]Node{
+				MOV, R1, R1,
+				MOV, R2, Number(1),
+				MOV, R2, R3,
+				MOV, R4, R2,
+				MOV, R2, R4,
+				SYSCALL,
+			},
+			[]Node{
+				MOV, R2, R3,
+				MOV, R4, R2,
+				SYSCALL,
+			},
+		},
+		{
+			"redundant eq and jz",
+			[]Node{
+				EQ, R1, Number(0),
+				JZ, Offset{PC, 16},
+				EQ, R1, Number(0),
+				JZ, Offset{PC, 7},
+				EQ, R1, Number(0),
+				JNZ, Offset{PC, 3},
+				RET,
+				MOV, R0, Number(0),
+				SYSCALL,
+			},
+			[]Node{
+				EQ, R1, Number(0),
+				JZ, Offset{PC, 8},
+				JMP, Offset{PC, 3},
+				RET,
+				MOV, R0, Number(0),
+				SYSCALL,
+			},
+		},
+		{
+			"fold constants",
+			[]Node{
+				ADD, R1, Number(2),
+				SUB, R1, Number(5),
+				MOV, R2, Number(10),
+				SUB, R2, Number(1),
+				EQ, R3, Number(0),
+				MOV, R4, Number(10),
+				SUB, R4, Number(1),
+				JNZ, Offset{PC, -3},
+				SYSCALL,
+			},
+			[]Node{
+				SUB, R1, Number(3),
+				MOV, R2, Number(9),
+				EQ, R3, Number(0),
+				MOV, R4, Number(10),
+				SUB, R4, Number(1),
+				JNZ, Offset{PC, -3},
+				SYSCALL,
+			},
+		},
+		{
+			"pc is read",
+			[]Node{
+				NOP,
+				MOV, R1, PC,
+				SYSCALL,
+			},
+			[]Node{
+				NOP,
+				MOV, R1, PC,
+				SYSCALL,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Optimize(tt.nodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.expect, got); diff != "" {
+				t.Errorf("diff:\n%s\ngot:\n%s", diff, Print(got))
+			}
+		})
+	}
+}
+
+func TestLinkWithDebugInfo_Optimize(t *testing.T) {
+	code := `
+.section .text:
+    global _start
+_start:
+    call _f
+    mov r0 0
+    syscall
+_f:
+    mov r1 1
+    ret
+`
+	tokens, err := Tokenize([]rune(code), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, info, err := LinkWithDebugInfo([]*IR{ir}, &LinkConfig{Optimize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range nodes {
+		if nd == NOP {
+			t.Fatalf("nop remains:\n%s", Print(nodes))
+		}
+	}
+	f, ok := info.Lookup("_f")
+	if !ok {
+		t.Fatal("_f not found")
+	}
+	// _f は mov r1 1; ret
+	if nodes[f.Addr] != MOV || f.Size != 4 {
+		t.Errorf("_f = %+v\n%s", f, Print(nodes))
+	}
+}
@@ -0,0 +1,102 @@
+package ir
+
+import "fmt"
+
+// PartialLink irsを1つの .mir にまとめる。結果はFormatでソースにする
+// 中で解決したimportは消し、まだ解決されていないimportとexportは残す
+// exportされていないラベルとデータは、ほかの名前とぶつかれば付け替える
+func PartialLink(irs []*IR, archives []*Archive) (*IR, error) {
+	irs, err := ExpandMacros(irs, archives)
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := pullMembers(irs, archives)
+	if err != nil {
+		return nil, err
+	}
+	irs = append(irs[:len(irs):len(irs)], pulled...)
+
+	result := &IR{
+		Imports:   []string{},
+		Exports:   []string{},
+		Constants: []Constant{},
+		Text:      []Node{},
+	}
+	defined := map[string]bool{}
+	for _, ir := range irs {
+		if ir.EntryPoint != "" {
+			if result.EntryPoint != "" {
+				return nil, fmt.Errorf("too many entryPoint: %s, %s", result.EntryPoint, ir.EntryPoint)
+			}
+			result.EntryPoint = ir.EntryPoint
+		}
+		// データはまとめた .mir に残るので、大きさは足さずに大きい方だけ残す
+		result.StackSize = max(result.StackSize, ir.StackSize)
+		result.HeapSize = max(result.HeapSize, ir.HeapSize)
+		// exportしたマクロはまとめた .mir からも使えるようにする
+		for _, m := range ir.Macros {
+			if m.Exported {
+				result.Macros = append(result.Macros, m)
+			}
+		}
+		for _, name := range ir.Exports {
+			if defined[name] {
+				return nil, fmt.Errorf("label exists: %s", name)
+			}
+			defined[name] = true
+			result.Exports = append(result.Exports, name)
+		}
+		for _, nd := range ir.Text {
+			if label, ok := nd.(Label); ok && label.Define {
+				defined[label.Name] = true
+			}
+		}
+	}
+	for _, ir := range irs {
+		for _, name := range ir.Imports {
+			if !defined[name] && !in(name, result.Imports) {
+				result.Imports = append(result.Imports, name)
+			}
+		}
+	}
+
+	for _, ir := range scopePrivate(irs, true) {
+		result.Constants = append(result.Constants, ir.Constants...)
+		text, err := unsolveLabel(ir)
+		if err != nil {
+			return nil, err
+		}
+		result.Text = append(result.Text, text...)
+	}
+	return result, nil
+}
+
+// unsolveLabel Parseで解決したローカルラベルを名前に戻す。solveLabelの逆
+func unsolveLabel(ir *IR) ([]Node, error) {
+	locals := map[int]string{}
+	for _, l := range ir.Locals {
+		locals[l.Pos] = l.Name
+	}
+	text := make([]Node, 0, len(ir.Text))
+	// opPC 直前の命令の位置
+	opPC := 0
+	for pc, nd := range ir.Text {
+		if name, ok := locals[pc]; ok && nd == NOP {
+			text = append(text, Label{Define: true, Name: name})
+			continue
+		}
+		if _, ok := nd.(Operation); ok {
+			opPC = pc
+		}
+		if off, ok := nd.(Offset); ok && off.Target == PC {
+			name, ok := locals[opPC+off.Diff]
+			if !ok {
+				return nil, fmt.Errorf("no label at %d", opPC+off.Diff)
+			}
+			text = append(text, Label{Define: false, Name: name})
+			continue
+		}
+		text = append(text, nd)
+	}
+	return text, nil
+}
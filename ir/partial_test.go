@@ -0,0 +1,100 @@
+package ir
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPartialLink_SameAsLink(t *testing.T) {
+	srcs := readExampleSources(t, "calc/main.mir", "calc/lib.mir", "calc/fmt.mir")
+	irs, err := ParseSources(srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Link(irs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	libIrs, err := ParseSources(srcs[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := PartialLink(libIrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := LinkSources([]Source{
+		srcs[0],
+		{Name: "sdk.mir", Text: []rune(Format(lib))},
+	}, &LinkConfig{})
+	if err != nil {
+		t.Fatalf("%v\n%s", err, Format(lib))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPartialLink_RenamesPrivateSymbols(t *testing.T) {
+	a := `
+.export _a
+.import _b
+.import _print
+.section .data:
+    buf auto 'a', '\n'
+.section .text:
+_a:
+    mov r1 buf
+__loop:
+    call _b
+    jmp __loop
+`
+	b := `
+.export _b
+.section .data:
+    buf auto '\0', 1
+.section .text:
+_b:
+    mov r1 buf
+__loop:
+    jmp __loop
+`
+	lib, err := PartialLink(parseSources(t, a, b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"_print"}, lib.Imports); diff != "" {
+		t.Errorf("imports diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"_a", "_b"}, lib.Exports); diff != "" {
+		t.Errorf("exports diff (-want +got):\n%s", diff)
+	}
+	want := `.import _print
+.export _a
+.export _b
+
+.section .data:
+    buf auto 'a', '\n'
+    buf_1 auto '\0', 1
+
+.section .text:
+_a:
+    mov r1 buf
+__loop:
+    call _b
+    jmp __loop
+_b:
+    mov r1 buf_1
+__loop_1:
+    jmp __loop_1
+`
+	if diff := cmp.Diff(want, Format(lib)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	// 出力はそのままパースできる
+	if _, err := ParseSources([]Source{{Name: "lib.mir", Text: []rune(Format(lib))}}); err != nil {
+		t.Fatal(err)
+	}
+}
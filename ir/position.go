@@ -1,6 +1,22 @@
 package ir
 
+import "fmt"
+
 type Position struct {
 	StartedAt int
 	Line      int
 }
+
+// LineError Tokenize/Parse のエラーと、見つけた行(1から)
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
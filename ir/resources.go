@@ -0,0 +1,29 @@
+package ir
+
+import "github.com/x0y14/minivm/vm"
+
+// resources リンクしたirsの `.stack` `.heap` をまとめる。irsはスタートアップとアーカイブから取り出したものも含む
+// どちらもモジュールの中で一番大きいものを使い、ヒープには _pre が確保する .data の大きさを足す
+// constants はたどれないものを取り除いた後のデータ。`.heap` がどこにもなければ既定の大きさに足す
+// `.heap` も .data もなければヒープは0(指定なし)のまま
+func resources(irs []*IR, constants []Constant) vm.Resources {
+	var r vm.Resources
+	for _, ir := range irs {
+		r.StackSize = max(r.StackSize, ir.StackSize)
+		r.HeapSize = max(r.HeapSize, ir.HeapSize)
+	}
+	data := 0
+	for _, c := range constants {
+		if c.Mode == AUTO {
+			data += len(c.Values)
+		}
+	}
+	if data == 0 {
+		return r
+	}
+	if r.HeapSize == 0 {
+		r.HeapSize = vm.DefaultHeapSize
+	}
+	r.HeapSize += data
+	return r
+}
@@ -0,0 +1,150 @@
+package ir
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/x0y14/minivm/vm"
+)
+
+func TestResources(t *testing.T) {
+	main := `
+.import _f
+.stack 1024
+.heap 100
+.section .data:
+    msg auto "hi"
+.section .text:
+    global _start
+_start:
+    mov r1 msg
+    call _f
+    mov r0 0
+    syscall
+`
+	lib := `
+.export _f
+.stack 4096
+.heap 50
+.section .data:
+    buf auto 1, 2, 3
+.section .text:
+_f:
+    mov r1 buf
+    ret
+`
+	noHeap := `
+.stack 64
+.section .data:
+    msg auto "hi"
+.section .text:
+    global _start
+_start:
+    mov r1 msg
+    mov r0 0
+    syscall
+`
+	noData := `
+.stack 64
+.section .text:
+    global _start
+_start:
+    mov r0 0
+    syscall
+`
+	unused := `
+.heap 10
+.section .data:
+    unused auto 1, 2, 3, 4
+.section .text:
+    global _start
+_start:
+    mov r0 0
+    syscall
+`
+	archive, err := NewArchive([]Member{
+		{"lib.mir", parseSources(t, lib)[0]},
+		{"other.mir", parseSources(t, ".export _g\n.stack 65536\n.section .text:\n_g:\n    ret\n")[0]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		irs    []*IR
+		config *LinkConfig
+		want   vm.Resources
+	}{
+		// スタックは大きい方、ヒープは大きい方 + .data の 3+3
+		{"max", parseSources(t, main, lib), &LinkConfig{}, vm.Resources{StackSize: 4096, HeapSize: 106}},
+		// 取り出したメンバーだけを数える
+		{"archive", parseSources(t, main), &LinkConfig{Archives: []*Archive{archive}}, vm.Resources{StackSize: 4096, HeapSize: 106}},
+		{"objects", parseSources(t, main), &LinkConfig{Objects: []*Object{Compile("lib.mir", parseSources(t, lib)[0])}}, vm.Resources{StackSize: 4096, HeapSize: 106}},
+		// .heap がなくても .data の分は既定の大きさに足す
+		{"no heap", parseSources(t, noHeap), &LinkConfig{}, vm.Resources{StackSize: 64, HeapSize: vm.DefaultHeapSize + 3}},
+		// どちらもなければ指定なし
+		{"no data", parseSources(t, noData), &LinkConfig{}, vm.Resources{StackSize: 64}},
+		// 取り除いたデータは数えない
+		{"keep data", parseSources(t, unused), &LinkConfig{}, vm.Resources{HeapSize: 14}},
+		{"strip data", parseSources(t, unused), &LinkConfig{StripData: true}, vm.Resources{HeapSize: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := LinkProgram(tt.irs, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Resources != tt.want {
+				t.Errorf("got %+v, want %+v", p.Resources, tt.want)
+			}
+		})
+	}
+}
+
+func TestResources_KeptByFormatAndArchive(t *testing.T) {
+	irs := parseSources(t, `
+.export _f
+.stack 2048
+.heap 512
+.section .text:
+_f:
+    ret
+`)
+	// 部分リンクした .mir に残る
+	lib, err := PartialLink(irs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := Format(lib)
+	if !strings.Contains(src, ".stack 2048\n") || !strings.Contains(src, ".heap 512\n") {
+		t.Errorf("missing directives:\n%s", src)
+	}
+	// .mar のメンバーにも残る
+	archive, err := NewArchive([]Member{{"lib.mir", irs[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := WriteArchive(&buf, archive); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadArchive(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := read.Members[0].IR
+	if diff := cmp.Diff([]int{2048, 512}, []int{m.StackSize, m.HeapSize}); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParse_InvalidSize(t *testing.T) {
+	tokens, err := Tokenize([]rune(".stack 0\n.section .text:\n_start:\n    ret\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(tokens); err == nil {
+		t.Error("expected error")
+	}
+}
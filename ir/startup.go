@@ -0,0 +1,67 @@
+package ir
+
+import "fmt"
+
+// crt0 既定のスタートアップ。main を呼び、戻り値を終了コードにして exit する
+const crt0 = `
+.import main
+.section .text:
+    global _start
+_start:
+    call main
+    mov r1 r0
+    mov r0 0
+    syscall
+`
+
+// DefaultStartup crt0 をパースしたもの
+func DefaultStartup() (*IR, error) {
+	tokens, err := Tokenize([]rune(crt0), true)
+	if err != nil {
+		return nil, fmt.Errorf("crt0: %w", err)
+	}
+	ir, err := Parse(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("crt0: %w", err)
+	}
+	ir.Source = "crt0"
+	return ir, nil
+}
+
+// checkStartup スタートアップが定義するラベルを、リンクするファイルでも定義していればエラーにする
+func checkStartup(stub *IR, irs []*IR) error {
+	for _, nd := range stub.Text {
+		label, ok := nd.(Label)
+		if !ok || !label.Define {
+			continue
+		}
+		for _, ir := range irs {
+			for _, nd := range ir.Text {
+				if l, ok := nd.(Label); ok && l.Define && l.Name == label.Name {
+					return fmt.Errorf("%s: %s is also defined by the startup %s", ir.Source, label.Name, stub.Source)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bindStartup スタートアップの main への参照を entry に付け替えたコピーを返す
+func bindStartup(stub *IR, entry string) *IR {
+	bound := *stub
+	bound.Imports = make([]string, 0, len(stub.Imports))
+	for _, name := range stub.Imports {
+		if name == "main" {
+			name = entry
+		}
+		bound.Imports = append(bound.Imports, name)
+	}
+	bound.Text = make([]Node, 0, len(stub.Text))
+	for _, nd := range stub.Text {
+		if label, ok := nd.(Label); ok && !label.Define && label.Name == "main" {
+			nd = Label{Define: false, Name: entry}
+		}
+		bound.Text = append(bound.Text, nd)
+	}
+	return &bound
+}
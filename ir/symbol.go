@@ -114,7 +114,9 @@ func (s *SymbolTable) collect(ir *IR) error {
 		switch nd := nd.(type) {
 		case Label:
 			if nd.Define {
-				if err := s.declare(Function, nd.Name, ir.Id, in(nd.Name, ir.Exports)); err != nil {
+				// エントリーポイントはスタートアップから呼ばれるのでexportと同じ
+				exported := in(nd.Name, ir.Exports) || nd.Name == ir.EntryPoint
+				if err := s.declare(Function, nd.Name, ir.Id, exported); err != nil {
 					return err
 				}
 			} else {
@@ -1,8 +1,10 @@
 package ir
 
 import (
+	"fmt"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"testing/quick"
 
@@ -108,3 +110,52 @@ func TestTokenize_RoundTrip(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Tokenize/Parse がパッケージの状態を共有していないこと
+func TestTokenizeAndParse_Concurrent(t *testing.T) {
+	inputs := []string{
+		".section .text:\n_f:\n    mov r0 1\n    ret\n",
+		".section .data:\n    msg auto \"hello\"\n.section .text:\n_g:\n    mov r1 msg\n    ret\n",
+		".section .text:\n_h:\n    load r3 [r1+r2*4]\n    jmp _h\n",
+	}
+	want := make([]*IR, len(inputs))
+	for i, input := range inputs {
+		tokens, err := Tokenize([]rune(input), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ir, err := Parse(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = ir
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for n := 0; n < 100; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := n % len(inputs)
+			tokens, err := Tokenize([]rune(inputs[i]), true)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ir, err := Parse(tokens)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !cmp.Equal(want[i], ir) {
+				errs <- fmt.Errorf("input %d: result differs from sequential parse", i)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
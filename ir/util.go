@@ -21,3 +21,14 @@ func expand(nodes []Node) []Node {
 	}
 	return nds
 }
+
+func constValue(c ConstantData) int {
+	switch c := c.(type) {
+	case ConstChar:
+		return int(c)
+	case ConstInt:
+		return int(c)
+	default:
+		return 0
+	}
+}
@@ -1,5 +1,7 @@
 package vm
 
+import "fmt"
+
 //
 //type HeapAddress Integer
 //
@@ -16,3 +18,36 @@ package vm
 //func (h HeapAddress) String() string {
 //	return fmt.Sprintf("@(%s%+d)", HP.String(), h)
 //}
+
+// Address `[r1+4]`のようなレジスタ相対のメモリ上の位置
+type Address interface {
+	Operand
+	isAddress()
+}
+
+// RegisterOffset [base+disp]
+type RegisterOffset struct {
+	Base GeneralPurposeRegister
+	Disp int
+}
+
+func (r RegisterOffset) isCode() {}
+func (r RegisterOffset) String() string {
+	return fmt.Sprintf("[%s%+d]", r.Base.String(), r.Disp)
+}
+func (r RegisterOffset) isOperand() {}
+func (r RegisterOffset) isAddress() {}
+
+// IndexedOffset [base+index*scale]
+type IndexedOffset struct {
+	Base  GeneralPurposeRegister
+	Index GeneralPurposeRegister
+	Scale int
+}
+
+func (i IndexedOffset) isCode() {}
+func (i IndexedOffset) String() string {
+	return fmt.Sprintf("[%s+%s*%d]", i.Base.String(), i.Index.String(), i.Scale)
+}
+func (i IndexedOffset) isOperand() {}
+func (i IndexedOffset) isAddress() {}
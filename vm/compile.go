@@ -0,0 +1,604 @@
+package vm
+
+import "fmt"
+
+// Engine 命令列の実行方法
+type Engine int
+
+const (
+	// EngineInterpreter 1命令ずつオペランドを調べながら実行する
+	EngineInterpreter Engine = iota
+	// EngineCompiled 実行前に基本ブロックごとにクロージャへ変換してから実行する
+	EngineCompiled
+)
+
+func (e Engine) String() string {
+	return []string{
+		EngineInterpreter: "interpreter",
+		EngineCompiled:    "compiled",
+	}[e]
+}
+
+// ParseEngine "interpreter" / "compiled" を Engine に変換する
+func ParseEngine(s string) (Engine, error) {
+	switch s {
+	case "", "interpreter":
+		return EngineInterpreter, nil
+	case "compiled":
+		return EngineCompiled, nil
+	default:
+		return 0, fmt.Errorf("unsupported engine: %s", s)
+	}
+}
+
+// compiledOp 1命令分のクロージャ。オペランドは束縛済みで、PCの更新まで行う
+type compiledOp func(r *Runtime) error
+
+type operandReader func(r *Runtime) (Immediate, error)
+type operandWriter func(r *Runtime, v Immediate) error
+
+// compiledBlock 基本ブロック。途中で飛び出すのは最後の命令かエラーのときだけ
+type compiledBlock struct {
+	pcs []int
+	ops []compiledOp
+}
+
+type compiledProgram struct {
+	// ops pc -> 命令。オペランドの位置はnil
+	ops []compiledOp
+	// blocks pc -> そのpcを含む基本ブロック、index はブロック内の位置
+	blocks []*compiledBlock
+	index  []int
+}
+
+// compile 命令列を検査し、基本ブロックごとにクロージャへ変換する
+func compile(program []Code) (*compiledProgram, error) {
+	c := &compiledProgram{
+		ops:    make([]compiledOp, len(program)),
+		blocks: make([]*compiledBlock, len(program)),
+		index:  make([]int, len(program)),
+	}
+
+	// 1) 命令の位置を調べ、飛び先をブロックの先頭にする
+	var pcs []int
+	isOp := make([]bool, len(program))
+	for pc := 0; pc < len(program); {
+		op, ok := program[pc].(Opcode)
+		if !ok {
+			return nil, fmt.Errorf("compile: pc %d: unexpected operand: %s", pc, program[pc].String())
+		}
+		if len(program) <= pc+op.NumOperands() {
+			return nil, fmt.Errorf("compile: pc %d: %s: missing operands", pc, op.String())
+		}
+		isOp[pc] = true
+		pcs = append(pcs, pc)
+		pc += op.NumOperands() + 1
+	}
+	leaders := map[int]bool{0: true}
+	for _, pc := range pcs {
+		op := program[pc].(Opcode)
+		for i := 1; i <= op.NumOperands(); i++ {
+			off, ok := program[pc+i].(PcOffset)
+			if !ok {
+				continue
+			}
+			// 命令でない飛び先はインタプリタと同じく、実際に飛んだときにエラーにする
+			dst := pc + int(off)
+			if dst < 0 || len(program) <= dst || !isOp[dst] {
+				continue
+			}
+			leaders[dst] = true
+		}
+		if endsBlock(program, pc) {
+			leaders[pc+op.NumOperands()+1] = true
+		}
+	}
+
+	// 2) 命令ごとにクロージャを作る
+	for _, pc := range pcs {
+		op, err := compileOp(program, pc)
+		if err != nil {
+			return nil, fmt.Errorf("compile: pc %d: %w", pc, err)
+		}
+		c.ops[pc] = op
+	}
+
+	// 3) 基本ブロックにまとめる
+	var block *compiledBlock
+	for _, pc := range pcs {
+		if block == nil || leaders[pc] {
+			block = &compiledBlock{}
+		}
+		c.blocks[pc] = block
+		c.index[pc] = len(block.ops)
+		block.pcs = append(block.pcs, pc)
+		block.ops = append(block.ops, c.ops[pc])
+	}
+	return c, nil
+}
+
+// endsBlock pcの命令の後に次の命令へ進むとは限らないならtrue
+// ジャンプのほか、スレッドの切り替え・停止・割り込みの受け付けが起きうる命令も含む
+func endsBlock(program []Code, pc int) bool {
+	op := program[pc].(Opcode)
+	switch op {
+	case JMP, JZ, JNZ, CALL, RET, TAILCALL,
+		SPAWN, YIELD, JOIN, TEXIT,
+		SEND, RECV, LOCK,
+		THROW, INT, IRET, STI,
+		SYSCALL:
+		return true
+	}
+	// PCへの書き込み
+	for i := 1; i <= op.NumOperands(); i++ {
+		if program[pc+i] == PC {
+			return true
+		}
+	}
+	return false
+}
+
+// compileOp pcの命令をクロージャにする。頻繁に使う命令以外はインタプリタに任せる
+func compileOp(program []Code, pc int) (compiledOp, error) {
+	op := program[pc].(Opcode)
+	operand := func(i int) Code { return program[pc+i] }
+	switch op {
+	case NOP:
+		return relocating(op, func(r *Runtime) error { return nil }), nil
+	case MOV:
+		src, err := compileReader(op, operand(2), 0, true)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := compileWriter(op, operand(1), 0, true)
+		if err != nil {
+			return nil, err
+		}
+		return relocating(op, func(r *Runtime) error {
+			v, err := src(r)
+			if err != nil {
+				return err
+			}
+			return dst(r, v)
+		}), nil
+	case PUSH:
+		src, err := compileReader(op, operand(1), 0, false)
+		if err != nil {
+			return nil, err
+		}
+		return relocating(op, func(r *Runtime) error {
+			v, err := src(r)
+			if err != nil {
+				return err
+			}
+			return r.pushToStack(v)
+		}), nil
+	case POP:
+		reg, ok := operand(1).(Register)
+		if !ok {
+			return nil, fmt.Errorf("pop: unsupported dst: %s", operand(1).String())
+		}
+		dst, err := compileWriter(op, reg, 0, false)
+		if err != nil {
+			return nil, err
+		}
+		return relocating(op, func(r *Runtime) error {
+			v, err := r.popFromStack()
+			if err != nil {
+				return err
+			}
+			return dst(r, v)
+		}), nil
+	case STORE, STORE8, STORE16, STORE32, STORE64:
+		width := op.width()
+		src, err := compileReader(op, operand(2), width, true)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := compileStoreAddress(op, operand(1))
+		if err != nil {
+			return nil, err
+		}
+		return relocating(op, func(r *Runtime) error {
+			v, err := src(r)
+			if err != nil {
+				return err
+			}
+			addr, err := dst(r)
+			if err != nil {
+				return err
+			}
+			return r.setMemory(addr, width, v)
+		}), nil
+	case LOAD, LOAD8, LOAD16, LOAD32, LOAD64:
+		width := op.width()
+		var src operandReader
+		if addr, ok := operand(2).(Address); ok {
+			// アドレスそのものを使う
+			src = func(r *Runtime) (Immediate, error) {
+				v, err := r.effectiveAddress(addr)
+				if err != nil {
+					return nil, err
+				}
+				return Integer(v), nil
+			}
+		} else {
+			reader, err := compileReader(op, operand(2), 0, false)
+			if err != nil {
+				return nil, err
+			}
+			src = reader
+		}
+		var dst operandWriter
+		if addr, ok := operand(1).(Integer); ok {
+			dst = func(r *Runtime, v Immediate) error {
+				return r.setMemory(int(addr), width, v)
+			}
+		} else {
+			writer, err := compileWriter(op, operand(1), width, true)
+			if err != nil {
+				return nil, err
+			}
+			dst = writer
+		}
+		return relocating(op, func(r *Runtime) error {
+			addr, err := src(r)
+			if err != nil {
+				return err
+			}
+			v, err := r.getMemory(addr.Value(), width)
+			if err != nil {
+				return err
+			}
+			return dst(r, v)
+		}), nil
+	case CALL:
+		dst, err := jumpTarget(op, pc, operand(1))
+		if err != nil {
+			return nil, err
+		}
+		retAddr := Integer(pc + op.NumOperands() + 1)
+		return func(r *Runtime) error {
+			if err := r.pushToStack(retAddr); err != nil {
+				return err
+			}
+			r.registers.specials[PC] = dst
+			r.current.calls = append(r.current.calls, pc)
+			return nil
+		}, nil
+	case RET:
+		return func(r *Runtime) error {
+			dst, err := r.popFromStack()
+			if err != nil {
+				return err
+			}
+			if n := len(r.current.calls); 0 < n {
+				r.current.calls = r.current.calls[:n-1]
+			}
+			addr, ok := dst.(Integer)
+			if !ok {
+				return fmt.Errorf("ret: unsupported dst: %s", dst.String())
+			}
+			if addr == threadExit {
+				r.exitThread()
+				return r.schedule()
+			}
+			r.registers.specials[PC] = int(addr)
+			return nil
+		}, nil
+	case ENTER:
+		n, ok := operand(1).(Integer)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("enter: unsupported size: %s", operand(1).String())
+		}
+		return relocating(op, func(r *Runtime) error {
+			if err := r.pushToStack(r.getSpecialReg(BP)); err != nil {
+				return err
+			}
+			sp := r.registers.specials[SP]
+			r.registers.specials[BP] = sp
+			if !r.reserveStack(r.current, sp-int(n)) {
+				return faultf(FaultStackOverflow, "enter: stack overflow")
+			}
+			r.registers.specials[SP] = sp - int(n)
+			return nil
+		}), nil
+	case LEAVE:
+		return relocating(op, func(r *Runtime) error { return r.leave() }), nil
+	case TAILCALL:
+		dst, err := jumpTarget(op, pc, operand(1))
+		if err != nil {
+			return nil, err
+		}
+		return func(r *Runtime) error {
+			if err := r.leave(); err != nil {
+				return err
+			}
+			r.registers.specials[PC] = dst
+			return nil
+		}, nil
+	case JMP:
+		dst, err := jumpTarget(op, pc, operand(1))
+		if err != nil {
+			return nil, err
+		}
+		return func(r *Runtime) error {
+			r.registers.specials[PC] = dst
+			return nil
+		}, nil
+	case JZ, JNZ:
+		dst, err := jumpTarget(op, pc, operand(1))
+		if err != nil {
+			return nil, err
+		}
+		next := pc + op.NumOperands() + 1
+		want := op == JZ
+		return func(r *Runtime) error {
+			if r.registers.flags[ZF] == want {
+				r.registers.specials[PC] = dst
+			} else {
+				r.registers.specials[PC] = next
+			}
+			return nil
+		}, nil
+	case ADD, SUB:
+		if _, ok := operand(1).(Register); !ok {
+			if _, ok := operand(1).(Offset); !ok {
+				return nil, fmt.Errorf("%s: unsupported dst: %s", op.String(), operand(1).String())
+			}
+		}
+		src, err := compileReader(op, operand(2), 0, false)
+		if err != nil {
+			return nil, err
+		}
+		lhs, err := compileReader(op, operand(1), 0, false)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := compileWriter(op, operand(1), 0, false)
+		if err != nil {
+			return nil, err
+		}
+		calc := addValues
+		if op == SUB {
+			calc = subValues
+		}
+		return relocating(op, func(r *Runtime) error {
+			s, err := src(r)
+			if err != nil {
+				return err
+			}
+			v, err := lhs(r)
+			if err != nil {
+				return err
+			}
+			res, err := calc(v, s)
+			if err != nil {
+				return err
+			}
+			r.registers.flags[ZF] = res.Value() == 0
+			return dst(r, res)
+		}), nil
+	case EQ, NE, LT, LE:
+		lhs, err := compileReader(op, operand(1), 0, false)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := compileReader(op, operand(2), 0, false)
+		if err != nil {
+			return nil, err
+		}
+		var compare func(a, b int) bool
+		switch op {
+		case EQ:
+			compare = func(a, b int) bool { return a == b }
+		case NE:
+			compare = func(a, b int) bool { return a != b }
+		case LT:
+			compare = func(a, b int) bool { return a < b }
+		default:
+			compare = func(a, b int) bool { return a <= b }
+		}
+		return relocating(op, func(r *Runtime) error {
+			a, err := lhs(r)
+			if err != nil {
+				return err
+			}
+			b, err := rhs(r)
+			if err != nil {
+				return err
+			}
+			r.registers.flags[ZF] = compare(a.Value(), b.Value())
+			return nil
+		}), nil
+	default:
+		// 残りはインタプリタで実行する
+		return func(r *Runtime) error { return r.exec() }, nil
+	}
+}
+
+// relocating 実行後にPCを次の命令へ進める。インタプリタと同じくエラーでも進める
+func relocating(op Opcode, body compiledOp) compiledOp {
+	size := op.NumOperands() + 1
+	return func(r *Runtime) error {
+		err := body(r)
+		r.registers.specials[PC] += size
+		return err
+	}
+}
+
+// jumpTarget PcOffsetのオペランドを飛び先の絶対アドレスにする
+func jumpTarget(op Opcode, pc int, operand Code) (int, error) {
+	off, ok := operand.(PcOffset)
+	if !ok {
+		return 0, fmt.Errorf("%s: unsupported dst: %s", op.String(), operand.String())
+	}
+	return pc + int(off), nil
+}
+
+// compileReader 値を読むオペランド。memory が true ならアドレス([r1+4])からwidthバイト読むことも許す
+func compileReader(op Opcode, operand Code, width int, memory bool) (operandReader, error) {
+	switch operand := operand.(type) {
+	case GeneralPurposeRegister:
+		return func(r *Runtime) (Immediate, error) {
+			return r.registers.generals[operand], nil
+		}, nil
+	case SpecialRegister:
+		return func(r *Runtime) (Immediate, error) {
+			return Integer(r.registers.specials[operand]), nil
+		}, nil
+	case FlagRegister:
+		return func(r *Runtime) (Immediate, error) {
+			return Boolean(r.registers.flags[operand]), nil
+		}, nil
+	case Offset:
+		return func(r *Runtime) (Immediate, error) {
+			return r.getStack(operand)
+		}, nil
+	case Address:
+		if !memory {
+			break
+		}
+		return func(r *Runtime) (Immediate, error) {
+			addr, err := r.effectiveAddress(operand)
+			if err != nil {
+				return nil, err
+			}
+			return r.getMemory(addr, width)
+		}, nil
+	case Immediate:
+		return func(r *Runtime) (Immediate, error) {
+			return operand, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported src: %s", op.String(), operand.String())
+}
+
+// compileWriter 値を書き込むオペランド。memory が true ならアドレス([r1+4])へwidthバイト書くことも許す
+func compileWriter(op Opcode, operand Code, width int, memory bool) (operandWriter, error) {
+	switch operand := operand.(type) {
+	case GeneralPurposeRegister:
+		return func(r *Runtime, v Immediate) error {
+			r.registers.generals[operand] = v
+			return nil
+		}, nil
+	case Register:
+		return func(r *Runtime, v Immediate) error {
+			return r.setReg(operand, v)
+		}, nil
+	case Offset:
+		return func(r *Runtime, v Immediate) error {
+			return r.setStack(operand, v)
+		}, nil
+	case Address:
+		if !memory {
+			break
+		}
+		return func(r *Runtime, v Immediate) error {
+			addr, err := r.effectiveAddress(operand)
+			if err != nil {
+				return err
+			}
+			return r.setMemory(addr, width, v)
+		}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported dst: %s", op.String(), operand.String())
+}
+
+// compileStoreAddress store の書き込み先。レジスタとスタックは中身をアドレスとして使う
+func compileStoreAddress(op Opcode, operand Code) (func(r *Runtime) (int, error), error) {
+	switch operand := operand.(type) {
+	case Register, Offset:
+		reader, err := compileReader(op, operand, 0, false)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *Runtime) (int, error) {
+			v, err := reader(r)
+			if err != nil {
+				return 0, err
+			}
+			addr, ok := v.(Integer)
+			if !ok {
+				return 0, fmt.Errorf("%s: unsupported dst: %s", op.String(), operand.String())
+			}
+			return int(addr), nil
+		}, nil
+	case Address:
+		return func(r *Runtime) (int, error) {
+			return r.effectiveAddress(operand)
+		}, nil
+	case Integer:
+		return func(r *Runtime) (int, error) {
+			return int(operand), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported dst: %s", op.String(), operand.String())
+}
+
+func addValues(v, src Immediate) (Immediate, error) {
+	if !calculable(v, src) {
+		return nil, faultf(FaultTypeMismatch, "add: unsupported values: %T += %T", v, src)
+	}
+	switch typeof(v) {
+	case TInt:
+		return Integer(v.Value() + src.Value()), nil
+	case TChar:
+		return Character(v.Value() + src.Value()), nil
+	default:
+		return nil, faultf(FaultTypeMismatch, "add: unsupported values: %T += %T", v, src)
+	}
+}
+
+func subValues(v, src Immediate) (Immediate, error) {
+	if !calculable(v, src) {
+		return nil, faultf(FaultTypeMismatch, "sub: unsupported values: %T -= %T", v, src)
+	}
+	return Integer(v.Value() - src.Value()), nil
+}
+
+// runCompiled コンパイル済みの命令列を実行する
+// タイマー割り込みもプリエンプションもなければ基本ブロック単位でまとめて実行する
+func (r *Runtime) runCompiled() error {
+	if r.compileErr != nil {
+		return r.compileErr
+	}
+	perInstruction := 0 < r.config.TimerInterval || 0 < r.config.Scheduler.Quantum
+	for !r.halt {
+		pc := int(r.getSpecialReg(PC))
+		if perInstruction {
+			if err := r.step(); err != nil {
+				return r.runtimeError(err, pc)
+			}
+			continue
+		}
+		if pc, err := r.runBlock(); err != nil {
+			return r.runtimeError(err, pc)
+		}
+	}
+	return nil
+}
+
+// runBlock 現在のPCから基本ブロックの終わりまで実行する。エラーならその命令のPCも返す
+func (r *Runtime) runBlock() (int, error) {
+	pc := int(r.getSpecialReg(PC))
+	if err := r.pollInterrupts(); err != nil {
+		return pc, err
+	}
+	// 割り込みでPCが変わっているかもしれない
+	pc = int(r.getSpecialReg(PC))
+	if pc < 0 || len(r.compiled.blocks) <= pc || r.compiled.blocks[pc] == nil {
+		return pc, fmt.Errorf("unsupported code at pc %d", pc)
+	}
+	block := r.compiled.blocks[pc]
+	for i := r.compiled.index[pc]; i < len(block.ops); i++ {
+		if err := block.ops[i](r); err != nil {
+			if err := r.catchFault(err); err != nil {
+				return block.pcs[i], err
+			}
+			// ハンドラへ飛んだ
+			return 0, nil
+		}
+	}
+	return 0, nil
+}
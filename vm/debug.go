@@ -40,3 +40,19 @@ func DumpText(w io.Writer, program []Code) error {
 	}
 	return nil
 }
+
+// instructionAt pcの命令をオペランド付きで文字列にする
+func instructionAt(program []Code, pc int) string {
+	if pc < 0 || len(program) <= pc {
+		return fmt.Sprintf("<pc %d out of program>", pc)
+	}
+	op, ok := program[pc].(Opcode)
+	if !ok {
+		return program[pc].String()
+	}
+	s := op.String()
+	for j := 1; j <= op.NumOperands() && pc+j < len(program); j++ {
+		s += " " + program[pc+j].String()
+	}
+	return s
+}
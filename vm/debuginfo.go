@@ -0,0 +1,213 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SymbolKind デバッグ情報のシンボルの種類
+type SymbolKind int
+
+const (
+	// SymbolFunction 関数。Addr から Size 命令分がこの関数
+	SymbolFunction SymbolKind = iota
+	// SymbolLabel 関数の中のラベル
+	SymbolLabel
+	// SymbolData データ。Addr はヒープのアドレス、Size は要素数
+	SymbolData
+)
+
+func (k SymbolKind) String() string {
+	return []string{
+		SymbolFunction: "func",
+		SymbolLabel:    "label",
+		SymbolData:     "data",
+	}[k]
+}
+
+// DebugSymbol リンク後のシンボル
+type DebugSymbol struct {
+	Kind     SymbolKind
+	Name     string
+	Addr     int
+	Size     int
+	Exported bool
+	Imported bool
+	// Source 定義したファイル。リンカが足したものは空
+	Source string
+}
+
+// DebugInfo リンカが出力するシンボルとPCの対応表
+type DebugInfo struct {
+	Symbols []DebugSymbol
+}
+
+// debugInfoPrefix .mbyt に埋め込むときの行頭。コメントなので古いVMでも読み飛ばされる
+const debugInfoPrefix = ";@debug "
+
+// Function pcを含む関数を返す
+func (d *DebugInfo) Function(pc int) (DebugSymbol, bool) {
+	if d == nil {
+		return DebugSymbol{}, false
+	}
+	for _, sym := range d.Symbols {
+		if sym.Kind == SymbolFunction && sym.Addr <= pc && pc < sym.Addr+sym.Size {
+			return sym, true
+		}
+	}
+	return DebugSymbol{}, false
+}
+
+// Lookup 名前からシンボルを探す
+func (d *DebugInfo) Lookup(name string) (DebugSymbol, bool) {
+	if d == nil {
+		return DebugSymbol{}, false
+	}
+	for _, sym := range d.Symbols {
+		if sym.Name == name {
+			return sym, true
+		}
+	}
+	return DebugSymbol{}, false
+}
+
+// Describe pcを `pc 34 (_print+3)` の形にする
+func (d *DebugInfo) Describe(pc int) string {
+	if sym, ok := d.Function(pc); ok {
+		return fmt.Sprintf("pc %d (%s+%d)", pc, sym.Name, pc-sym.Addr)
+	}
+	return fmt.Sprintf("pc %d", pc)
+}
+
+// Sort 関数とラベルはPC順、データはアドレス順に並べる
+func (d *DebugInfo) Sort() {
+	sort.SliceStable(d.Symbols, func(i, j int) bool {
+		a, b := d.Symbols[i], d.Symbols[j]
+		if (a.Kind == SymbolData) != (b.Kind == SymbolData) {
+			return b.Kind == SymbolData
+		}
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// WriteDebugInfo .mbyt に埋め込める形で書き出す
+//
+//	;@debug func _start 2 20 export
+func WriteDebugInfo(w io.Writer, d *DebugInfo) error {
+	for _, sym := range d.Symbols {
+		line := fmt.Sprintf("%s%s %s %d %d", debugInfoPrefix, sym.Kind.String(), sym.Name, sym.Addr, sym.Size)
+		if sym.Exported {
+			line += " export"
+		}
+		if sym.Imported {
+			line += " import"
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseDebugInfo .mbyt に埋め込まれたデバッグ情報を読む。なければ空のDebugInfoを返す
+func ParseDebugInfo(text string) (*DebugInfo, error) {
+	d := &DebugInfo{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, debugInfoPrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, debugInfoPrefix))
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("debug info: broken line: %s", line)
+		}
+		var sym DebugSymbol
+		switch fields[0] {
+		case "func":
+			sym.Kind = SymbolFunction
+		case "label":
+			sym.Kind = SymbolLabel
+		case "data":
+			sym.Kind = SymbolData
+		default:
+			return nil, fmt.Errorf("debug info: unsupported kind: %s", fields[0])
+		}
+		sym.Name = fields[1]
+		addr, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("debug info: %s: %w", line, err)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("debug info: %s: %w", line, err)
+		}
+		sym.Addr, sym.Size = addr, size
+		for _, flag := range fields[4:] {
+			switch flag {
+			case "export":
+				sym.Exported = true
+			case "import":
+				sym.Imported = true
+			default:
+				return nil, fmt.Errorf("debug info: unsupported flag: %s", flag)
+			}
+		}
+		d.Symbols = append(d.Symbols, sym)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// RuntimeError Runが返すエラー。どこで起きたかと呼び出し元を持つ
+type RuntimeError struct {
+	Err    error
+	Thread int
+	PC     int
+	// Backtrace 呼び出し元のcall命令のPC。内側から順に並ぶ
+	Backtrace []int
+
+	debug   *DebugInfo
+	threads int
+}
+
+func (e *RuntimeError) Error() string {
+	var sb strings.Builder
+	if 1 < e.threads {
+		fmt.Fprintf(&sb, "thread %d: ", e.Thread)
+	}
+	fmt.Fprintf(&sb, "%s: %s", e.debug.Describe(e.PC), e.Err.Error())
+	for _, pc := range e.Backtrace {
+		fmt.Fprintf(&sb, "\n\tcalled from %s", e.debug.Describe(pc))
+	}
+	return sb.String()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// runtimeError errに実行中のスレッドの位置と呼び出し履歴をつける
+func (r *Runtime) runtimeError(err error, pc int) error {
+	backtrace := make([]int, 0, len(r.current.calls))
+	for i := len(r.current.calls) - 1; 0 <= i; i-- {
+		backtrace = append(backtrace, r.current.calls[i])
+	}
+	return &RuntimeError{
+		Err:       err,
+		Thread:    r.current.id,
+		PC:        pc,
+		Backtrace: backtrace,
+		debug:     r.config.Debug,
+		threads:   len(r.threads),
+	}
+}
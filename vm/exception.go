@@ -0,0 +1,71 @@
+package vm
+
+import "fmt"
+
+// handler tryで登録した例外ハンドラ
+type handler struct {
+	pc int
+	// try実行時のSP/BP。例外が起きたらここまで巻き戻す
+	sp int
+	bp int
+	// calls try実行時の呼び出しの深さ
+	calls int
+}
+
+// unwind 一番内側のハンドラまでスタックを巻き戻してジャンプする
+// ハンドラにはR0に投げられた値、R1にFaultCodeが入る
+func (r *Runtime) unwind(value Immediate, code FaultCode) error {
+	handlers := r.current.handlers
+	if len(handlers) == 0 {
+		return fmt.Errorf("uncaught exception: %v", value)
+	}
+	h := handlers[len(handlers)-1]
+	r.current.handlers = handlers[:len(handlers)-1]
+
+	// 巻き戻した範囲のスタックは捨てる
+	for addr := int(r.getSpecialReg(SP)); addr < h.sp; addr++ {
+		r.stack[addr-r.stackBase] = nil
+	}
+	r.current.calls = r.current.calls[:h.calls]
+	r.setSpecialReg(SP, Integer(h.sp))
+	r.setSpecialReg(BP, Integer(h.bp))
+	r.setSpecialReg(PC, Integer(h.pc))
+	r.setGeneralReg(R0, value)
+	r.setGeneralReg(R1, Integer(code))
+	return nil
+}
+
+// execExceptionOp 例外処理の命令
+func (r *Runtime) execExceptionOp(op Opcode) error {
+	pc := r.getSpecialReg(PC)
+	switch op {
+	case TRY:
+		dst := r.program[pc+1]
+		if _, ok := dst.(PcOffset); !ok {
+			return fmt.Errorf("try: unsupported dst: %s", dst.String())
+		}
+		r.current.handlers = append(r.current.handlers, handler{
+			pc:    int(pc) + int(dst.(PcOffset)),
+			sp:    int(r.getSpecialReg(SP)),
+			bp:    int(r.getSpecialReg(BP)),
+			calls: len(r.current.calls),
+		})
+		r.relocate(op)
+		return nil
+	case ENDTRY:
+		if len(r.current.handlers) == 0 {
+			return fmt.Errorf("endtry: no handler")
+		}
+		r.current.handlers = r.current.handlers[:len(r.current.handlers)-1]
+		r.relocate(op)
+		return nil
+	case THROW:
+		v, err := r.operandValue(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		return r.unwind(v, FaultNone)
+	default:
+		return fmt.Errorf("execExceptionOp: unsupported opcode: %s", op.String())
+	}
+}
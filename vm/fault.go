@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FaultCode VMの実行時エラーの種類。例外として捕まえたときにR1に入る
+type FaultCode int
+
+const (
+	// FaultNone throwで投げられた例外
+	FaultNone FaultCode = iota
+	FaultOutOfBounds
+	FaultStackOverflow
+	FaultStackUnderflow
+	FaultOutOfMemory
+	FaultTypeMismatch
+	FaultUndefined
+	FaultBadSyscall
+	FaultChannelClosed
+)
+
+func (c FaultCode) String() string {
+	return []string{
+		FaultNone:           "none",
+		FaultOutOfBounds:    "out of bounds",
+		FaultStackOverflow:  "stack overflow",
+		FaultStackUnderflow: "stack underflow",
+		FaultOutOfMemory:    "out of memory",
+		FaultTypeMismatch:   "type mismatch",
+		FaultUndefined:      "undefined value",
+		FaultBadSyscall:     "bad syscall",
+		FaultChannelClosed:  "channel closed",
+	}[c]
+}
+
+// Fault ゲストのプログラムが原因で起きた実行時エラー
+// Config.CatchFaults が true なら、ゲストの例外ハンドラで捕まえられる
+type Fault struct {
+	Code FaultCode
+	Err  error
+}
+
+func (f *Fault) Error() string {
+	return f.Err.Error()
+}
+
+func (f *Fault) Unwrap() error {
+	return f.Err
+}
+
+func faultf(code FaultCode, format string, args ...any) error {
+	return &Fault{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// faultCodeOf errがFaultならそのコードを返す
+func faultCodeOf(err error) (FaultCode, bool) {
+	var f *Fault
+	if errors.As(err, &f) {
+		return f.Code, true
+	}
+	return 0, false
+}
@@ -0,0 +1,181 @@
+package vm
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// InterruptTimer Config.TimerInterval 命令ごとに発生する割り込みの番号
+const InterruptTimer = 0
+
+// interruptFrame 割り込み時にスタックへ積むレジスタ。この順にpushし、iretで逆順にpopする
+// SPはpopし終わった位置に戻るので積まない。最後に割り込みを許可していたかを1/0で積む
+var interruptFrame = []Register{PC, ZF, BP, R0, R1, R2, R3, R4, R5, R6, R7, R8, R9, R10}
+
+// interrupts 割り込みの状態
+type interrupts struct {
+	// vectors 割り込み番号 -> ハンドラのPC
+	vectors map[int]int
+	// disabled trueの間は割り込みを受け付けない。ハンドラ実行中とcli〜stiの間
+	disabled bool
+	// ticks タイマー割り込みのための命令数
+	ticks int
+
+	// pending ホストから届いて、まだ処理していない割り込み
+	// Interrupt は他のgoroutineから呼ばれるのでロックする
+	mu         sync.Mutex
+	pending    []int
+	hasPending atomic.Bool
+}
+
+// Interrupt 割り込みnを発生させる。実行中の別のgoroutineから呼んでも良い
+// 割り込みが禁止されている間は保留され、ハンドラが登録されていない割り込みは捨てられる
+func (r *Runtime) Interrupt(n int) {
+	r.interrupts.mu.Lock()
+	defer r.interrupts.mu.Unlock()
+	r.interrupts.pending = append(r.interrupts.pending, n)
+	r.interrupts.hasPending.Store(true)
+}
+
+func (r *Runtime) nextInterrupt() (int, bool) {
+	if !r.interrupts.hasPending.Load() {
+		return 0, false
+	}
+	r.interrupts.mu.Lock()
+	defer r.interrupts.mu.Unlock()
+	if len(r.interrupts.pending) == 0 {
+		return 0, false
+	}
+	n := r.interrupts.pending[0]
+	r.interrupts.pending = r.interrupts.pending[1:]
+	r.interrupts.hasPending.Store(len(r.interrupts.pending) != 0)
+	return n, true
+}
+
+// tickTimer 1命令ごとに呼び、TimerInterval 命令ごとにタイマー割り込みを発生させる
+func (r *Runtime) tickTimer() {
+	interval := r.config.TimerInterval
+	if interval <= 0 {
+		return
+	}
+	// 禁止されている間は数えない。保留中のタイマー割り込みが溜まらないように
+	if r.interrupts.disabled {
+		return
+	}
+	r.interrupts.ticks++
+	if interval <= r.interrupts.ticks {
+		r.interrupts.ticks = 0
+		r.Interrupt(InterruptTimer)
+	}
+}
+
+// pollInterrupts 保留中の割り込みがあればハンドラへ入る
+func (r *Runtime) pollInterrupts() error {
+	for !r.interrupts.disabled {
+		n, ok := r.nextInterrupt()
+		if !ok {
+			return nil
+		}
+		if _, ok := r.interrupts.vectors[n]; !ok {
+			continue
+		}
+		return r.enterInterrupt(n, int(r.getSpecialReg(PC)))
+	}
+	return nil
+}
+
+// enterInterrupt レジスタをスタックに積んでハンドラへジャンプする。retPCはiretで戻る先
+func (r *Runtime) enterInterrupt(n, retPC int) error {
+	handler, ok := r.interrupts.vectors[n]
+	if !ok {
+		return fmt.Errorf("interrupt: no handler for interrupt %d", n)
+	}
+	r.setSpecialReg(PC, Integer(retPC))
+	for _, reg := range interruptFrame {
+		v, err := r.getReg(reg)
+		if err != nil {
+			return err
+		}
+		if err := r.pushToStack(v); err != nil {
+			return err
+		}
+	}
+	enabled := Integer(1)
+	if r.interrupts.disabled {
+		enabled = 0
+	}
+	if err := r.pushToStack(enabled); err != nil {
+		return err
+	}
+	r.interrupts.disabled = true
+	r.current.calls = append(r.current.calls, retPC)
+	r.setSpecialReg(PC, Integer(handler))
+	return nil
+}
+
+// execInterruptOp 割り込みの命令
+func (r *Runtime) execInterruptOp(op Opcode) error {
+	pc := r.getSpecialReg(PC)
+	switch op {
+	case SETVEC:
+		// setvec n handler
+		n, err := r.operandValue(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			return faultf(FaultUndefined, "setvec: undefined interrupt number")
+		}
+		dst := r.program[pc+2]
+		if _, ok := dst.(PcOffset); !ok {
+			return fmt.Errorf("setvec: unsupported dst: %s", dst.String())
+		}
+		r.interrupts.vectors[n.Value()] = int(pc) + int(dst.(PcOffset))
+		r.relocate(op)
+		return nil
+	case INT:
+		// ソフトウェア割り込み。禁止されていても即座にハンドラへ入る
+		n, err := r.operandValue(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			return faultf(FaultUndefined, "int: undefined interrupt number")
+		}
+		return r.enterInterrupt(n.Value(), int(pc)+op.NumOperands()+1)
+	case IRET:
+		enabled, err := r.popFromStack()
+		if err != nil {
+			return err
+		}
+		if _, ok := enabled.(Integer); !ok {
+			return fmt.Errorf("iret: broken frame: interrupt flag = %v", enabled)
+		}
+		for i := len(interruptFrame) - 1; 0 <= i; i-- {
+			v, err := r.popFromStack()
+			if err != nil {
+				return err
+			}
+			if err := r.setReg(interruptFrame[i], v); err != nil {
+				return fmt.Errorf("iret: broken frame: %w", err)
+			}
+		}
+		// 割り込む前の許可/禁止に戻す
+		r.interrupts.disabled = enabled.(Integer) == 0
+		if n := len(r.current.calls); 0 < n {
+			r.current.calls = r.current.calls[:n-1]
+		}
+		return nil
+	case CLI:
+		r.interrupts.disabled = true
+		r.relocate(op)
+		return nil
+	case STI:
+		r.interrupts.disabled = false
+		r.relocate(op)
+		return nil
+	default:
+		return fmt.Errorf("execInterruptOp: unsupported opcode: %s", op.String())
+	}
+}
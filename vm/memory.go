@@ -0,0 +1,207 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MemoryModel ヒープの表現方法
+type MemoryModel int
+
+const (
+	// CellMemory 1セルに型付きの値を1つ保持する
+	CellMemory MemoryModel = iota
+	// ByteMemory リトルエンディアンのフラットなバイト列
+	ByteMemory
+)
+
+func (m MemoryModel) String() string {
+	return []string{
+		CellMemory: "cell",
+		ByteMemory: "byte",
+	}[m]
+}
+
+// ParseMemoryModel "cell" / "byte" を MemoryModel に変換する
+func ParseMemoryModel(s string) (MemoryModel, error) {
+	switch s {
+	case "", "cell":
+		return CellMemory, nil
+	case "byte":
+		return ByteMemory, nil
+	default:
+		return 0, fmt.Errorf("unsupported memory model: %s", s)
+	}
+}
+
+// memory ヒープの読み書き
+// width はバイト数(1, 2, 4, 8)で、0 は1セル(ByteMemoryでは1バイト)を表す
+type memory interface {
+	len() int
+	load(addr, width int) (Immediate, error)
+	store(addr, width int, imm Immediate) error
+	readBytes(addr, length int) ([]byte, error)
+	writeBytes(addr int, data []byte) error
+	// grow 中身をコピーしてsizeに広げたものを返す
+	grow(size int) memory
+}
+
+func newMemory(model MemoryModel, size int) memory {
+	switch model {
+	case ByteMemory:
+		return make(byteMemory, size)
+	default:
+		return make(cellMemory, size)
+	}
+}
+
+// truncate 値を下位 width バイトに切り詰める
+func truncate(v, width int) int {
+	if width <= 0 || width >= 8 {
+		return v
+	}
+	return v & (1<<(8*width) - 1)
+}
+
+type cellMemory []Immediate
+
+func (m cellMemory) len() int {
+	return len(m)
+}
+
+func (m cellMemory) grow(size int) memory {
+	grown := make(cellMemory, size)
+	copy(grown, m)
+	return grown
+}
+
+func (m cellMemory) load(addr, width int) (Immediate, error) {
+	if addr < 0 || len(m) <= addr {
+		return nil, faultf(FaultOutOfBounds, "load: out of bounds: %d", addr)
+	}
+	cell := m[addr]
+	if width == 0 {
+		return cell, nil
+	}
+	// nil は 0 とみなす
+	if cell == nil {
+		return Integer(0), nil
+	}
+	return Integer(truncate(cell.Value(), width)), nil
+}
+
+func (m cellMemory) store(addr, width int, imm Immediate) error {
+	if addr < 0 || len(m) <= addr {
+		return faultf(FaultOutOfBounds, "store: out of bounds: %d", addr)
+	}
+	if width == 0 {
+		m[addr] = imm
+		return nil
+	}
+	if imm == nil {
+		return faultf(FaultUndefined, "store: undefined value")
+	}
+	m[addr] = Integer(truncate(imm.Value(), width))
+	return nil
+}
+
+func (m cellMemory) readBytes(addr, length int) ([]byte, error) {
+	buf := make([]byte, 0, length)
+	for i := range length {
+		cell, err := m.load(addr+i, 0)
+		if err != nil {
+			return nil, err
+		}
+		// nil は 0 とみなす
+		var b byte
+		if cell == nil {
+			b = 0
+		} else {
+			b = byte(rune(cell.Value()))
+		}
+		// ヌル終端で停止
+		if b == 0 {
+			break
+		}
+		buf = append(buf, b)
+	}
+	return buf, nil
+}
+
+func (m cellMemory) writeBytes(addr int, data []byte) error {
+	for i, b := range data {
+		// ヌル終端で停止
+		if b == 0 {
+			break
+		}
+		if err := m.store(addr+i, 0, Character(int(b))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type byteMemory []byte
+
+func (m byteMemory) len() int {
+	return len(m)
+}
+
+func (m byteMemory) grow(size int) memory {
+	grown := make(byteMemory, size)
+	copy(grown, m)
+	return grown
+}
+
+func (m byteMemory) bounds(addr, width int) error {
+	if addr < 0 || width < 0 || len(m) < addr+width {
+		return faultf(FaultOutOfBounds, "out of bounds: %d..%d", addr, addr+width)
+	}
+	return nil
+}
+
+func (m byteMemory) load(addr, width int) (Immediate, error) {
+	if width == 0 {
+		width = 1
+	}
+	if err := m.bounds(addr, width); err != nil {
+		return nil, fmt.Errorf("load: %w", err)
+	}
+	var buf [8]byte
+	copy(buf[:], m[addr:addr+width])
+	return Integer(int(binary.LittleEndian.Uint64(buf[:]))), nil
+}
+
+func (m byteMemory) store(addr, width int, imm Immediate) error {
+	if width == 0 {
+		width = 1
+	}
+	if err := m.bounds(addr, width); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if imm == nil {
+		return faultf(FaultUndefined, "store: undefined value")
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(imm.Value()))
+	copy(m[addr:addr+width], buf[:width])
+	return nil
+}
+
+// readBytes バイナリをそのまま扱うため、ヌル終端では停止しない
+func (m byteMemory) readBytes(addr, length int) ([]byte, error) {
+	if err := m.bounds(addr, length); err != nil {
+		return nil, fmt.Errorf("readBytes: %w", err)
+	}
+	buf := make([]byte, length)
+	copy(buf, m[addr:addr+length])
+	return buf, nil
+}
+
+func (m byteMemory) writeBytes(addr int, data []byte) error {
+	if err := m.bounds(addr, len(data)); err != nil {
+		return fmt.Errorf("writeBytes: %w", err)
+	}
+	copy(m[addr:], data)
+	return nil
+}
@@ -14,9 +14,24 @@ const (
 	STORE
 	LOAD
 
+	STORE8
+	STORE16
+	STORE32
+	STORE64
+	LOAD8
+	LOAD16
+	LOAD32
+	LOAD64
+
+	LEA
+
 	CALL
 	RET
 
+	ENTER
+	LEAVE
+	TAILCALL
+
 	JMP
 	JZ
 	JNZ
@@ -29,6 +44,37 @@ const (
 	LT
 	LE
 
+	SADD
+	SSUB
+	SEQ
+	SNE
+	SLT
+	SLE
+	DUP
+	SWAP
+	OVER
+	DROP
+	ROT
+	SPAWN
+	YIELD
+	JOIN
+	TEXIT
+	CHAN
+	SEND
+	RECV
+	CLOSE
+	LOCK
+	UNLOCK
+	CAS
+	TRY
+	ENDTRY
+	THROW
+	SETVEC
+	INT
+	IRET
+	CLI
+	STI
+
 	SYSCALL
 )
 
@@ -36,48 +82,148 @@ func (o Opcode) isCode() {}
 
 func (o Opcode) String() string {
 	return []string{
-		NOP:     "nop",
-		MOV:     "mov",
-		PUSH:    "push",
-		POP:     "pop",
-		ALLOC:   "alloc",
-		STORE:   "store",
-		LOAD:    "load",
-		CALL:    "call",
-		RET:     "ret",
-		JMP:     "jmp",
-		JZ:      "jz",
-		JNZ:     "jnz",
-		ADD:     "add",
-		SUB:     "sub",
-		EQ:      "eq",
-		NE:      "ne",
-		LT:      "lt",
-		LE:      "le",
-		SYSCALL: "syscall",
+		NOP:      "nop",
+		MOV:      "mov",
+		PUSH:     "push",
+		POP:      "pop",
+		ALLOC:    "alloc",
+		STORE:    "store",
+		LOAD:     "load",
+		STORE8:   "store8",
+		STORE16:  "store16",
+		STORE32:  "store32",
+		STORE64:  "store64",
+		LOAD8:    "load8",
+		LOAD16:   "load16",
+		LOAD32:   "load32",
+		LOAD64:   "load64",
+		LEA:      "lea",
+		CALL:     "call",
+		RET:      "ret",
+		ENTER:    "enter",
+		LEAVE:    "leave",
+		TAILCALL: "tailcall",
+		JMP:      "jmp",
+		JZ:       "jz",
+		JNZ:      "jnz",
+		ADD:      "add",
+		SUB:      "sub",
+		EQ:       "eq",
+		NE:       "ne",
+		LT:       "lt",
+		LE:       "le",
+		SADD:     "sadd",
+		SSUB:     "ssub",
+		SEQ:      "seq",
+		SNE:      "sne",
+		SLT:      "slt",
+		SLE:      "sle",
+		DUP:      "dup",
+		SWAP:     "swap",
+		OVER:     "over",
+		DROP:     "drop",
+		ROT:      "rot",
+		SPAWN:    "spawn",
+		YIELD:    "yield",
+		JOIN:     "join",
+		TEXIT:    "texit",
+		CHAN:     "chan",
+		SEND:     "send",
+		RECV:     "recv",
+		CLOSE:    "close",
+		LOCK:     "lock",
+		UNLOCK:   "unlock",
+		CAS:      "cas",
+		TRY:      "try",
+		ENDTRY:   "endtry",
+		THROW:    "throw",
+		SETVEC:   "setvec",
+		INT:      "int",
+		IRET:     "iret",
+		CLI:      "cli",
+		STI:      "sti",
+		SYSCALL:  "syscall",
 	}[o]
 }
 
 func (o Opcode) NumOperands() int {
 	return []int{
-		NOP:     0,
-		MOV:     2,
-		PUSH:    1,
-		POP:     1,
-		ALLOC:   1,
-		STORE:   2,
-		LOAD:    2,
-		CALL:    1,
-		RET:     0,
-		JMP:     1,
-		JZ:      1,
-		JNZ:     1,
-		ADD:     2,
-		SUB:     2,
-		EQ:      2,
-		NE:      2,
-		LT:      2,
-		LE:      2,
-		SYSCALL: 0,
+		NOP:      0,
+		MOV:      2,
+		PUSH:     1,
+		POP:      1,
+		ALLOC:    1,
+		STORE:    2,
+		LOAD:     2,
+		STORE8:   2,
+		STORE16:  2,
+		STORE32:  2,
+		STORE64:  2,
+		LOAD8:    2,
+		LOAD16:   2,
+		LOAD32:   2,
+		LOAD64:   2,
+		LEA:      2,
+		CALL:     1,
+		RET:      0,
+		ENTER:    1,
+		LEAVE:    0,
+		TAILCALL: 1,
+		JMP:      1,
+		JZ:       1,
+		JNZ:      1,
+		ADD:      2,
+		SUB:      2,
+		EQ:       2,
+		NE:       2,
+		LT:       2,
+		LE:       2,
+		SADD:     0,
+		SSUB:     0,
+		SEQ:      0,
+		SNE:      0,
+		SLT:      0,
+		SLE:      0,
+		DUP:      0,
+		SWAP:     0,
+		OVER:     0,
+		DROP:     0,
+		ROT:      0,
+		SPAWN:    1,
+		YIELD:    0,
+		JOIN:     1,
+		TEXIT:    0,
+		CHAN:     1,
+		SEND:     2,
+		RECV:     2,
+		CLOSE:    1,
+		LOCK:     1,
+		UNLOCK:   1,
+		CAS:      2,
+		TRY:      1,
+		ENDTRY:   0,
+		THROW:    1,
+		SETVEC:   2,
+		INT:      1,
+		IRET:     0,
+		CLI:      0,
+		STI:      0,
+		SYSCALL:  0,
 	}[o]
 }
+
+// width LOAD/STORE系命令が一度に扱うバイト数。0は1セル
+func (o Opcode) width() int {
+	switch o {
+	case STORE8, LOAD8:
+		return 1
+	case STORE16, LOAD16:
+		return 2
+	case STORE32, LOAD32:
+		return 4
+	case STORE64, LOAD64:
+		return 8
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Resources プログラムが必要とするスタックとヒープの大きさ。0は指定なし
+type Resources struct {
+	StackSize int
+	HeapSize  int
+}
+
+// DefaultStackSize / DefaultHeapSize どちらも指定がないときの大きさ
+const (
+	DefaultStackSize = 100
+	DefaultHeapSize  = 100
+)
+
+// .mbyt に埋め込むときの行頭。;@debug と同じくコメントなので古いVMでも読み飛ばされる
+const (
+	stackSizePrefix = ";@stack "
+	heapSizePrefix  = ";@heap "
+)
+
+// WriteResources .mbyt の先頭に置ける形で書き出す。指定のないものは書かない
+//
+//	;@stack 32768
+//	;@heap 131072
+func WriteResources(w io.Writer, r Resources) error {
+	if r.StackSize > 0 {
+		if _, err := fmt.Fprintf(w, "%s%d\n", stackSizePrefix, r.StackSize); err != nil {
+			return err
+		}
+	}
+	if r.HeapSize > 0 {
+		if _, err := fmt.Fprintf(w, "%s%d\n", heapSizePrefix, r.HeapSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseResources .mbyt に書かれた ;@stack / ;@heap を読む。なければ0のまま
+func ParseResources(text string) (Resources, error) {
+	var r Resources
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var dst *int
+		var rest string
+		switch {
+		case strings.HasPrefix(line, stackSizePrefix):
+			dst, rest = &r.StackSize, strings.TrimPrefix(line, stackSizePrefix)
+		case strings.HasPrefix(line, heapSizePrefix):
+			dst, rest = &r.HeapSize, strings.TrimPrefix(line, heapSizePrefix)
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(rest))
+		if err != nil || n <= 0 {
+			return Resources{}, fmt.Errorf("resources: broken line: %s", line)
+		}
+		*dst = n
+	}
+	if err := scanner.Err(); err != nil {
+		return Resources{}, err
+	}
+	return r, nil
+}
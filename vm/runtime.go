@@ -3,87 +3,121 @@ package vm
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 )
 
 type Config struct {
 	StackSize int
 	HeapSize  int
+	// StackLimit / HeapLimit StackSize/HeapSizeより大きければ、足りなくなったときにこの大きさまで広げる
+	// アドレスは上限の大きさで割り当てるので、広げてもSP/BPやヒープのアドレスは変わらない
+	StackLimit int
+	HeapLimit  int
+	Memory     MemoryModel
+	Scheduler  SchedulerConfig
+	// CatchFaults true ならFaultを例外としてゲストのハンドラに渡す
+	CatchFaults bool
+	// TimerInterval 0より大きければ、この命令数ごとにタイマー割り込みを発生させる
+	TimerInterval int
+	// Debug リンカが出力したデバッグ情報。エラーのPCを関数名で表示する
+	Debug *DebugInfo
+	// Engine 命令列の実行方法
+	Engine Engine
 
-	stdin  io.Reader
-	stdout io.Writer
-	stderr io.Writer
+	// Stdin / Stdout / Stderr システムコールが使う入出力。nilならプロセスのものを使う
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// stackLimit / heapLimit 広げられる上限。指定がなければ初期の大きさのまま
+func (c *Config) stackLimit() int {
+	return max(c.StackSize, c.StackLimit)
+}
+func (c *Config) heapLimit() int {
+	return max(c.HeapSize, c.HeapLimit)
 }
 
+// registerSet レジスタ番号で引く配列。0番は使わない
 type registerSet struct {
-	specials map[SpecialRegister]int
-	generals map[GeneralPurposeRegister]Immediate
-	flags    map[FlagRegister]bool
+	specials [HP + 1]int
+	generals [R10 + 1]Immediate
+	flags    [ZF + 1]bool
 }
 
 type Runtime struct {
+	config    Config
 	program   []Code
-	registers registerSet
-	stack     []Immediate
-	heap      []Immediate
+	registers *registerSet
+	stack     cellMemory
+	heap      memory
 	halt      bool
 
+	// stackBase スタック領域の先頭アドレス
+	// アドレス空間は [0, heapLimit) がヒープ、[heapLimit, heapLimit+stackLimit) がメインスレッドのスタック
+	// spawnしたスレッドのスタックはその後ろにstackLimitずつ並ぶ
+	// スタックは末尾(SPの初期値)を揃えて確保するので、広げると stackBase が小さくなる
+	stackBase int
+
+	// threads IDの順に並んだ全スレッド。current が実行中のスレッド
+	threads []*thread
+	current *thread
+	// ticks current が連続して実行した命令数
+	ticks int
+	rand  *rand.Rand
+
+	channels []*channel
+	// mutexes ロックされているmutexのアドレスと、持っているスレッドのID
+	mutexes map[int]int
+
+	interrupts interrupts
+
+	// compiled Engine が EngineCompiled のときの変換済みの命令列
+	compiled   *compiledProgram
+	compileErr error
+
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
 }
 
 func NewRuntime(program []Code, config *Config) *Runtime {
-	regs := registerSet{
-		specials: map[SpecialRegister]int{
-			PC: 0,
-			BP: 0,
-			SP: config.StackSize,
-			HP: 0,
-		},
-		generals: map[GeneralPurposeRegister]Immediate{
-			R0:  nil,
-			R1:  nil,
-			R2:  nil,
-			R3:  nil,
-			R4:  nil,
-			R5:  nil,
-			R6:  nil,
-			R7:  nil,
-			R8:  nil,
-			R9:  nil,
-			R10: nil,
-		},
-		flags: map[FlagRegister]bool{
-			ZF: false,
-		},
-	}
+	main := newThread(0, config.heapLimit(), config.StackSize, config.stackLimit())
 
 	// fds
 	var stdin io.Reader = os.Stdin
 	var stdout io.Writer = os.Stdout
 	var stderr io.Writer = os.Stderr
-	if config.stdin != nil {
-		stdin = config.stdin
+	if config.Stdin != nil {
+		stdin = config.Stdin
 	}
-	if config.stdout != nil {
-		stdout = config.stdout
+	if config.Stdout != nil {
+		stdout = config.Stdout
 	}
-	if config.stderr != nil {
-		stderr = config.stderr
+	if config.Stderr != nil {
+		stderr = config.Stderr
 	}
 
-	return &Runtime{
-		program:   program,
-		registers: regs,
-		stack:     make([]Immediate, config.StackSize),
-		heap:      make([]Immediate, config.HeapSize),
-		halt:      false,
+	r := &Runtime{
+		config:  *config,
+		program: program,
+		heap:    newMemory(config.Memory, config.HeapSize),
+		halt:    false,
+		threads: []*thread{main},
+		mutexes: map[int]int{},
+		rand:    newScheduleRand(config.Scheduler),
 
 		stdin:  stdin,
 		stdout: stdout,
 		stderr: stderr,
 	}
+	r.interrupts.vectors = map[int]int{}
+	r.switchTo(main)
+	if config.Engine == EngineCompiled {
+		r.compiled, r.compileErr = compile(program)
+	}
+	return r
 }
 
 // Register操作
@@ -143,119 +177,223 @@ func (r *Runtime) setReg(reg Register, imm Immediate) error {
 }
 
 // Stack操作
-func (r *Runtime) getStack(offset Offset) (Immediate, error) {
+func (r *Runtime) stackAddress(offset Offset) (int, error) {
 	switch offset.(type) {
 	case BpOffset:
-		curt := int(r.getSpecialReg(BP))
-		diff := int(offset.(BpOffset))
-		return r.stack[curt+diff], nil
+		return int(r.getSpecialReg(BP)) + int(offset.(BpOffset)), nil
 	case SpOffset:
-		curt := int(r.getSpecialReg(SP))
-		diff := int(offset.(SpOffset))
-		return r.stack[curt+diff], nil
+		return int(r.getSpecialReg(SP)) + int(offset.(SpOffset)), nil
 	default:
-		return nil, fmt.Errorf("getValueFromOffset: unsupported offset: %s", offset.String())
+		return 0, fmt.Errorf("stackAddress: unsupported offset: %s", offset.String())
 	}
 }
 
+func (r *Runtime) getStack(offset Offset) (Immediate, error) {
+	addr, err := r.stackAddress(offset)
+	if err != nil {
+		return nil, err
+	}
+	// 確保していない範囲なら広げる。広げられなければloadが範囲外を返す
+	r.reserveStack(r.current, addr)
+	v, err := r.stack.load(addr-r.stackBase, 0)
+	if err != nil {
+		return nil, fmt.Errorf("getStack: %s: %w", offset.String(), err)
+	}
+	return v, nil
+}
+
 func (r *Runtime) setStack(offset Offset, imm Immediate) error {
-	switch offset.(type) {
-	case BpOffset:
-		curt := int(r.getSpecialReg(BP))
-		diff := int(offset.(BpOffset))
-		r.stack[curt+diff] = imm
-		return nil
-	case SpOffset:
-		curt := int(r.getSpecialReg(SP))
-		diff := int(offset.(SpOffset))
-		r.stack[curt+diff] = imm
-		return nil
-	default:
-		return fmt.Errorf("setStackValue: unsupported offset: %s", offset.String())
+	addr, err := r.stackAddress(offset)
+	if err != nil {
+		return err
 	}
+	r.reserveStack(r.current, addr)
+	if err := r.stack.store(addr-r.stackBase, 0, imm); err != nil {
+		return fmt.Errorf("setStack: %s: %w", offset.String(), err)
+	}
+	return nil
 }
 
 func (r *Runtime) pushToStack(imm Immediate) error {
 	r.setSpecialReg(SP, r.getSpecialReg(SP)-1)
-	if r.getSpecialReg(SP) < 0 {
-		return fmt.Errorf("pushToStack: stack overflow")
+	if !r.reserveStack(r.current, int(r.getSpecialReg(SP))) {
+		return faultf(FaultStackOverflow, "pushToStack: stack overflow")
 	}
-	r.stack[r.getSpecialReg(SP)] = imm
+	if r.stackBase+len(r.stack) <= int(r.getSpecialReg(SP)) {
+		return faultf(FaultOutOfBounds, "pushToStack: sp is out of stack: %d", r.getSpecialReg(SP)+1)
+	}
+	r.stack[int(r.getSpecialReg(SP))-r.stackBase] = imm
 	return nil
 }
 func (r *Runtime) popFromStack() (Immediate, error) {
-	sp := r.getSpecialReg(SP)
-	if len(r.stack) <= int(sp) {
-		return nil, fmt.Errorf("popFromStack: stack underflow")
+	sp := int(r.getSpecialReg(SP))
+	if r.stackBase+len(r.stack) <= sp {
+		return nil, faultf(FaultStackUnderflow, "popFromStack: stack underflow")
+	}
+	if sp < r.stackBase {
+		return nil, faultf(FaultOutOfBounds, "popFromStack: sp is out of stack: %d", sp)
 	}
-	v := r.stack[sp]
-	r.stack[sp] = nil
-	r.setSpecialReg(SP, sp+1)
+	v := r.stack[sp-r.stackBase]
+	r.stack[sp-r.stackBase] = nil
+	r.setSpecialReg(SP, Integer(sp+1))
 	return v, nil
 }
 
+// reserveStack tのスタックをaddrまで使えるようにする。上限を超えるならfalse
+// 中身を末尾に揃えてコピーするので、確保済みの位置のアドレスは変わらない
+func (r *Runtime) reserveStack(t *thread, addr int) bool {
+	if t.stackBase <= addr {
+		return true
+	}
+	if addr < t.stackFloor {
+		return false
+	}
+	top := t.stackBase + len(t.stack)
+	size := min(max(top-addr, 2*len(t.stack)), top-t.stackFloor)
+	grown := make(cellMemory, size)
+	copy(grown[size-len(t.stack):], t.stack)
+	t.stack = grown
+	t.stackBase = top - size
+	if t == r.current {
+		r.stack = t.stack
+		r.stackBase = t.stackBase
+	}
+	return true
+}
+
 // heap操作
 func (r *Runtime) reserveHeap(size int) (Immediate, error) {
-	if len(r.heap) <= int(r.getSpecialReg(HP))+size {
-		return nil, fmt.Errorf("reserveHeap: out of memory")
+	// HPの次の1セルまで確保されている必要がある
+	need := int(r.getSpecialReg(HP)) + size + 1
+	if r.heap.len() < need {
+		limit := r.config.heapLimit()
+		if limit < need {
+			return nil, faultf(FaultOutOfMemory, "reserveHeap: out of memory")
+		}
+		r.heap = r.heap.grow(min(max(need, 2*r.heap.len()), limit))
 	}
 	baseAddr := r.getSpecialReg(HP)
 	r.setSpecialReg(HP, r.getSpecialReg(HP)+Integer(size))
 	return baseAddr, nil
 }
-func (r *Runtime) setHeap(heapAddr int, imm Immediate) error {
-	if heapAddr < 0 || len(r.heap) <= heapAddr {
-		return fmt.Errorf("setHeap: out of bounds")
+
+// region アドレスが属する領域と、領域内でのアドレスを返す
+func (r *Runtime) region(addr int) (memory, int) {
+	if r.stackBase <= addr && addr < r.stackBase+len(r.stack) {
+		return r.stack, addr - r.stackBase
+	}
+	// 他のスレッドのスタック。確保していない範囲なら広げる
+	for _, t := range r.threads {
+		if t.stackFloor <= addr && addr < t.stackBase+len(t.stack) {
+			r.reserveStack(t, addr)
+			return t.stack, addr - t.stackBase
+		}
+	}
+	return r.heap, addr
+}
+
+// sizedOnStack byte でもスタックはセル単位なので、サイズ指定の読み書きはできない
+func (r *Runtime) sizedOnStack(m memory, width int) error {
+	if _, ok := m.(cellMemory); ok && width > 0 && r.config.Memory == ByteMemory {
+		return faultf(FaultOutOfBounds, "sized access to stack address")
+	}
+	return nil
+}
+
+// setMemory / getMemory ヒープとスタックを区別せずwidthバイト単位で読み書きする。0は1セル
+func (r *Runtime) setMemory(addr, width int, imm Immediate) error {
+	m, local := r.region(addr)
+	if err := r.sizedOnStack(m, width); err != nil {
+		return fmt.Errorf("setMemory: %w", err)
+	}
+	if err := m.store(local, width, imm); err != nil {
+		return fmt.Errorf("setMemory: %w", err)
 	}
-	r.heap[heapAddr] = imm
 	return nil
 }
-func (r *Runtime) getHeap(heapAddr int) (Immediate, error) {
-	if heapAddr < 0 || len(r.heap) <= heapAddr {
-		return nil, fmt.Errorf("getHeap: out of bounds")
+func (r *Runtime) getMemory(addr, width int) (Immediate, error) {
+	m, local := r.region(addr)
+	if err := r.sizedOnStack(m, width); err != nil {
+		return nil, fmt.Errorf("getMemory: %w", err)
+	}
+	v, err := m.load(local, width)
+	if err != nil {
+		return nil, fmt.Errorf("getMemory: %w", err)
 	}
-	return r.heap[heapAddr], nil
+	return v, nil
 }
 
-func (r *Runtime) readHeapBytes(addr, length int) ([]byte, error) {
-	if addr < 0 || length < 0 {
-		return nil, fmt.Errorf("readHeapBytes: invalid args")
+// effectiveAddress [r1+4] / [r1+r2*4] の指すアドレスを計算する
+func (r *Runtime) effectiveAddress(addr Address) (int, error) {
+	value := func(reg GeneralPurposeRegister) (int, error) {
+		v := r.getGeneralReg(reg)
+		if v == nil {
+			return 0, faultf(FaultUndefined, "effectiveAddress: undefined register: %s", reg.String())
+		}
+		return v.Value(), nil
 	}
-	buf := make([]byte, 0, length)
-	for i := range length {
-		cell, err := r.getHeap(addr + i)
+	switch addr := addr.(type) {
+	case RegisterOffset:
+		base, err := value(addr.Base)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		// nil は 0 とみなす
-		var b byte
-		if cell == nil {
-			b = 0
-		} else {
-			b = byte(rune(cell.Value()))
+		return base + addr.Disp, nil
+	case IndexedOffset:
+		base, err := value(addr.Base)
+		if err != nil {
+			return 0, err
 		}
-		// ヌル終端で停止
-		if b == 0 {
-			break
+		index, err := value(addr.Index)
+		if err != nil {
+			return 0, err
 		}
-		buf = append(buf, b)
+		return base + index*addr.Scale, nil
+	default:
+		return 0, fmt.Errorf("effectiveAddress: unsupported address: %s", addr.String())
+	}
+}
+
+func (r *Runtime) readHeapBytes(addr, length int) ([]byte, error) {
+	if addr < 0 || length < 0 {
+		return nil, faultf(FaultOutOfBounds, "readHeapBytes: invalid args")
 	}
-	return buf, nil
+	m, local := r.region(addr)
+	return m.readBytes(local, length)
 }
 
 func (r *Runtime) writeHeapBytes(addr int, data []byte) error {
 	if addr < 0 {
-		return fmt.Errorf("writeHeapBytes: invalid addr")
+		return faultf(FaultOutOfBounds, "writeHeapBytes: invalid addr")
 	}
-	for i, b := range data {
-		// ヌル終端で停止
-		if b == 0 {
-			break
-		}
-		if err := r.setHeap(addr+i, Character(int(b))); err != nil {
-			return err
+	m, local := r.region(addr)
+	return m.writeBytes(local, data)
+}
+
+// syscallArgs システムコールの引数のレジスタを読む
+func (r *Runtime) syscallArgs(regs ...GeneralPurposeRegister) ([]int, error) {
+	args := make([]int, len(regs))
+	for i, reg := range regs {
+		v := r.getGeneralReg(reg)
+		if v == nil {
+			return nil, faultf(FaultUndefined, "syscall: undefined argument: %s", reg.String())
 		}
+		args[i] = v.Value()
+	}
+	return args, nil
+}
+
+// leave mov sp bp; pop bp
+func (r *Runtime) leave() error {
+	r.setSpecialReg(SP, r.getSpecialReg(BP))
+	bp, err := r.popFromStack()
+	if err != nil {
+		return err
 	}
+	if _, ok := bp.(Integer); !ok {
+		return fmt.Errorf("leave: broken frame: %v", bp)
+	}
+	r.setSpecialReg(BP, bp.(Integer))
 	return nil
 }
 
@@ -288,6 +426,16 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				srcValue = v
+			case Address:
+				addr, err := r.effectiveAddress(src.(Address))
+				if err != nil {
+					return err
+				}
+				v, err := r.getMemory(addr, 0)
+				if err != nil {
+					return err
+				}
+				srcValue = v
 			case Immediate:
 				srcValue = src.(Immediate)
 			default:
@@ -299,6 +447,12 @@ func (r *Runtime) exec() error {
 				return r.setReg(dst.(Register), srcValue)
 			case Offset:
 				return r.setStack(dst.(Offset), srcValue)
+			case Address:
+				addr, err := r.effectiveAddress(dst.(Address))
+				if err != nil {
+					return err
+				}
+				return r.setMemory(addr, 0, srcValue)
 			default:
 				return fmt.Errorf("mov: unsupported dst: %s", dst.String())
 			}
@@ -367,7 +521,7 @@ func (r *Runtime) exec() error {
 				return err
 			}
 			return r.pushToStack(baseAddr)
-		case STORE:
+		case STORE, STORE8, STORE16, STORE32, STORE64:
 			defer func() { r.relocate(code) }()
 			dst := r.program[r.getSpecialReg(PC)+1]
 			src := r.program[r.getSpecialReg(PC)+2]
@@ -386,10 +540,20 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				srcValue = v
+			case Address:
+				addr, err := r.effectiveAddress(src.(Address))
+				if err != nil {
+					return err
+				}
+				v, err := r.getMemory(addr, code.width())
+				if err != nil {
+					return err
+				}
+				srcValue = v
 			case Immediate:
 				srcValue = src.(Immediate)
 			default:
-				return fmt.Errorf("store: unsupported src: %s", src.String())
+				return fmt.Errorf("%s: unsupported src: %s", code.String(), src.String())
 			}
 
 			switch dst.(type) {
@@ -399,27 +563,33 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				if _, ok := addr.(Integer); !ok {
-					return fmt.Errorf("store: unsupported dst: %s", dst.String())
+					return fmt.Errorf("%s: unsupported dst: %s", code.String(), dst.String())
 				}
-				return r.setHeap(int(addr.(Integer)), srcValue)
+				return r.setMemory(int(addr.(Integer)), code.width(), srcValue)
 			case Offset:
 				offset, err := r.getStack(dst.(Offset))
 				if err != nil {
 					return err
 				}
 				if _, ok := offset.(Integer); !ok {
-					return fmt.Errorf("store: unsupported dst: %s", dst.String())
+					return fmt.Errorf("%s: unsupported dst: %s", code.String(), dst.String())
+				}
+				return r.setMemory(int(offset.(Integer)), code.width(), srcValue)
+			case Address:
+				addr, err := r.effectiveAddress(dst.(Address))
+				if err != nil {
+					return err
 				}
-				return r.setHeap(int(offset.(Integer)), srcValue)
+				return r.setMemory(addr, code.width(), srcValue)
 			case Immediate:
 				if _, ok := dst.(Integer); !ok {
-					return fmt.Errorf("store: unsupported dst: %s", dst.String())
+					return fmt.Errorf("%s: unsupported dst: %s", code.String(), dst.String())
 				}
-				return r.setHeap(int(dst.(Integer)), srcValue)
+				return r.setMemory(int(dst.(Integer)), code.width(), srcValue)
 			default:
-				return fmt.Errorf("store: unsupported dst: %s", dst.String())
+				return fmt.Errorf("%s: unsupported dst: %s", code.String(), dst.String())
 			}
-		case LOAD:
+		case LOAD, LOAD8, LOAD16, LOAD32, LOAD64:
 			defer func() { r.relocate(code) }()
 			dst := r.program[r.getSpecialReg(PC)+1]
 			src := r.program[r.getSpecialReg(PC)+2]
@@ -438,13 +608,20 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				srcValue = v
+			case Address:
+				// アドレスそのものを使う
+				addr, err := r.effectiveAddress(src.(Address))
+				if err != nil {
+					return err
+				}
+				srcValue = Integer(addr)
 			case Immediate:
 				srcValue = src.(Immediate)
 			default:
-				return fmt.Errorf("load: unsupported src: %s", src.String())
+				return fmt.Errorf("%s: unsupported src: %s", code.String(), src.String())
 			}
 
-			v, err := r.getHeap(srcValue.Value())
+			v, err := r.getMemory(srcValue.Value(), code.width())
 			if err != nil {
 				return err
 			}
@@ -454,13 +631,51 @@ func (r *Runtime) exec() error {
 				return r.setReg(dst.(Register), v)
 			case Offset:
 				return r.setStack(dst.(Offset), v)
+			case Address:
+				addr, err := r.effectiveAddress(dst.(Address))
+				if err != nil {
+					return err
+				}
+				return r.setMemory(addr, code.width(), v)
 			case Immediate:
 				if _, ok := dst.(Integer); !ok {
-					return fmt.Errorf("load: unsupported src: %s", src.String())
+					return fmt.Errorf("%s: unsupported src: %s", code.String(), src.String())
+				}
+				return r.setMemory(int(dst.(Integer)), code.width(), v)
+			default:
+				return fmt.Errorf("%s: unsupported dst: %s", code.String(), dst.String())
+			}
+		case LEA:
+			defer func() { r.relocate(code) }()
+			dst := r.program[r.getSpecialReg(PC)+1]
+			src := r.program[r.getSpecialReg(PC)+2]
+
+			// 値ではなく位置の絶対アドレスを求める
+			var addr int
+			switch src.(type) {
+			case BpOffset, SpOffset:
+				v, err := r.stackAddress(src.(Offset))
+				if err != nil {
+					return err
+				}
+				addr = v
+			case Address:
+				v, err := r.effectiveAddress(src.(Address))
+				if err != nil {
+					return err
 				}
-				return r.setHeap(int(dst.(Integer)), v)
+				addr = v
 			default:
-				return fmt.Errorf("load: unsupported dst: %s", dst.String())
+				return fmt.Errorf("lea: unsupported src: %s", src.String())
+			}
+
+			switch dst.(type) {
+			case Register:
+				return r.setReg(dst.(Register), Integer(addr))
+			case Offset:
+				return r.setStack(dst.(Offset), Integer(addr))
+			default:
+				return fmt.Errorf("lea: unsupported dst: %s", dst.String())
 			}
 		case CALL:
 			dst := r.program[r.getSpecialReg(PC)+1]
@@ -478,19 +693,60 @@ func (r *Runtime) exec() error {
 				return err
 			}
 			r.setSpecialReg(PC, dstAddr)
+			r.current.calls = append(r.current.calls, base)
 			return nil
 		case RET:
 			dst, err := r.popFromStack()
 			if err != nil {
 				return err
 			}
+			if n := len(r.current.calls); 0 < n {
+				r.current.calls = r.current.calls[:n-1]
+			}
 			switch dst.(type) {
 			case Integer:
+				if dst.(Integer) == threadExit {
+					r.exitThread()
+					return r.schedule()
+				}
 				r.setSpecialReg(PC, dst.(Integer))
 				return nil
 			default:
 				return fmt.Errorf("ret: unsupported dst: %s", dst.String())
 			}
+		case ENTER:
+			defer func() { r.relocate(code) }()
+			src := r.program[r.getSpecialReg(PC)+1]
+			n, ok := src.(Integer)
+			if !ok || n < 0 {
+				return fmt.Errorf("enter: unsupported size: %s", src.String())
+			}
+			// push bp; mov bp sp; sub sp n
+			if err := r.pushToStack(r.getSpecialReg(BP)); err != nil {
+				return err
+			}
+			r.setSpecialReg(BP, r.getSpecialReg(SP))
+			if !r.reserveStack(r.current, int(r.getSpecialReg(SP)-n)) {
+				return faultf(FaultStackOverflow, "enter: stack overflow")
+			}
+			r.setSpecialReg(SP, r.getSpecialReg(SP)-n)
+			return nil
+		case LEAVE:
+			defer func() { r.relocate(code) }()
+			return r.leave()
+		case TAILCALL:
+			dst := r.program[r.getSpecialReg(PC)+1]
+			if _, ok := dst.(PcOffset); !ok {
+				return fmt.Errorf("tailcall: unsupported dst: %s", dst.String())
+			}
+			// ENTERで作ったフレームを畳んでから飛ぶので、呼び出し先のRETは呼び出し元へ戻る
+			if err := r.leave(); err != nil {
+				return err
+			}
+			base := int(r.getSpecialReg(PC))
+			diff := int(dst.(PcOffset))
+			r.setSpecialReg(PC, Integer(base+diff))
+			return nil
 		case JMP:
 			dst := r.program[r.getSpecialReg(PC)+1]
 			if _, ok := dst.(PcOffset); !ok {
@@ -564,7 +820,7 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				if !calculable(v, srcValue) {
-					return fmt.Errorf("add: unsupported values: %T += %T", v, srcValue)
+					return faultf(FaultTypeMismatch, "add: unsupported values: %T += %T", v, srcValue)
 				}
 				var res Immediate
 				switch typeof(v) {
@@ -573,7 +829,7 @@ func (r *Runtime) exec() error {
 				case TChar:
 					res = Character(v.Value() + srcValue.Value())
 				default:
-					return fmt.Errorf("add: unsupported values: %T += %T", v, srcValue)
+					return faultf(FaultTypeMismatch, "add: unsupported values: %T += %T", v, srcValue)
 				}
 				r.setFlagReg(ZF, res.Value() == 0)
 				return r.setReg(dst.(Register), res)
@@ -583,7 +839,7 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				if !calculable(v, srcValue) {
-					return fmt.Errorf("add: unsupported values: %T += %T", v, srcValue)
+					return faultf(FaultTypeMismatch, "add: unsupported values: %T += %T", v, srcValue)
 				}
 				var res Immediate
 				switch typeof(v) {
@@ -592,7 +848,7 @@ func (r *Runtime) exec() error {
 				case TChar:
 					res = Character(v.Value() + srcValue.Value())
 				default:
-					return fmt.Errorf("add: unsupported values: %T += %T", v, srcValue)
+					return faultf(FaultTypeMismatch, "add: unsupported values: %T += %T", v, srcValue)
 				}
 				r.setFlagReg(ZF, res.Value() == 0)
 				return r.setStack(dst.(Offset), res)
@@ -631,7 +887,7 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				if !calculable(v, srcValue) {
-					return fmt.Errorf("sub: unsupported values: %T -= %T", v, srcValue)
+					return faultf(FaultTypeMismatch, "sub: unsupported values: %T -= %T", v, srcValue)
 				}
 				res := Integer(v.Value() - srcValue.Value())
 				r.setFlagReg(ZF, res.Value() == 0)
@@ -642,7 +898,7 @@ func (r *Runtime) exec() error {
 					return err
 				}
 				if !calculable(v, srcValue) {
-					return fmt.Errorf("sub: unsupported values: %T -= %T", v, srcValue)
+					return faultf(FaultTypeMismatch, "sub: unsupported values: %T -= %T", v, srcValue)
 				}
 				res := Integer(v.Value() - srcValue.Value())
 				r.setFlagReg(ZF, res.Value() == 0)
@@ -854,6 +1110,17 @@ func (r *Runtime) exec() error {
 			}
 			r.setFlagReg(ZF, false)
 			return nil
+		case SADD, SSUB, SEQ, SNE, SLT, SLE, DUP, SWAP, OVER, DROP, ROT:
+			defer func() { r.relocate(code) }()
+			return r.execStackOp(code)
+		case SPAWN, YIELD, JOIN, TEXIT:
+			return r.execThreadOp(code)
+		case CHAN, SEND, RECV, CLOSE, LOCK, UNLOCK, CAS:
+			return r.execSyncOp(code)
+		case TRY, ENDTRY, THROW:
+			return r.execExceptionOp(code)
+		case SETVEC, INT, IRET, CLI, STI:
+			return r.execInterruptOp(code)
 		case SYSCALL:
 			defer func() { r.relocate(code) }()
 			no, err := r.getReg(R0)
@@ -865,9 +1132,11 @@ func (r *Runtime) exec() error {
 				r.halt = true
 				return nil
 			case SYS_WRITE:
-				fd := r.getGeneralReg(R1).Value()
-				addr := r.getGeneralReg(R2).Value()
-				length := r.getGeneralReg(R3).Value()
+				args, err := r.syscallArgs(R1, R2, R3)
+				if err != nil {
+					return err
+				}
+				fd, addr, length := args[0], args[1], args[2]
 				data, err := r.readHeapBytes(addr, length)
 				if err != nil {
 					return err
@@ -880,7 +1149,7 @@ func (r *Runtime) exec() error {
 				case 2:
 					w = r.stderr
 				default:
-					return fmt.Errorf("sys_write: unsupported fd: %d", fd)
+					return faultf(FaultBadSyscall, "sys_write: unsupported fd: %d", fd)
 				}
 				wrote, err := w.Write(data)
 				if err != nil {
@@ -888,16 +1157,18 @@ func (r *Runtime) exec() error {
 				}
 				return r.setReg(R0, Integer(wrote))
 			case SYS_READ:
-				fd := r.getGeneralReg(R1).Value()
-				addr := r.getGeneralReg(R2).Value()
-				length := r.getGeneralReg(R3).Value()
+				args, err := r.syscallArgs(R1, R2, R3)
+				if err != nil {
+					return err
+				}
+				fd, addr, length := args[0], args[1], args[2]
 
 				var rd io.Reader
 				switch fd {
 				case 0:
 					rd = r.stdin
 				default:
-					return fmt.Errorf("sys_read: unsupported fd: %d", fd)
+					return faultf(FaultBadSyscall, "sys_read: unsupported fd: %d", fd)
 				}
 				buf := make([]byte, length)
 				got, err := rd.Read(buf)
@@ -912,7 +1183,7 @@ func (r *Runtime) exec() error {
 				}
 				return r.setReg(R0, Integer(got))
 			default:
-				return fmt.Errorf("syscall: unsupported syscallNo: %d", no.Value())
+				return faultf(FaultBadSyscall, "syscall: unsupported syscallNo: %d", no.Value())
 			}
 		default:
 			return fmt.Errorf("exec: unimplemented opcode: %s", code.String())
@@ -922,20 +1193,64 @@ func (r *Runtime) exec() error {
 	}
 }
 func (r *Runtime) Run() error {
+	if r.config.Engine == EngineCompiled {
+		return r.runCompiled()
+	}
 	for {
 		if r.halt {
 			return nil
 		}
-		switch code := r.program[r.getSpecialReg(PC)]; code.(type) {
-		case Opcode:
-			if err := r.exec(); err != nil {
+		pc := int(r.getSpecialReg(PC))
+		if err := r.step(); err != nil {
+			return r.runtimeError(err, pc)
+		}
+	}
+}
+
+// step 実行中のスレッドで1命令実行する
+func (r *Runtime) step() error {
+	if err := r.pollInterrupts(); err != nil {
+		return err
+	}
+	switch code := r.program[r.getSpecialReg(PC)]; code.(type) {
+	case Opcode:
+		r.ticks++
+		// 実行する前の許可/禁止で数える。iretやstiそのものは数えない
+		r.tickTimer()
+		if err := r.execute(); err != nil {
+			if err := r.catchFault(err); err != nil {
 				return err
 			}
-		default:
-			return fmt.Errorf("unsupported code: %s", code.String())
+		}
+		// 命令数によるプリエンプション
+		if !r.halt && 0 < r.config.Scheduler.Quantum && r.config.Scheduler.Quantum <= r.ticks {
+			return r.schedule()
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported code: %s", code.String())
+	}
+}
+
+// execute 現在のPCの命令を実行する。コンパイル済みならそのクロージャを呼ぶ
+func (r *Runtime) execute() error {
+	if r.compiled != nil {
+		if op := r.compiled.ops[r.getSpecialReg(PC)]; op != nil {
+			return op(r)
 		}
 	}
+	return r.exec()
 }
+
+// catchFault CatchFaults が有効でハンドラがあれば、FaultをゲストのハンドラへTHROWする
+func (r *Runtime) catchFault(err error) error {
+	code, ok := faultCodeOf(err)
+	if !ok || !r.config.CatchFaults || len(r.current.handlers) == 0 {
+		return err
+	}
+	return r.unwind(Integer(code), code)
+}
+
 func (r *Runtime) Status() int {
 	imm, err := r.getReg(R1)
 	if err != nil {
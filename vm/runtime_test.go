@@ -2,8 +2,11 @@ package vm
 
 import (
 	"bytes"
+	"errors"
 	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestNOP(t *testing.T) {
@@ -912,3 +915,1424 @@ func TestBrainfuck_Loop_GeneratesHelloWorld(t *testing.T) {
 		t.Errorf("stdout = %q, want %q", got, want)
 	}
 }
+
+func TestByteMemorySizedLoadAndStore(t *testing.T) {
+	program := []Code{
+		ALLOC, Integer(16),
+		POP, R1, // R1 = base
+		STORE32, R1, Integer(0x11223344),
+		LOAD8, R2, R1, // 最下位バイト
+		LOAD16, R3, R1,
+		LOAD32, R4, R1,
+		STORE64, Integer(8), Integer(-2),
+		LOAD64, R5, Integer(8),
+		LOAD8, R6, Integer(15), // 最上位バイト
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, Memory: ByteMemory}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	want := map[GeneralPurposeRegister]Immediate{
+		R2: Integer(0x44),
+		R3: Integer(0x3344),
+		R4: Integer(0x11223344),
+		R5: Integer(-2),
+		R6: Integer(0xff),
+	}
+	for reg, v := range want {
+		if runtime.registers.generals[reg] != v {
+			t.Errorf("%s = %v, want %v", reg, runtime.registers.generals[reg], v)
+		}
+	}
+}
+
+func TestCellMemorySizedStoreTruncates(t *testing.T) {
+	program := []Code{
+		ALLOC, Integer(1),
+		POP, R1,
+		STORE8, R1, Integer(0x1ff),
+		LOAD, R2, R1,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R2] != Integer(0xff) {
+		t.Errorf("R2 = %v, want %v", runtime.registers.generals[R2], Integer(0xff))
+	}
+}
+
+func TestByteMemoryOutOfBounds(t *testing.T) {
+	program := []Code{
+		STORE32, Integer(98), Integer(1), // 98..102 はヒープの外
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, Memory: ByteMemory}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err == nil {
+		t.Fatalf("Run() error = nil, want out of bounds")
+	}
+}
+
+func TestByteMemorySyscallWriteBinary(t *testing.T) {
+	// バイトメモリではヌル文字も含めて length バイト書き込む
+	program := []Code{
+		ALLOC, Integer(3),
+		POP, R2,
+		STORE16, R2, Integer('a'),
+		STORE8, Integer(2), Character('b'),
+		MOV, R1, Integer(1),
+		MOV, R3, Integer(3),
+		MOV, R0, Integer(1),
+		SYSCALL,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, Memory: ByteMemory}
+	runtime := NewRuntime(program, config)
+
+	var buf bytes.Buffer
+	runtime.stdout = &buf
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if buf.String() != "a\x00b" {
+		t.Errorf("stdout = %q, want %q", buf.String(), "a\x00b")
+	}
+}
+
+func TestRegisterRelativeAddressing(t *testing.T) {
+	program := []Code{
+		ALLOC, Integer(8),
+		POP, R1, // R1 = base
+		MOV, R2, Integer(3), // R2 = index
+		STORE, RegisterOffset{Base: R1, Disp: 4}, Integer(42),
+		STORE, IndexedOffset{Base: R1, Index: R2, Scale: 2}, Integer(7), // heap[base+6]
+		LOAD, R3, RegisterOffset{Base: R1, Disp: 4},
+		MOV, R4, IndexedOffset{Base: R1, Index: R2, Scale: 2},
+		MOV, RegisterOffset{Base: R1, Disp: 0}, R4,
+		LOAD, R5, R1,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	want := map[GeneralPurposeRegister]Immediate{
+		R3: Integer(42),
+		R4: Integer(7),
+		R5: Integer(7),
+	}
+	for reg, v := range want {
+		if runtime.registers.generals[reg] != v {
+			t.Errorf("%s = %v, want %v", reg, runtime.registers.generals[reg], v)
+		}
+	}
+}
+
+func TestRegisterRelativeAddressing_UndefinedBase(t *testing.T) {
+	program := []Code{
+		LOAD, R1, RegisterOffset{Base: R2, Disp: 1},
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err == nil {
+		t.Fatalf("Run() error = nil, want undefined register")
+	}
+}
+
+func TestLEAAndPointerToStack(t *testing.T) {
+	program := []Code{
+		PUSH, Integer(0), // ローカル変数
+		LEA, R1, SpOffset(0), // R1 = &local
+		CALL, PcOffset(8), // f(&local)
+		POP, R2,
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// f: *R1 = 42
+		STORE, R1, Integer(42),
+		RET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// スタックはヒープの直後に配置される
+	if runtime.registers.generals[R1] != Integer(199) {
+		t.Errorf("R1 = %v, want %v", runtime.registers.generals[R1], Integer(199))
+	}
+	if runtime.registers.generals[R2] != Integer(42) {
+		t.Errorf("R2 = %v, want %v", runtime.registers.generals[R2], Integer(42))
+	}
+}
+
+func TestLOADFromStackAddress(t *testing.T) {
+	program := []Code{
+		PUSH, Integer(7),
+		PUSH, Integer(8),
+		LEA, R1, SpOffset(0),
+		LOAD, R2, RegisterOffset{Base: R1, Disp: 1}, // 先にpushした値。スタックはセル単位
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, Memory: ByteMemory}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R2] != Integer(7) {
+		t.Errorf("R2 = %v, want %v", runtime.registers.generals[R2], Integer(7))
+	}
+}
+
+func TestSizedAccessToStackAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		code []Code
+	}{
+		{"load8", []Code{LOAD8, R2, R1}},
+		{"store8", []Code{STORE8, R1, Integer(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := []Code{
+				PUSH, Integer(7),
+				LEA, R1, SpOffset(0),
+			}
+			program = append(program, tt.code...)
+			program = append(program, MOV, R0, Integer(0), SYSCALL)
+			// byte でもスタックはセル単位なので、サイズ指定の読み書きはフォルトになる
+			config := &Config{StackSize: 100, HeapSize: 100, Memory: ByteMemory}
+			runtime := NewRuntime(program, config)
+			err := runtime.Run()
+			if code, ok := faultCodeOf(err); !ok || code != FaultOutOfBounds {
+				t.Fatalf("Run() error = %v, want out of bounds fault", err)
+			}
+		})
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	program := []Code{
+		PUSH, Integer(1),
+		PUSH, Integer(2),
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 1, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err == nil {
+		t.Fatalf("Run() error = nil, want stack overflow")
+	}
+}
+
+func TestStackGrowth(t *testing.T) {
+	program := []Code{
+		CALL, PcOffset(6),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// f: ローカル変数のアドレスを取ってからスタックを伸ばす
+		ENTER, Integer(1),
+		MOV, BpOffset(-1), Integer(42),
+		LEA, R3, BpOffset(-1),
+		PUSH, Integer(1),
+		PUSH, Integer(2),
+		PUSH, Integer(3),
+		PUSH, Integer(4),
+		MOV, R4, RegisterOffset{R3, 0},
+		MOV, R5, BpOffset(-1),
+		POP, R6,
+		LEAVE,
+		RET,
+	}
+	config := &Config{StackSize: 1, HeapSize: 100, StackLimit: 10}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// 伸ばす前に取ったアドレスもBP相対の位置も同じ値を指す
+	if runtime.registers.generals[R4] != Integer(42) || runtime.registers.generals[R5] != Integer(42) {
+		t.Errorf("R4 = %v, R5 = %v, want 42", runtime.registers.generals[R4], runtime.registers.generals[R5])
+	}
+	// スタックは上限の大きさで配置される
+	if runtime.registers.specials[SP] != 110 {
+		t.Errorf("SP = %d, want 110", runtime.registers.specials[SP])
+	}
+	if n := len(runtime.stack); n <= 1 || 10 < n {
+		t.Errorf("len(stack) = %d, want 2..10", n)
+	}
+
+	// 上限を超えればあふれる
+	config = &Config{StackSize: 1, HeapSize: 100, StackLimit: 5}
+	runtime = NewRuntime(program, config)
+	err := runtime.Run()
+	if code, ok := faultCodeOf(err); !ok || code != FaultStackOverflow {
+		t.Errorf("Run() error = %v, want stack overflow", err)
+	}
+}
+
+func TestStackGrowth_Threads(t *testing.T) {
+	program := []Code{
+		PUSH, Integer(5),
+		LEA, R1, SpOffset(0),
+		SPAWN, PcOffset(13),
+		JOIN, R0,
+		MOV, R2, R0,
+		POP, R3,
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// worker: 自分のスタックを伸ばしてから、メインスレッドのローカル変数を読む
+		PUSH, Integer(1),
+		PUSH, Integer(2),
+		PUSH, Integer(3),
+		POP, R5,
+		POP, R5,
+		POP, R5,
+		LOAD, R0, R1,
+		RET,
+	}
+	config := &Config{StackSize: 1, HeapSize: 10, StackLimit: 8}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R2] != Integer(5) {
+		t.Errorf("R2 = %v, want 5", runtime.registers.generals[R2])
+	}
+	// workerのスタックはメインスレッドの上限の後ろ [18, 26) に置かれる
+	worker := runtime.threads[1]
+	if worker.stackFloor != 18 || worker.stackBase+len(worker.stack) != 26 || 23 < worker.stackBase {
+		t.Errorf("worker stack = [%d, %d), floor %d", worker.stackBase, worker.stackBase+len(worker.stack), worker.stackFloor)
+	}
+}
+
+func TestHeapGrowth(t *testing.T) {
+	program := []Code{
+		ALLOC, Integer(5),
+		POP, R1,
+		ALLOC, Integer(5),
+		POP, R2,
+		STORE, R2, Integer(7),
+		LOAD, R3, R2,
+		PUSH, Integer(1),
+		POP, R4,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 10, HeapSize: 1, HeapLimit: 20}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R2] != Integer(5) || runtime.registers.generals[R3] != Integer(7) {
+		t.Errorf("R2 = %v, R3 = %v, want 5, 7", runtime.registers.generals[R2], runtime.registers.generals[R3])
+	}
+	if n := runtime.heap.len(); n <= 10 || 20 < n {
+		t.Errorf("len(heap) = %d, want 11..20", n)
+	}
+	// スタックはヒープの上限の後ろに置かれる
+	if runtime.registers.specials[SP] != 30 {
+		t.Errorf("SP = %d, want 30", runtime.registers.specials[SP])
+	}
+
+	config = &Config{StackSize: 10, HeapSize: 1, HeapLimit: 8}
+	runtime = NewRuntime(program, config)
+	err := runtime.Run()
+	if code, ok := faultCodeOf(err); !ok || code != FaultOutOfMemory {
+		t.Errorf("Run() error = %v, want out of memory", err)
+	}
+}
+
+func TestENTERAndLEAVE(t *testing.T) {
+	program := []Code{
+		MOV, R1, Integer(5),
+		CALL, PcOffset(6),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// f: ローカル変数2つ
+		ENTER, Integer(2),
+		MOV, BpOffset(-1), R1,
+		MOV, BpOffset(-2), Integer(10),
+		MOV, R2, BpOffset(-2),
+		ADD, R2, BpOffset(-1),
+		LEAVE,
+		RET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R2] != Integer(15) {
+		t.Errorf("R2 = %v, want %v", runtime.registers.generals[R2], Integer(15))
+	}
+	// フレームが全て畳まれていること
+	if runtime.registers.specials[SP] != 200 || runtime.registers.specials[BP] != 200 {
+		t.Errorf("SP = %d, BP = %d, want 200", runtime.registers.specials[SP], runtime.registers.specials[BP])
+	}
+}
+
+func TestTAILCALLReusesFrame(t *testing.T) {
+	program := []Code{
+		MOV, R1, Integer(1000), // PC=0
+		CALL, PcOffset(6), // PC=3 -> f
+		MOV, R0, Integer(0), // PC=5
+		SYSCALL, // PC=8
+		// f(n): n == 0 まで自分自身を末尾呼び出しする
+		ENTER, Integer(1), // PC=9
+		MOV, BpOffset(-1), R1, // PC=11
+		EQ, R1, Integer(0), // PC=14
+		JZ, PcOffset(7), // PC=17 -> done
+		SUB, R1, Integer(1), // PC=19
+		TAILCALL, PcOffset(-13), // PC=22 -> f
+		LEAVE, // PC=24 done:
+		RET,   // PC=25
+	}
+	// CALLで再帰すると1000段は収まらない大きさ
+	config := &Config{StackSize: 10, HeapSize: 10}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R1] != Integer(0) {
+		t.Errorf("R1 = %v, want %v", runtime.registers.generals[R1], Integer(0))
+	}
+}
+
+func TestStackMachineOps(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []Code
+		want    []Immediate // 上から順にpopした値
+		wantZF  bool
+	}{
+		{
+			name:    "sadd",
+			program: []Code{PUSH, Integer(2), PUSH, Integer(3), SADD},
+			want:    []Immediate{Integer(5)},
+		},
+		{
+			name:    "sadd char",
+			program: []Code{PUSH, Character('a'), PUSH, Integer(1), SADD},
+			want:    []Immediate{Character('b')},
+		},
+		{
+			name:    "ssub",
+			program: []Code{PUSH, Integer(2), PUSH, Integer(2), SSUB},
+			want:    []Immediate{Integer(0)},
+			wantZF:  true,
+		},
+		{
+			name:    "slt",
+			program: []Code{PUSH, Integer(1), PUSH, Integer(2), SLT},
+			want:    []Immediate{Boolean(true)},
+			wantZF:  true,
+		},
+		{
+			name:    "sle",
+			program: []Code{PUSH, Integer(3), PUSH, Integer(2), SLE},
+			want:    []Immediate{Boolean(false)},
+		},
+		{
+			name:    "seq and sne",
+			program: []Code{PUSH, Integer(1), PUSH, Integer(1), SEQ, PUSH, Integer(1), PUSH, Integer(1), SNE},
+			want:    []Immediate{Boolean(false), Boolean(true)},
+		},
+		{
+			name:    "dup",
+			program: []Code{PUSH, Integer(7), DUP},
+			want:    []Immediate{Integer(7), Integer(7)},
+		},
+		{
+			name:    "swap",
+			program: []Code{PUSH, Integer(1), PUSH, Integer(2), SWAP},
+			want:    []Immediate{Integer(1), Integer(2)},
+		},
+		{
+			name:    "over",
+			program: []Code{PUSH, Integer(1), PUSH, Integer(2), OVER},
+			want:    []Immediate{Integer(1), Integer(2), Integer(1)},
+		},
+		{
+			name:    "drop",
+			program: []Code{PUSH, Integer(1), PUSH, Integer(2), DROP},
+			want:    []Immediate{Integer(1)},
+		},
+		{
+			name:    "rot",
+			program: []Code{PUSH, Integer(1), PUSH, Integer(2), PUSH, Integer(3), ROT},
+			want:    []Immediate{Integer(1), Integer(3), Integer(2)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := append(tt.program, MOV, R0, Integer(0), SYSCALL)
+			config := &Config{StackSize: 100, HeapSize: 100}
+			runtime := NewRuntime(program, config)
+			if err := runtime.Run(); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			for i, want := range tt.want {
+				got, err := runtime.popFromStack()
+				if err != nil {
+					t.Fatalf("pop[%d] error = %v", i, err)
+				}
+				if got != want {
+					t.Errorf("pop[%d] = %v, want %v", i, got, want)
+				}
+			}
+			if _, err := runtime.popFromStack(); err == nil {
+				t.Errorf("stack has extra values")
+			}
+			if runtime.registers.flags[ZF] != tt.wantZF {
+				t.Errorf("ZF = %v, want %v", runtime.registers.flags[ZF], tt.wantZF)
+			}
+		})
+	}
+}
+
+func TestStackMachineOps_Underflow(t *testing.T) {
+	program := []Code{
+		PUSH, Integer(1),
+		SADD,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err == nil {
+		t.Fatalf("Run() error = nil, want stack underflow")
+	}
+}
+
+func TestStackMachineOps_UnderflowKeepsStack(t *testing.T) {
+	// 途中で足りなくなっても、積んであった値は取り出さない
+	program := []Code{
+		PUSH, Integer(1),
+		PUSH, Integer(2),
+		ROT,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+	if err := runtime.Run(); err == nil {
+		t.Fatalf("Run() error = nil, want stack underflow")
+	}
+	for i, want := range []Immediate{Integer(2), Integer(1)} {
+		got, err := runtime.popFromStack()
+		if err != nil {
+			t.Fatalf("pop[%d] error = %v", i, err)
+		}
+		if got != want {
+			t.Errorf("pop[%d] = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDROP_Undefined(t *testing.T) {
+	// enterで確保しただけの未定義のセルも捨てられる
+	program := []Code{
+		PUSH, Integer(7),
+		ENTER, Integer(1),
+		DROP,
+		POP, BP,
+		POP, R1,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := runtime.registers.generals[R1]; got != Integer(7) {
+		t.Errorf("r1 = %v, want 7", got)
+	}
+}
+
+// traceThreads 1命令ごとに実行したスレッドのIDを記録する
+func traceThreads(t *testing.T, runtime *Runtime) []int {
+	t.Helper()
+	var trace []int
+	for !runtime.halt {
+		trace = append(trace, runtime.current.id)
+		if err := runtime.step(); err != nil {
+			t.Fatalf("step() error = %v", err)
+		}
+	}
+	return trace
+}
+
+func TestThreads_SpawnAndJoin(t *testing.T) {
+	program := []Code{
+		SPAWN, PcOffset(11),
+		JOIN, R0,
+		MOV, R1, R0,
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// worker
+		MOV, R0, Integer(42),
+		RET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != 42 {
+		t.Errorf("Status() = %d, want 42", runtime.Status())
+	}
+	if len(runtime.threads) != 2 || runtime.threads[1].state != threadDone {
+		t.Errorf("worker thread is not done")
+	}
+}
+
+func TestThreads_RoundRobin(t *testing.T) {
+	program := []Code{
+		SPAWN, PcOffset(12),
+		SPAWN, PcOffset(10),
+		JOIN, Integer(1),
+		JOIN, Integer(2),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// worker
+		YIELD,
+		YIELD,
+		TEXIT,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	got := traceThreads(t, runtime)
+	want := []int{0, 0, 0, 1, 2, 1, 2, 1, 2, 0, 0, 0, 0}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("trace diff:\n%s", diff)
+	}
+}
+
+func TestThreads_Preemption(t *testing.T) {
+	program := []Code{
+		SPAWN, PcOffset(12),
+		SPAWN, PcOffset(10),
+		JOIN, Integer(1),
+		JOIN, Integer(2),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// worker
+		NOP,
+		NOP,
+		NOP,
+		TEXIT,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, Scheduler: SchedulerConfig{Quantum: 2}}
+	runtime := NewRuntime(program, config)
+
+	got := traceThreads(t, runtime)
+	want := []int{0, 0, 1, 1, 2, 2, 0, 1, 1, 2, 2, 0, 0, 0, 0}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("trace diff:\n%s", diff)
+	}
+}
+
+func TestThreads_RandomScheduleIsReproducible(t *testing.T) {
+	program := []Code{
+		SPAWN, PcOffset(12),
+		SPAWN, PcOffset(10),
+		JOIN, Integer(1),
+		JOIN, Integer(2),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// worker
+		NOP,
+		NOP,
+		NOP,
+		TEXIT,
+	}
+	run := func() []int {
+		config := &Config{StackSize: 100, HeapSize: 100, Scheduler: SchedulerConfig{Quantum: 1, Random: true, Seed: 42}}
+		return traceThreads(t, NewRuntime(program, config))
+	}
+	first := run()
+	if diff := cmp.Diff(first, run()); diff != "" {
+		t.Errorf("same seed produced different traces:\n%s", diff)
+	}
+}
+
+func TestThreads_Deadlock(t *testing.T) {
+	program := []Code{
+		SPAWN, PcOffset(5),
+		JOIN, Integer(1),
+		SYSCALL,
+		// worker
+		JOIN, Integer(0),
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	err := runtime.Run()
+	if err == nil || !strings.Contains(err.Error(), "deadlock") {
+		t.Fatalf("Run() error = %v, want deadlock", err)
+	}
+}
+
+func TestChannel_ProducerConsumer(t *testing.T) {
+	program := []Code{
+		CHAN, Integer(1),
+		MOV, R7, R0,
+		MOV, R9, Integer(0),
+		SPAWN, PcOffset(19),
+		// consumer
+		RECV, R1, R7,
+		JZ, PcOffset(7),
+		ADD, R9, R1,
+		JMP, PcOffset(-8),
+		MOV, R1, R9,
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// producer
+		SEND, R7, Integer(1),
+		SEND, R7, Integer(2),
+		SEND, R7, Integer(3),
+		CLOSE, R7,
+		TEXIT,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != 6 {
+		t.Errorf("Status() = %d, want 6", runtime.Status())
+	}
+}
+
+func TestChannel_SendOnClosed(t *testing.T) {
+	program := []Code{
+		CHAN, Integer(1),
+		CLOSE, R0,
+		SEND, R0, Integer(1),
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err == nil {
+		t.Fatalf("Run() error = nil, want send on closed channel")
+	}
+}
+
+func TestMutex_Counter(t *testing.T) {
+	program := []Code{
+		STORE, Integer(0), Integer(0),
+		SPAWN, PcOffset(15),
+		SPAWN, PcOffset(13),
+		JOIN, Integer(1),
+		JOIN, Integer(2),
+		LOAD, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// worker: 3回 heap[0]++
+		MOV, R8, Integer(3),
+		LOCK, Integer(10),
+		LOAD, R1, Integer(0),
+		ADD, R1, Integer(1),
+		STORE, Integer(0), R1,
+		UNLOCK, Integer(10),
+		SUB, R8, Integer(1),
+		JNZ, PcOffset(-16),
+		TEXIT,
+	}
+	// 1命令ごとに切り替えても、ロックしていれば増分は失われない
+	for seed := int64(0); seed < 10; seed++ {
+		config := &Config{StackSize: 100, HeapSize: 100, Scheduler: SchedulerConfig{Quantum: 1, Random: true, Seed: seed}}
+		runtime := NewRuntime(program, config)
+		if err := runtime.Run(); err != nil {
+			t.Fatalf("seed %d: Run() error = %v", seed, err)
+		}
+		if runtime.Status() != 6 {
+			t.Errorf("seed %d: Status() = %d, want 6", seed, runtime.Status())
+		}
+	}
+}
+
+func TestCAS(t *testing.T) {
+	program := []Code{
+		STORE, Integer(0), Integer(5),
+		MOV, R0, Integer(5),
+		CAS, Integer(0), Integer(7), // 成功
+		MOV, R8, ZF,
+		MOV, R0, Integer(1),
+		CAS, Integer(0), Integer(9), // 失敗してR0に現在値
+		MOV, R9, R0,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.registers.generals[R8] != Boolean(true) {
+		t.Errorf("first cas ZF = %v, want true", runtime.registers.generals[R8])
+	}
+	if runtime.registers.flags[ZF] {
+		t.Errorf("second cas ZF = true, want false")
+	}
+	if runtime.registers.generals[R9] != Integer(7) {
+		t.Errorf("R0 after failed cas = %v, want 7", runtime.registers.generals[R9])
+	}
+	if v, _ := runtime.getMemory(0, 0); v != Integer(7) {
+		t.Errorf("heap[0] = %v, want 7", v)
+	}
+}
+
+func TestDeadlock_ReportsBlockedThreads(t *testing.T) {
+	program := []Code{
+		CHAN, Integer(1),
+		MOV, R7, R0,
+		LOCK, Integer(3),
+		SPAWN, PcOffset(5),
+		RECV, R1, R7,
+		// worker
+		LOCK, Integer(3),
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	err := runtime.Run()
+	if err == nil {
+		t.Fatalf("Run() error = nil, want deadlock")
+	}
+	for _, want := range []string{
+		"deadlock",
+		"thread 0 at pc 9: recv r1 r7 (channel 0)",
+		"thread 1 at pc 12: lock 3 (mutex 3)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err.Error(), want)
+		}
+	}
+}
+
+func TestTHROW_UnwindsToHandler(t *testing.T) {
+	program := []Code{
+		TRY, PcOffset(12),
+		CALL, PcOffset(17),
+		ENDTRY,
+		MOV, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler
+		MOV, R1, R0,
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// f
+		PUSH, Integer(1),
+		PUSH, Integer(2),
+		THROW, Integer(99),
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != 99 {
+		t.Errorf("Status() = %d, want 99", runtime.Status())
+	}
+	// 戻りアドレスとpushした値は巻き戻されている
+	if sp := runtime.registers.specials[SP]; sp != 200 {
+		t.Errorf("SP = %d, want 200", sp)
+	}
+}
+
+func TestTHROW_NestedHandlers(t *testing.T) {
+	program := []Code{
+		TRY, PcOffset(14),
+		TRY, PcOffset(5),
+		ENDTRY,
+		THROW, Integer(7),
+		// inner
+		MOV, R1, Integer(1),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// outer
+		MOV, R1, R0,
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != 7 {
+		t.Errorf("Status() = %d, want 7", runtime.Status())
+	}
+}
+
+func TestTHROW_Uncaught(t *testing.T) {
+	program := []Code{
+		THROW, Integer(1),
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	err := runtime.Run()
+	if err == nil || !strings.Contains(err.Error(), "uncaught exception") {
+		t.Fatalf("Run() error = %v, want uncaught exception", err)
+	}
+}
+
+func TestCatchFaults(t *testing.T) {
+	program := []Code{
+		TRY, PcOffset(12),
+		LOAD, R2, Integer(1000),
+		MOV, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler: R1 = FaultCode
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		config := &Config{StackSize: 100, HeapSize: 100, CatchFaults: true}
+		runtime := NewRuntime(program, config)
+		if err := runtime.Run(); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if runtime.Status() != int(FaultOutOfBounds) {
+			t.Errorf("Status() = %d, want %d", runtime.Status(), FaultOutOfBounds)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		config := &Config{StackSize: 100, HeapSize: 100}
+		runtime := NewRuntime(program, config)
+		err := runtime.Run()
+		if code, ok := faultCodeOf(err); !ok || code != FaultOutOfBounds {
+			t.Fatalf("Run() error = %v, want out of bounds fault", err)
+		}
+	})
+}
+
+func TestCatchFaults_BadSyscall(t *testing.T) {
+	program := []Code{
+		TRY, PcOffset(22),
+		MOV, R0, Integer(2), // SYS_READ
+		MOV, R1, Integer(9), // 不正なfd
+		MOV, R2, Integer(0),
+		MOV, R3, Integer(1),
+		SYSCALL,
+		MOV, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler
+		MOV, R0, Integer(0),
+		SYSCALL,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, CatchFaults: true}
+	runtime := NewRuntime(program, config)
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != int(FaultBadSyscall) {
+		t.Errorf("Status() = %d, want %d", runtime.Status(), FaultBadSyscall)
+	}
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	program := []Code{
+		STORE, Integer(0), Integer(0),
+		SETVEC, Integer(InterruptTimer), PcOffset(20),
+		// heap[0] が3になるまで回る
+		LOAD, R1, Integer(0),
+		MOV, R2, R1,
+		EQ, R2, Integer(3),
+		JZ, PcOffset(4),
+		JMP, PcOffset(-11),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler: heap[0]++
+		LOAD, R5, Integer(0),
+		ADD, R5, Integer(1),
+		STORE, Integer(0), R5,
+		IRET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, TimerInterval: 5}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != 3 {
+		t.Errorf("Status() = %d, want 3", runtime.Status())
+	}
+	// ハンドラで使ったレジスタは元に戻っている
+	if v := runtime.registers.generals[R5]; v != nil {
+		t.Errorf("R5 = %v, want nil", v)
+	}
+	if sp := runtime.registers.specials[SP]; sp != 200 {
+		t.Errorf("SP = %d, want 200", sp)
+	}
+}
+
+func TestInterrupt_FromHost(t *testing.T) {
+	program := []Code{
+		STORE, Integer(0), Integer(1),
+		SETVEC, Integer(7), PcOffset(15),
+		CLI,
+		LOAD, R8, Integer(0), // 禁止中なので割り込みはまだ来ない
+		STI,
+		LOAD, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler
+		STORE, Integer(0), Integer(2),
+		IRET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+	// cliまで進める
+	for range 3 {
+		if err := runtime.step(); err != nil {
+			t.Fatalf("step() error = %v", err)
+		}
+	}
+	runtime.Interrupt(99) // ハンドラがないので捨てられる
+	runtime.Interrupt(7)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if v := runtime.registers.generals[R8]; v != Integer(1) {
+		t.Errorf("R8 = %v, want 1", v)
+	}
+	if runtime.Status() != 2 {
+		t.Errorf("Status() = %d, want 2", runtime.Status())
+	}
+}
+
+func TestINT(t *testing.T) {
+	program := []Code{
+		SETVEC, Integer(3), PcOffset(12),
+		INT, Integer(3),
+		LOAD, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler
+		STORE, Integer(0), Integer(5),
+		IRET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if runtime.Status() != 5 {
+		t.Errorf("Status() = %d, want 5", runtime.Status())
+	}
+}
+
+func TestIRET_RestoresDisabled(t *testing.T) {
+	// cliの間のintから戻っても、割り込みは禁止されたまま
+	program := []Code{
+		SETVEC, Integer(3), PcOffset(10),
+		CLI,
+		INT, Integer(3),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler
+		IRET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100}
+	runtime := NewRuntime(program, config)
+	for range 4 {
+		if err := runtime.step(); err != nil {
+			t.Fatalf("step() error = %v", err)
+		}
+	}
+	if !runtime.interrupts.disabled {
+		t.Errorf("disabled = false after iret, want true")
+	}
+	if sp := runtime.registers.specials[SP]; sp != 200 {
+		t.Errorf("SP = %d, want 200", sp)
+	}
+}
+
+func TestTimerInterrupt_Disabled(t *testing.T) {
+	// 禁止されている間はタイマー割り込みが溜まらない
+	program := []Code{
+		STORE, Integer(0), Integer(0),
+		SETVEC, Integer(InterruptTimer), PcOffset(23),
+		CLI,
+		NOP, NOP, NOP, NOP, NOP, NOP, NOP, NOP, NOP, NOP,
+		STI,
+		NOP,
+		LOAD, R1, Integer(0),
+		MOV, R0, Integer(0),
+		SYSCALL,
+		// handler: heap[0]++
+		LOAD, R5, Integer(0),
+		ADD, R5, Integer(1),
+		STORE, Integer(0), R5,
+		IRET,
+	}
+	config := &Config{StackSize: 100, HeapSize: 100, TimerInterval: 4}
+	runtime := NewRuntime(program, config)
+	if err := runtime.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// stiの後のnopで1回だけ
+	if runtime.Status() != 1 {
+		t.Errorf("Status() = %d, want 1", runtime.Status())
+	}
+}
+
+func TestRuntimeError_Backtrace(t *testing.T) {
+	program := []Code{
+		// _start
+		CALL, PcOffset(6), // 0
+		MOV, R0, Integer(0), // 2
+		SYSCALL, // 5
+		// _outer
+		CALL, PcOffset(3), // 6
+		RET, // 8
+		// _inner
+		THROW, Integer(1), // 9
+		RET, // 11
+	}
+	debug := &DebugInfo{Symbols: []DebugSymbol{
+		{Kind: SymbolFunction, Name: "_start", Addr: 0, Size: 6},
+		{Kind: SymbolFunction, Name: "_outer", Addr: 6, Size: 3},
+		{Kind: SymbolFunction, Name: "_inner", Addr: 9, Size: 3},
+	}}
+	config := &Config{StackSize: 100, HeapSize: 100, Debug: debug}
+	runtime := NewRuntime(program, config)
+
+	err := runtime.Run()
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Run() error = %v, want *RuntimeError", err)
+	}
+	if diff := cmp.Diff([]int{6, 0}, rerr.Backtrace); diff != "" {
+		t.Errorf("Backtrace diff: %s", diff)
+	}
+	want := "pc 9 (_inner+0): uncaught exception: 1\n" +
+		"\tcalled from pc 6 (_outer+0)\n" +
+		"\tcalled from pc 0 (_start+0)"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestDebugInfo_WriteAndParse(t *testing.T) {
+	info := &DebugInfo{Symbols: []DebugSymbol{
+		{Kind: SymbolFunction, Name: "_start", Addr: 2, Size: 10, Exported: true},
+		{Kind: SymbolLabel, Name: "_loop", Addr: 5},
+		{Kind: SymbolFunction, Name: "_print", Addr: 12, Size: 8, Imported: true},
+		{Kind: SymbolData, Name: "msg", Addr: 0, Size: 6},
+	}}
+	var sb strings.Builder
+	if err := WriteDebugInfo(&sb, info); err != nil {
+		t.Fatal(err)
+	}
+	// 命令列の後ろに埋め込まれていても読める
+	got, err := ParseDebugInfo("nop\nmov r0 0\n" + sb.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(info, got); diff != "" {
+		t.Errorf("diff: %s", diff)
+	}
+	if d := got.Describe(7); d != "pc 7 (_start+5)" {
+		t.Errorf("Describe(7) = %q", d)
+	}
+}
+
+func TestResources_WriteAndParse(t *testing.T) {
+	var sb strings.Builder
+	if err := WriteResources(&sb, Resources{StackSize: 32768, HeapSize: 131072}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseResources("; comment\n" + sb.String() + "nop\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Resources{StackSize: 32768, HeapSize: 131072}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// 指定のないものは0のまま
+	got, err = ParseResources(";@heap 10\nnop\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Resources{HeapSize: 10}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := ParseResources(";@stack many\n"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// engineResult 実行し終わった状態のうち、エンジンによらず同じになるはずのもの
+type engineResult struct {
+	Failed   bool
+	Specials [HP + 1]int
+	Generals [R10 + 1]Immediate
+	Flags    [ZF + 1]bool
+	Stack    []Immediate
+	Stdout   string
+}
+
+func runWithEngine(program []Code, config Config, engine Engine) engineResult {
+	var out bytes.Buffer
+	config.Engine = engine
+	config.Stdout = &out
+	runtime := NewRuntime(program, &config)
+	err := runtime.Run()
+	result := engineResult{
+		Failed:   err != nil,
+		Specials: runtime.registers.specials,
+		Generals: runtime.registers.generals,
+		Flags:    runtime.registers.flags,
+	}
+	for {
+		v, err := runtime.popFromStack()
+		if err != nil {
+			break
+		}
+		result.Stack = append(result.Stack, v)
+	}
+	result.Stdout = out.String()
+	return result
+}
+
+func TestEngines_SameResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []Code
+		config  Config
+	}{
+		{
+			name: "loop",
+			program: []Code{
+				MOV, R1, Integer(0),
+				MOV, R2, Integer(10),
+				ADD, R1, R2, // 3 loop
+				SUB, R2, Integer(1),
+				JNZ, PcOffset(-6),
+				MOV, R0, Integer(0),
+				SYSCALL,
+			},
+		},
+		{
+			name: "jnz into operand not taken",
+			program: []Code{
+				EQ, Integer(1), Integer(1),
+				JNZ, PcOffset(4),
+				MOV, R1, Integer(999),
+				MOV, R0, Integer(0),
+				SYSCALL,
+			},
+		},
+		{
+			name:    "jmp into operand",
+			program: []Code{JMP, PcOffset(1), MOV, R0, Integer(0), SYSCALL},
+		},
+		{
+			name: "call and ret",
+			program: []Code{
+				CALL, PcOffset(6),
+				MOV, R0, Integer(0),
+				SYSCALL,
+				ENTER, Integer(2),
+				MOV, BpOffset(-1), Integer(42),
+				MOV, R1, BpOffset(-1),
+				LEAVE,
+				RET,
+			},
+		},
+		{
+			name: "stack machine",
+			program: []Code{
+				PUSH, Integer(1),
+				PUSH, Integer(2),
+				PUSH, Integer(3),
+				ROT,
+				SADD,
+				OVER,
+				SWAP,
+				SLT,
+				DUP,
+				MOV, R0, Integer(0),
+				SYSCALL,
+			},
+		},
+		{
+			name: "stack underflow",
+			program: []Code{
+				PUSH, Integer(1),
+				PUSH, Integer(2),
+				ROT,
+			},
+		},
+		{
+			name: "write",
+			program: []Code{
+				ALLOC, Integer(2),
+				POP, R2,
+				STORE, R2, Character('h'),
+				STORE, Integer(1), Character('i'),
+				MOV, R1, Integer(1),
+				MOV, R3, Integer(2),
+				MOV, R0, Integer(1),
+				SYSCALL,
+				MOV, R0, Integer(0),
+				SYSCALL,
+			},
+		},
+		{
+			name: "byte memory",
+			program: []Code{
+				ALLOC, Integer(16),
+				POP, R1,
+				STORE32, R1, Integer(0x11223344),
+				LOAD8, R2, R1,
+				LOAD16, R3, R1,
+				STORE64, Integer(8), Integer(-2),
+				LOAD64, R5, Integer(8),
+				MOV, R0, Integer(0),
+				SYSCALL,
+			},
+			config: Config{Memory: ByteMemory},
+		},
+		{
+			name: "throw",
+			program: []Code{
+				TRY, PcOffset(12),
+				CALL, PcOffset(17),
+				ENDTRY,
+				MOV, R1, Integer(0),
+				MOV, R0, Integer(0),
+				SYSCALL,
+				MOV, R1, R0,
+				MOV, R0, Integer(0),
+				SYSCALL,
+				PUSH, Integer(1),
+				PUSH, Integer(2),
+				THROW, Integer(99),
+			},
+		},
+		{
+			name: "threads",
+			program: []Code{
+				PUSH, Integer(5),
+				LEA, R1, SpOffset(0),
+				SPAWN, PcOffset(13),
+				JOIN, R0,
+				MOV, R2, R0,
+				POP, R3,
+				MOV, R0, Integer(0),
+				SYSCALL,
+				PUSH, Integer(1),
+				POP, R5,
+				LOAD, R0, R1,
+				RET,
+			},
+		},
+		{
+			name: "timer interrupt",
+			program: []Code{
+				STORE, Integer(0), Integer(0),
+				SETVEC, Integer(InterruptTimer), PcOffset(20),
+				LOAD, R1, Integer(0),
+				MOV, R2, R1,
+				EQ, R2, Integer(3),
+				JZ, PcOffset(4),
+				JMP, PcOffset(-11),
+				MOV, R0, Integer(0),
+				SYSCALL,
+				LOAD, R5, Integer(0),
+				ADD, R5, Integer(1),
+				STORE, Integer(0), R5,
+				IRET,
+			},
+			config: Config{TimerInterval: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.StackSize, config.HeapSize = 100, 100
+			want := runWithEngine(tt.program, config, EngineInterpreter)
+			got := runWithEngine(tt.program, config, EngineCompiled)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("diff (-interpreter +compiled):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompile_RejectsInvalidProgram(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []Code
+		want    string
+	}{
+		{
+			name:    "missing operands",
+			program: []Code{MOV, R0},
+			want:    "missing operands",
+		},
+		{
+			name:    "unsupported dst",
+			program: []Code{ADD, Integer(1), Integer(2), MOV, R0, Integer(0), SYSCALL},
+			want:    "unsupported dst",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{StackSize: 100, HeapSize: 100, Engine: EngineCompiled}
+			err := NewRuntime(tt.program, config).Run()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Run() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package vm
+
+import "fmt"
+
+// popValues スタックからn個取り出し、pushした順に並べて返す
+// 足りないときや未定義の値があるときは、何も取り出さずにフォルトにする
+func (r *Runtime) popValues(op Opcode, n int) ([]Immediate, error) {
+	if err := r.checkDepth(op, n); err != nil {
+		return nil, err
+	}
+	top := int(r.getSpecialReg(SP)) - r.stackBase
+	values := make([]Immediate, n)
+	for i := 0; i < n; i++ {
+		v := r.stack[top+i]
+		if v == nil {
+			return nil, faultf(FaultUndefined, "%s: undefined value on stack", op.String())
+		}
+		values[n-1-i] = v
+	}
+	for i := 0; i < n; i++ {
+		if _, err := r.popFromStack(); err != nil {
+			return nil, fmt.Errorf("%s: %w", op.String(), err)
+		}
+	}
+	return values, nil
+}
+
+// checkDepth スタックにn個以上積まれているか、取り出す前に確かめる
+func (r *Runtime) checkDepth(op Opcode, n int) error {
+	sp := int(r.getSpecialReg(SP))
+	if sp < r.stackBase {
+		return faultf(FaultOutOfBounds, "%s: sp is out of stack: %d", op.String(), sp)
+	}
+	if r.stackBase+len(r.stack)-sp < n {
+		return faultf(FaultStackUnderflow, "%s: stack underflow", op.String())
+	}
+	return nil
+}
+
+func (r *Runtime) pushValues(values ...Immediate) error {
+	for _, v := range values {
+		if err := r.pushToStack(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execStackOp オペランドを持たないスタックマシン命令
+func (r *Runtime) execStackOp(op Opcode) error {
+	switch op {
+	case SADD, SSUB:
+		v, err := r.popValues(op, 2)
+		if err != nil {
+			return err
+		}
+		lhs, rhs := v[0], v[1]
+		if !calculable(lhs, rhs) {
+			return faultf(FaultTypeMismatch, "%s: unsupported values: %T, %T", op.String(), lhs, rhs)
+		}
+		var res Immediate
+		switch {
+		case op == SSUB:
+			res = Integer(lhs.Value() - rhs.Value())
+		case typeof(lhs) == TInt:
+			res = Integer(lhs.Value() + rhs.Value())
+		case typeof(lhs) == TChar:
+			res = Character(lhs.Value() + rhs.Value())
+		default:
+			return faultf(FaultTypeMismatch, "%s: unsupported values: %T, %T", op.String(), lhs, rhs)
+		}
+		r.setFlagReg(ZF, res.Value() == 0)
+		return r.pushToStack(res)
+	case SEQ, SNE, SLT, SLE:
+		v, err := r.popValues(op, 2)
+		if err != nil {
+			return err
+		}
+		lhs, rhs := v[0].Value(), v[1].Value()
+		var res bool
+		switch op {
+		case SEQ:
+			res = lhs == rhs
+		case SNE:
+			res = lhs != rhs
+		case SLT:
+			res = lhs < rhs
+		case SLE:
+			res = lhs <= rhs
+		}
+		// JZ/JNZでも分岐できるようにZFにも結果を残す
+		r.setFlagReg(ZF, Boolean(res))
+		return r.pushToStack(Boolean(res))
+	case DUP:
+		// a -> a a
+		v, err := r.popValues(op, 1)
+		if err != nil {
+			return err
+		}
+		return r.pushValues(v[0], v[0])
+	case SWAP:
+		// a b -> b a
+		v, err := r.popValues(op, 2)
+		if err != nil {
+			return err
+		}
+		return r.pushValues(v[1], v[0])
+	case OVER:
+		// a b -> a b a
+		v, err := r.popValues(op, 2)
+		if err != nil {
+			return err
+		}
+		return r.pushValues(v[0], v[1], v[0])
+	case DROP:
+		// a -> 未定義の値でも捨てる
+		if err := r.checkDepth(op, 1); err != nil {
+			return err
+		}
+		_, err := r.popFromStack()
+		return err
+	case ROT:
+		// a b c -> b c a
+		v, err := r.popValues(op, 3)
+		if err != nil {
+			return err
+		}
+		return r.pushValues(v[1], v[2], v[0])
+	default:
+		return fmt.Errorf("execStackOp: unsupported opcode: %s", op.String())
+	}
+}
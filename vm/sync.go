@@ -0,0 +1,184 @@
+package vm
+
+import "fmt"
+
+// channel 容量付きのチャネル
+type channel struct {
+	buf    []Immediate
+	cap    int
+	closed bool
+}
+
+// operandValue レジスタ/スタック/即値のオペランドを値にする
+func (r *Runtime) operandValue(op Opcode, src Code) (Immediate, error) {
+	switch src.(type) {
+	case Register:
+		return r.getReg(src.(Register))
+	case Offset:
+		return r.getStack(src.(Offset))
+	case Immediate:
+		return src.(Immediate), nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported operand: %s", op.String(), src.String())
+	}
+}
+
+// operandAddress [r1+4] のようなアドレスか、アドレスの入ったレジスタ/即値をアドレスにする
+func (r *Runtime) operandAddress(op Opcode, src Code) (int, error) {
+	if addr, ok := src.(Address); ok {
+		return r.effectiveAddress(addr)
+	}
+	v, err := r.operandValue(op, src)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return 0, fmt.Errorf("%s: undefined address: %s", op.String(), src.String())
+	}
+	return v.Value(), nil
+}
+
+func (r *Runtime) channelAt(op Opcode, src Code) (int, *channel, error) {
+	v, err := r.operandValue(op, src)
+	if err != nil {
+		return 0, nil, err
+	}
+	if v == nil || v.Value() < 0 || len(r.channels) <= v.Value() {
+		return 0, nil, fmt.Errorf("%s: no such channel: %v", op.String(), v)
+	}
+	return v.Value(), r.channels[v.Value()], nil
+}
+
+// execSyncOp チャネル/mutex/CASの命令
+// ブロックする場合はPCを進めずにスケジューラへ戻り、起こされたら同じ命令をやり直す
+func (r *Runtime) execSyncOp(op Opcode) error {
+	pc := r.getSpecialReg(PC)
+	switch op {
+	case CHAN:
+		// chan cap
+		size, err := r.operandValue(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		if size == nil || size.Value() <= 0 {
+			return fmt.Errorf("chan: capacity must be positive: %v", size)
+		}
+		r.channels = append(r.channels, &channel{cap: size.Value()})
+		r.relocate(op)
+		return r.setReg(R0, Integer(len(r.channels)-1))
+	case SEND:
+		// send ch value
+		id, ch, err := r.channelAt(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		v, err := r.operandValue(op, r.program[pc+2])
+		if err != nil {
+			return err
+		}
+		if ch.closed {
+			return faultf(FaultChannelClosed, "send: send on closed channel: %d", id)
+		}
+		if len(ch.buf) == ch.cap {
+			return r.block(waitKey{waitChannel, id})
+		}
+		ch.buf = append(ch.buf, v)
+		r.wake(waitKey{waitChannel, id})
+		r.relocate(op)
+		return nil
+	case RECV:
+		// recv dst ch
+		dst, ok := r.program[pc+1].(Register)
+		if !ok {
+			return fmt.Errorf("recv: unsupported dst: %s", r.program[pc+1].String())
+		}
+		id, ch, err := r.channelAt(op, r.program[pc+2])
+		if err != nil {
+			return err
+		}
+		if len(ch.buf) == 0 {
+			if !ch.closed {
+				return r.block(waitKey{waitChannel, id})
+			}
+			// 閉じていて空ならZFを立てる
+			r.setFlagReg(ZF, true)
+			r.relocate(op)
+			return nil
+		}
+		v := ch.buf[0]
+		ch.buf = ch.buf[1:]
+		r.wake(waitKey{waitChannel, id})
+		r.setFlagReg(ZF, false)
+		r.relocate(op)
+		return r.setReg(dst, v)
+	case CLOSE:
+		id, ch, err := r.channelAt(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		if ch.closed {
+			return faultf(FaultChannelClosed, "close: channel already closed: %d", id)
+		}
+		ch.closed = true
+		r.wake(waitKey{waitChannel, id})
+		r.relocate(op)
+		return nil
+	case LOCK:
+		addr, err := r.operandAddress(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		owner, locked := r.mutexes[addr]
+		if locked {
+			if owner == r.current.id {
+				return fmt.Errorf("lock: mutex %d is already held by thread %d", addr, owner)
+			}
+			return r.block(waitKey{waitMutex, addr})
+		}
+		r.mutexes[addr] = r.current.id
+		r.relocate(op)
+		return nil
+	case UNLOCK:
+		addr, err := r.operandAddress(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		owner, locked := r.mutexes[addr]
+		if !locked || owner != r.current.id {
+			return fmt.Errorf("unlock: mutex %d is not held by thread %d", addr, r.current.id)
+		}
+		delete(r.mutexes, addr)
+		r.wake(waitKey{waitMutex, addr})
+		r.relocate(op)
+		return nil
+	case CAS:
+		// cas addr new
+		// [addr] == R0 なら [addr] = new として ZF を立てる。違えば R0 = [addr] として ZF を下ろす
+		addr, err := r.operandAddress(op, r.program[pc+1])
+		if err != nil {
+			return err
+		}
+		v, err := r.operandValue(op, r.program[pc+2])
+		if err != nil {
+			return err
+		}
+		old, err := r.getMemory(addr, 0)
+		if err != nil {
+			return err
+		}
+		expected := r.getGeneralReg(R0)
+		same := old == nil && expected == nil
+		if old != nil && expected != nil {
+			same = old.Value() == expected.Value()
+		}
+		r.relocate(op)
+		if same {
+			r.setFlagReg(ZF, true)
+			return r.setMemory(addr, 0, v)
+		}
+		r.setFlagReg(ZF, false)
+		return r.setReg(R0, old)
+	default:
+		return fmt.Errorf("execSyncOp: unsupported opcode: %s", op.String())
+	}
+}
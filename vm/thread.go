@@ -0,0 +1,238 @@
+package vm
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// SchedulerConfig グリーンスレッドの切り替え方
+type SchedulerConfig struct {
+	// Quantum 1スレッドが連続して実行できる命令数。0 なら yield/join/texit でのみ切り替える
+	Quantum int
+	// Random true なら次に動かすスレッドを Seed から作った乱数で選ぶ。false なら ID 順のラウンドロビン
+	Random bool
+	Seed   int64
+}
+
+type threadState int
+
+const (
+	threadRunnable threadState = iota
+	threadBlocked
+	threadDone
+)
+
+func (s threadState) String() string {
+	return []string{
+		threadRunnable: "runnable",
+		threadBlocked:  "blocked",
+		threadDone:     "done",
+	}[s]
+}
+
+// threadExit spawnしたスレッドの戻りアドレス。ここへretするとスレッドが終了する
+const threadExit = -1
+
+type thread struct {
+	id        int
+	registers registerSet
+	stack     cellMemory
+	// stackBase 確保したスタック領域の先頭アドレス
+	stackBase int
+	// stackFloor スタックを広げられる下限のアドレス。広げないときはstackBaseと同じ
+	stackFloor int
+	state      threadState
+	// waiting ブロックしている理由
+	waiting waitKey
+	// handlers tryで登録した例外ハンドラ。最後が一番内側
+	handlers []handler
+	// calls 実行中の関数を呼び出したcall命令のPC。バックトレースに使う
+	calls []int
+}
+
+type waitKind int
+
+const (
+	waitThread waitKind = iota
+	waitChannel
+	waitMutex
+)
+
+// waitKey スレッドが何を待っているか。id はスレッドID/チャネルID/mutexのアドレス
+type waitKey struct {
+	kind waitKind
+	id   int
+}
+
+func (k waitKey) String() string {
+	switch k.kind {
+	case waitThread:
+		return fmt.Sprintf("join thread %d", k.id)
+	case waitChannel:
+		return fmt.Sprintf("channel %d", k.id)
+	case waitMutex:
+		return fmt.Sprintf("mutex %d", k.id)
+	default:
+		return "unknown"
+	}
+}
+
+// newThread floorからstackLimit分の範囲を予約し、末尾のstackSize分だけを確保する
+func newThread(id, floor, stackSize, stackLimit int) *thread {
+	stackTop := floor + stackLimit
+	t := &thread{
+		id:         id,
+		stack:      make(cellMemory, stackSize),
+		stackBase:  stackTop - stackSize,
+		stackFloor: floor,
+		state:      threadRunnable,
+	}
+	t.registers.specials[BP] = stackTop
+	t.registers.specials[SP] = stackTop
+	return t
+}
+
+// switchTo tを実行中のスレッドにする
+// レジスタはポインタ、スタックはsliceなので、差し替えるだけで元のスレッドにも反映されている
+func (r *Runtime) switchTo(t *thread) {
+	// ヒープは共有なのでHPは引き継ぐ
+	if r.current != nil {
+		t.registers.specials[HP] = r.registers.specials[HP]
+	}
+	r.current = t
+	r.registers = &t.registers
+	r.stack = t.stack
+	r.stackBase = t.stackBase
+	r.ticks = 0
+}
+
+// spawn pcから始まるスレッドを作る。汎用レジスタは呼び出し元からコピーする
+func (r *Runtime) spawn(pc int) (*thread, error) {
+	id := len(r.threads)
+	limit := r.config.stackLimit()
+	t := newThread(id, r.config.heapLimit()+id*limit, r.config.StackSize, limit)
+	for reg, v := range r.registers.generals {
+		t.registers.generals[reg] = v
+	}
+	t.registers.specials[PC] = pc
+	// 先頭の関数がretしたらスレッドを終了させる
+	sp := t.registers.specials[SP] - 1
+	if !r.reserveStack(t, sp) {
+		return nil, faultf(FaultStackOverflow, "spawn: stack overflow")
+	}
+	t.stack[sp-t.stackBase] = Integer(threadExit)
+	t.registers.specials[SP] = sp
+	r.threads = append(r.threads, t)
+	return t, nil
+}
+
+// block 実行中のスレッドをブロックして他のスレッドに切り替える
+// PCは進めないので、起こされたら同じ命令をもう一度実行する
+func (r *Runtime) block(key waitKey) error {
+	r.current.state = threadBlocked
+	r.current.waiting = key
+	return r.schedule()
+}
+
+// wake keyを待っているスレッドを全て起こす
+func (r *Runtime) wake(key waitKey) {
+	for _, t := range r.threads {
+		if t.state == threadBlocked && t.waiting == key {
+			t.state = threadRunnable
+		}
+	}
+}
+
+// exitThread 実行中のスレッドを終了し、joinで待っているスレッドを起こす
+func (r *Runtime) exitThread() {
+	r.current.state = threadDone
+	r.wake(waitKey{waitThread, r.current.id})
+}
+
+// schedule 次に動かすスレッドを選んで切り替える
+func (r *Runtime) schedule() error {
+	var runnable []*thread
+	n := len(r.threads)
+	// 現在のスレッドの次から順に並べ、現在のスレッドを最後にする
+	for i := 1; i <= n; i++ {
+		t := r.threads[(r.current.id+i)%n]
+		if t.state == threadRunnable {
+			runnable = append(runnable, t)
+		}
+	}
+	if len(runnable) == 0 {
+		var blocked []string
+		for _, t := range r.threads {
+			if t.state == threadBlocked {
+				pc := t.registers.specials[PC]
+				blocked = append(blocked, fmt.Sprintf("thread %d at pc %d: %s (%s)", t.id, pc, instructionAt(r.program, pc), t.waiting.String()))
+			}
+		}
+		if len(blocked) != 0 {
+			return fmt.Errorf("deadlock: all threads are blocked:\n\t%s", strings.Join(blocked, "\n\t"))
+		}
+		// 全スレッドが終了した
+		r.halt = true
+		return nil
+	}
+	next := runnable[0]
+	if r.rand != nil {
+		next = runnable[r.rand.Intn(len(runnable))]
+	}
+	if next != r.current {
+		r.switchTo(next)
+	}
+	r.ticks = 0
+	return nil
+}
+
+func newScheduleRand(config SchedulerConfig) *rand.Rand {
+	if !config.Random {
+		return nil
+	}
+	return rand.New(rand.NewSource(config.Seed))
+}
+
+// execThreadOp スレッド操作の命令
+func (r *Runtime) execThreadOp(op Opcode) error {
+	switch op {
+	case SPAWN:
+		dst := r.program[r.getSpecialReg(PC)+1]
+		if _, ok := dst.(PcOffset); !ok {
+			return fmt.Errorf("spawn: unsupported dst: %s", dst.String())
+		}
+		t, err := r.spawn(int(r.getSpecialReg(PC)) + int(dst.(PcOffset)))
+		if err != nil {
+			return err
+		}
+		r.relocate(op)
+		return r.setReg(R0, Integer(t.id))
+	case YIELD:
+		r.relocate(op)
+		return r.schedule()
+	case JOIN:
+		id, err := r.operandValue(op, r.program[r.getSpecialReg(PC)+1])
+		if err != nil {
+			return err
+		}
+		if id == nil || id.Value() < 0 || len(r.threads) <= id.Value() {
+			return fmt.Errorf("join: no such thread: %v", id)
+		}
+		target := r.threads[id.Value()]
+		if target == r.current {
+			return fmt.Errorf("join: thread %d joins itself", target.id)
+		}
+		if target.state != threadDone {
+			return r.block(waitKey{waitThread, target.id})
+		}
+		r.relocate(op)
+		// 終了したスレッドのR0(戻り値)を受け取る
+		return r.setReg(R0, target.registers.generals[R0])
+	case TEXIT:
+		r.exitThread()
+		return r.schedule()
+	default:
+		return fmt.Errorf("execThreadOp: unsupported opcode: %s", op.String())
+	}
+}